@@ -0,0 +1,36 @@
+package action
+
+import (
+	"context"
+	"sync"
+)
+
+// pending tracks the analytics and image index writes running in the
+// background, so shutdown can wait for them.
+var pending sync.WaitGroup
+
+// Background runs fn in a goroutine tracked by WaitBackground.
+func Background(fn func()) {
+	pending.Add(1)
+	go func() {
+		defer pending.Done()
+		fn()
+	}()
+}
+
+// WaitBackground waits for the background writes to finish, or for ctx to
+// be done, whichever comes first.
+func WaitBackground(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
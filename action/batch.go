@@ -0,0 +1,216 @@
+package action
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/siddhartham/imageutil-thumbor/config"
+	"github.com/siddhartham/imageutil-thumbor/model"
+	"github.com/siddhartham/imageutil-thumbor/storage"
+	"github.com/siddhartham/imageutil-thumbor/util"
+)
+
+const (
+	// BatchMaxFiles is the most files a batch can have.
+	BatchMaxFiles = 500
+)
+
+var ErrTooManyFiles = fmt.Errorf("A batch can have at most %d files", BatchMaxFiles)
+
+type batchResult struct {
+	File   string `json:"file"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	ID     string `json:"id,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	Width  int64  `json:"width,omitempty"`
+	Height int64  `json:"height,omitempty"`
+	Format string `json:"format,omitempty"`
+}
+
+type batchResponse struct {
+	Files []*batchResult `json:"files"`
+	Error string         `json:"error,omitempty"`
+}
+
+// BatchUploadHandler uploads every "file" part of the request to the folder
+// of the upload token, naming each file after its part's file name. A name
+// already taken is dealt with as single uploads do, by ?on_conflict=, the
+// folder's or the project's policy, which applies to two files of the batch
+// with the same name too. Files are streamed one after the other, as single
+// uploads are, nothing is buffered. The response has the result of each
+// file, and is a 207 when some of them failed or the request broke off
+// after the first file, a 400 only when it broke off before.
+func BatchUploadHandler(db *sql.DB, store storage.Storage, sc *model.ServerConf, res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	util.LogInfo("BatchUploadHandler", vars["uploadToken"])
+	folder, policy, status, err := checkToken(db, sc, vars["uploadToken"])
+	if err != nil {
+		uploadError(res, "BatchUploadHandler : checkToken", status, err)
+		return
+	}
+
+	onConflict := req.URL.Query().Get("on_conflict")
+	if onConflict != "" && !config.ValidConflict(onConflict) {
+		uploadError(res, "BatchUploadHandler : on_conflict", http.StatusBadRequest, fmt.Errorf("Invalid on_conflict %q", onConflict))
+		return
+	}
+
+	// Limit the batch size, before anything is read
+	files := int64(BatchMaxFiles)
+	if policy.MaxFiles > 0 && policy.MaxFiles < files {
+		files = policy.MaxFiles
+	}
+	limit := files*policy.MaxSize + multipartOverhead
+	if req.ContentLength > limit {
+		uploadError(res, "BatchUploadHandler : ContentLength", http.StatusRequestEntityTooLarge, ErrTooLarge)
+		return
+	}
+	req.Body = http.MaxBytesReader(res, req.Body, limit)
+	mr, err := req.MultipartReader()
+	if err != nil {
+		uploadError(res, "BatchUploadHandler : MultipartReader", http.StatusBadRequest, err)
+		return
+	}
+
+	response := batchResponse{Files: []*batchResult{}}
+	names := &batchNames{db: db, sc: sc, folder: folder, policy: policy, onConflict: onConflict, names: map[string]bool{}, keys: map[string]bool{}}
+	for {
+		part, err := nextFilePart(mr)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			util.LogError("BatchUploadHandler : get file", err.Error())
+			response.Error = err.Error()
+			break
+		}
+		if len(response.Files) == BatchMaxFiles {
+			part.Close()
+			response.Error = ErrTooManyFiles.Error()
+			break
+		}
+		if policy.MaxFiles > 0 && int64(len(response.Files)) == policy.MaxFiles {
+			part.Close()
+			response.Error = ErrNoMoreFiles.Error()
+			break
+		}
+
+		result := &batchResult{File: part.FileName()}
+		response.Files = append(response.Files, result)
+		storeBatchFile(db, store, sc, folder, policy, names, result, part)
+		part.Close()
+	}
+
+	status = http.StatusOK
+	for _, result := range response.Files {
+		if result.Status != http.StatusOK {
+			status = http.StatusMultiStatus
+		}
+	}
+	// the files handled before the request broke off keep their results, a
+	// client must not send them again
+	if response.Error != "" {
+		status = http.StatusMultiStatus
+		if len(response.Files) == 0 {
+			status = http.StatusBadRequest
+		}
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(response)
+}
+
+func storeBatchFile(db *sql.DB, store storage.Storage, sc *model.ServerConf, folder model.Folder, policy model.UploadPolicy, names *batchNames, result *batchResult, r io.Reader) {
+	target, status, err := names.reserve(result.File)
+	if err != nil {
+		result.Status = status
+		result.Error = err.Error()
+		return
+	}
+
+	file, status, err := storeUpload(db, store, sc, folder, policy, target, result.File, r)
+	result.Status = status
+	if err != nil {
+		result.Error = err.Error()
+		names.release(target)
+		return
+	}
+
+	result.ID = file.ID
+	result.Name = file.Name
+	result.Path = file.Path
+	result.Size = file.FileSize
+	result.Width = file.Width
+	result.Height = file.Height
+	result.Format = file.Format
+}
+
+// batchNames hands out the file names and keys of a batch, so two files of
+// the same batch never get the same name or key. A nil batchNames has none.
+type batchNames struct {
+	db         *sql.DB
+	sc         *model.ServerConf
+	folder     model.Folder
+	policy     model.UploadPolicy
+	onConflict string
+	mu         sync.Mutex
+	names      map[string]bool
+	keys       map[string]bool
+}
+
+func (n *batchNames) reserve(fileName string) (uploadTarget, int, error) {
+	fileName = path.Base(strings.ReplaceAll(fileName, "\\", "/"))
+	if len(fileName) < 5 || fileName == "." || fileName == "/" {
+		return uploadTarget{}, http.StatusBadRequest, errors.New("Invalid filename")
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	target, status, err := resolveTarget(n.db, n.sc, n.folder, n.policy, fileName, n.onConflict, n)
+	if err != nil {
+		return target, status, err
+	}
+	n.names[target.Name] = true
+	n.keys[target.Key] = true
+	return target, http.StatusOK, nil
+}
+
+func (n *batchNames) release(target uploadTarget) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.names, target.Name)
+	delete(n.keys, target.Key)
+}
+
+func (n *batchNames) hasName(name string) bool {
+	return n != nil && n.names[name]
+}
+
+func (n *batchNames) hasKey(key string) bool {
+	return n != nil && n.keys[key]
+}
+
+// uniqueName returns fileName, or when it is taken the first of
+// "name (1).ext", "name (2).ext"... that is not.
+func uniqueName(fileName string, taken func(string) bool) string {
+	ext := path.Ext(fileName)
+	base := strings.TrimSuffix(fileName, ext)
+	name := fileName
+	for i := 1; taken(name); i++ {
+		name = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	return name
+}
@@ -0,0 +1,164 @@
+package action
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/siddhartham/imageutil-thumbor/config"
+	"github.com/siddhartham/imageutil-thumbor/model"
+	"github.com/siddhartham/imageutil-thumbor/storage"
+	"github.com/siddhartham/imageutil-thumbor/util"
+)
+
+// uploadTarget is where an upload goes once name conflicts are resolved.
+// Existing is the file it replaces, when overwriting or versioning.
+type uploadTarget struct {
+	Name     string
+	Key      string
+	Mode     string
+	Existing *model.Folder
+}
+
+// resolveTarget decides where fileName is uploaded in folder. When the
+// folder already has a file of that name, the conflict policy requested,
+// else the folder's, else the project's decides. batch holds the names and
+// keys handed out to the other files of a batch upload, nil outside one.
+func resolveTarget(db *sql.DB, sc *model.ServerConf, folder model.Folder, policy model.UploadPolicy, fileName string, requested string, batch *batchNames) (uploadTarget, int, error) {
+	target := uploadTarget{Name: fileName}
+	if requested != "" && !config.ValidConflict(requested) {
+		return target, http.StatusBadRequest, fmt.Errorf("Invalid on_conflict %q", requested)
+	}
+
+	existing, err := getFile(db, folder, fileName)
+	if err != nil && err != sql.ErrNoRows {
+		return target, http.StatusInternalServerError, err
+	}
+	if err == sql.ErrNoRows && !batch.hasName(fileName) {
+		target.Key = freeKey(db, sc, folder, fileName, batch)
+		return target, http.StatusOK, nil
+	}
+
+	target.Mode = requested
+	if target.Mode == "" {
+		db.QueryRow("SELECT COALESCE(conflict_policy, '') FROM folders WHERE project_id=? AND id=?", folder.ProjectID, folder.ID).Scan(&target.Mode)
+	}
+	if target.Mode == "" {
+		target.Mode = policy.OnConflict
+	}
+
+	switch target.Mode {
+	case model.ConflictOverwrite, model.ConflictVersion:
+		// another file of the batch has the name, and is not stored yet
+		if batch.hasName(fileName) {
+			return target, http.StatusConflict, errors.New("File with same name is already in this batch")
+		}
+		target.Existing = &existing
+		target.Key = existing.Path
+	case model.ConflictRename:
+		target.Name = uniqueName(fileName, func(name string) bool {
+			return batch.hasName(name) || fileExists(db, folder, name)
+		})
+		target.Key = freeKey(db, sc, folder, target.Name, batch)
+	default:
+		return target, http.StatusConflict, errors.New("File with same name already exists in this folder")
+	}
+	return target, http.StatusOK, nil
+}
+
+// freeKey returns the key a new file named fileName is stored at in folder:
+// its own, unless a file renamed or moved away is still stored there, or
+// another file of the batch got it, then the first free of "name (1).ext"...
+func freeKey(db *sql.DB, sc *model.ServerConf, folder model.Folder, fileName string, batch *batchNames) string {
+	return mediaKey(sc, folder, uniqueName(fileName, func(name string) bool {
+		key := mediaKey(sc, folder, name)
+		return batch.hasKey(key) || keyTaken(db, folder, key)
+	}))
+}
+
+// getFile returns the file named fileName in folder.
+func getFile(db *sql.DB, folder model.Folder, fileName string) (model.Folder, error) {
+	return scanLibraryItem(db.QueryRow("SELECT "+libraryColumns+" FROM folders WHERE project_id=? AND folder_id=? AND is_file=1 AND name=?", folder.ProjectID, folder.ID, fileName))
+}
+
+// versionFile copies file to a version of its own before it is
+// overwritten, and records the version in the folder_versions table.
+func versionFile(db *sql.DB, store storage.Storage, file model.Folder) error {
+	version := 0
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) + 1 FROM folder_versions WHERE file_id=?", file.ID).Scan(&version)
+	if err != nil {
+		return err
+	}
+	versionKey := path.Join(path.Dir(file.Path), ".versions", strconv.Itoa(version), path.Base(file.Path))
+
+	r, _, err := store.Get(file.Path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := store.Put(versionKey, r, file.MimeType); err != nil {
+		return err
+	}
+
+	_, err = db.Exec("INSERT INTO folder_versions (id, file_id, project_id, version, path, original_name, mime_type, file_size, width, height, format, created_at) VALUES (NULL, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW())",
+		file.ID, file.ProjectID, version, versionKey, file.OriginalName, file.MimeType, file.FileSize, file.Width, file.Height, file.Format)
+	if err != nil {
+		return err
+	}
+	util.LogInfo("versionFile : ", versionKey)
+	return nil
+}
+
+// deleteVersions deletes the versions kept of file.
+func deleteVersions(db *sql.DB, store storage.Storage, file model.Folder) error {
+	rows, err := db.Query("SELECT path FROM folder_versions WHERE file_id=?", file.ID)
+	if err != nil {
+		return err
+	}
+	keys := []string{}
+	for rows.Next() {
+		key := ""
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+
+	for _, key := range keys {
+		if err := store.Delete(key); err != nil && err != storage.ErrNotFound {
+			return err
+		}
+	}
+	_, err = db.Exec("DELETE FROM folder_versions WHERE file_id=?", file.ID)
+	return err
+}
+
+// replaceFile updates the row of a file overwritten in storage and
+// invalidates the images rendered from the old one.
+func replaceFile(db *sql.DB, store storage.Storage, sc *model.ServerConf, existing model.Folder, fileSize int64, mimeType string, originalName string, header imageHeader) (model.Folder, error) {
+	file := existing
+	file.OriginalName = originalName
+	file.MimeType = mimeType
+	file.FileSize = fileSize
+	file.Width = header.Width
+	file.Height = header.Height
+	file.Format = header.Format
+
+	_, err := db.Exec("UPDATE folders SET original_name=?, mime_type=?, file_size=?, width=?, height=?, format=?, updated_at=NOW() WHERE id=?",
+		file.OriginalName, file.MimeType, file.FileSize, file.Width, file.Height, file.Format, file.ID)
+	if err != nil {
+		return file, err
+	}
+
+	images, err := invalidateImages(db, store, file.ProjectID, mediaOriginPath(sc, file.Path), false)
+	if err != nil {
+		util.LogError("replaceFile : invalidateImages", err.Error())
+	}
+	purgeCdnInBackground(sc, file.ProjectID, images)
+	return file, nil
+}
@@ -0,0 +1,288 @@
+package action
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/siddhartham/imageutil-thumbor/model"
+	"github.com/siddhartham/imageutil-thumbor/storage"
+)
+
+// fakeDB answers the queries of the conflict policies from the rows of a
+// folders table, with no database server. The queries it does not know
+// fail.
+type fakeDB struct {
+	mu       sync.Mutex
+	folders  []model.Folder
+	versions [][]driver.Value
+}
+
+func (f *fakeDB) query(q string, args []driver.Value) ([][]driver.Value, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rows := [][]driver.Value{}
+	switch {
+	case strings.Contains(q, "FROM folders WHERE project_id=? AND folder_id=? AND is_file=1 AND name=?"):
+		for _, r := range f.folders {
+			if r.ProjectID == args[0] && r.FolderID == args[1] && r.IsFile == "1" && r.Name == args[2] {
+				rows = append(rows, []driver.Value{r.ID, r.FolderID, r.IsFile, r.Name, r.Path, r.UserID, r.ProjectID,
+					r.OriginalName, r.MimeType, r.FileSize, r.Width, r.Height, r.Format, r.ConflictPolicy})
+			}
+		}
+	case strings.HasPrefix(q, "SELECT COALESCE(conflict_policy, '') FROM folders WHERE project_id=? AND id=?"):
+		for _, r := range f.folders {
+			if r.ProjectID == args[0] && r.ID == args[1] {
+				rows = append(rows, []driver.Value{r.ConflictPolicy})
+			}
+		}
+	case strings.HasPrefix(q, "SELECT id FROM folders where project_id=? and user_id=? and folder_id=? and name=?"):
+		for _, r := range f.folders {
+			if r.ProjectID == args[0] && r.UserID == args[1] && r.FolderID == args[2] && r.Name == args[3] {
+				rows = append(rows, []driver.Value{r.ID})
+			}
+		}
+	case strings.HasPrefix(q, "SELECT id FROM folders WHERE project_id=? AND is_file=1 AND path=?"):
+		for _, r := range f.folders {
+			if r.ProjectID == args[0] && r.IsFile == "1" && r.Path == args[1] {
+				rows = append(rows, []driver.Value{r.ID})
+			}
+		}
+	case strings.HasPrefix(q, "SELECT COALESCE(MAX(version), 0) + 1 FROM folder_versions WHERE file_id=?"):
+		version := int64(1)
+		for _, v := range f.versions {
+			if v[0] == args[0] && v[2].(int64) >= version {
+				version = v[2].(int64) + 1
+			}
+		}
+		rows = append(rows, []driver.Value{version})
+	case strings.HasPrefix(q, "INSERT INTO folder_versions"):
+		f.versions = append(f.versions, args)
+	default:
+		return nil, fmt.Errorf("unexpected query %q", q)
+	}
+	return rows, nil
+}
+
+func (f *fakeDB) open() *sql.DB {
+	return sql.OpenDB(fakeConnector{f})
+}
+
+type fakeConnector struct{ db *fakeDB }
+
+func (c fakeConnector) Connect(context.Context) (driver.Conn, error) { return fakeConn(c), nil }
+func (c fakeConnector) Driver() driver.Driver                        { return c }
+func (c fakeConnector) Open(string) (driver.Conn, error)             { return fakeConn(c), nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(q string) (driver.Stmt, error) { return fakeStmt{c.db, q}, nil }
+func (c fakeConn) Close() error                          { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)             { return nil, errors.New("no transactions") }
+
+type fakeStmt struct {
+	db *fakeDB
+	q  string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if _, err := s.db.query(s.q, args); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows, err := s.db.query(s.q, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{rows: rows}, nil
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		// no row to scan, the count does not matter
+		return []string{""}
+	}
+	return make([]string, len(r.rows[0]))
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+var (
+	conflictConf = &model.ServerConf{MediaStorage: "media"}
+	photos       = model.Folder{ID: "10", ProjectID: "p", UserID: "u", Path: "p/photos"}
+	// another folder, with a conflict policy of its own
+	albums = model.Folder{ID: "11", ProjectID: "p", UserID: "u", Path: "p/albums", ConflictPolicy: model.ConflictRename}
+)
+
+func conflictDB() *fakeDB {
+	file := func(id string, folder model.Folder, name string, key string) model.Folder {
+		return model.Folder{ID: id, ProjectID: "p", UserID: "u", FolderID: folder.ID, IsFile: "1", Name: name, Path: "media/" + folder.Path + "/" + key, MimeType: "image/jpeg"}
+	}
+	photosRow, albumsRow := photos, albums
+	photosRow.IsFile, albumsRow.IsFile = "0", "0"
+	return &fakeDB{folders: []model.Folder{
+		photosRow,
+		albumsRow,
+		file("1", photos, "a.jpg", "a.jpg"),
+		file("2", photos, "a (1).jpg", "a (1).jpg"),
+		// renamed, still stored at the key of its first name
+		file("3", photos, "moved.jpg", "b.jpg"),
+		file("4", albums, "a.jpg", "a.jpg"),
+	}}
+}
+
+// testBatch returns the names of a batch which already reserved name and
+// key, in folder.
+func testBatch(name string, key string) *batchNames {
+	return &batchNames{names: map[string]bool{name: true}, keys: map[string]bool{"media/p/photos/" + key: true}}
+}
+
+func TestResolveTarget(t *testing.T) {
+	db := conflictDB().open()
+	defer db.Close()
+
+	tests := []struct {
+		name      string
+		folder    model.Folder
+		project   string
+		fileName  string
+		requested string
+		batch     *batchNames
+		status    int
+		want      uploadTarget
+		existing  string
+	}{
+		{"new name", photos, model.ConflictReject, "c.jpg", "", nil, http.StatusOK, uploadTarget{Name: "c.jpg", Key: "media/p/photos/c.jpg"}, ""},
+		{"key of a renamed file", photos, model.ConflictReject, "b.jpg", "", nil, http.StatusOK, uploadTarget{Name: "b.jpg", Key: "media/p/photos/b (1).jpg"}, ""},
+		{"rejected", photos, model.ConflictReject, "a.jpg", "", nil, http.StatusConflict, uploadTarget{}, ""},
+		{"overwritten", photos, model.ConflictReject, "a.jpg", model.ConflictOverwrite, nil, http.StatusOK, uploadTarget{Name: "a.jpg", Key: "media/p/photos/a.jpg", Mode: model.ConflictOverwrite}, "1"},
+		{"versioned", photos, model.ConflictReject, "a.jpg", model.ConflictVersion, nil, http.StatusOK, uploadTarget{Name: "a.jpg", Key: "media/p/photos/a.jpg", Mode: model.ConflictVersion}, "1"},
+		{"renamed", photos, model.ConflictReject, "a.jpg", model.ConflictRename, nil, http.StatusOK, uploadTarget{Name: "a (2).jpg", Key: "media/p/photos/a (2).jpg", Mode: model.ConflictRename}, ""},
+		{"project policy", photos, model.ConflictOverwrite, "a.jpg", "", nil, http.StatusOK, uploadTarget{Name: "a.jpg", Key: "media/p/photos/a.jpg", Mode: model.ConflictOverwrite}, "1"},
+		{"folder policy", albums, model.ConflictReject, "a.jpg", "", nil, http.StatusOK, uploadTarget{Name: "a (1).jpg", Key: "media/p/albums/a (1).jpg", Mode: model.ConflictRename}, ""},
+		{"requested over folder policy", albums, model.ConflictReject, "a.jpg", model.ConflictReject, nil, http.StatusConflict, uploadTarget{}, ""},
+		{"invalid policy", photos, model.ConflictReject, "a.jpg", "replace", nil, http.StatusBadRequest, uploadTarget{}, ""},
+		// names and keys taken by other files of a batch
+		{"batch name rejected", photos, model.ConflictReject, "c.jpg", "", testBatch("c.jpg", "c.jpg"), http.StatusConflict, uploadTarget{}, ""},
+		{"batch name not overwritten", photos, model.ConflictOverwrite, "c.jpg", "", testBatch("c.jpg", "c.jpg"), http.StatusConflict, uploadTarget{}, ""},
+		{"batch name renamed", photos, model.ConflictRename, "c.jpg", "", testBatch("c.jpg", "c.jpg"), http.StatusOK, uploadTarget{Name: "c (1).jpg", Key: "media/p/photos/c (1).jpg", Mode: model.ConflictRename}, ""},
+		{"batch key", photos, model.ConflictReject, "d.jpg", "", testBatch("x.jpg", "d.jpg"), http.StatusOK, uploadTarget{Name: "d.jpg", Key: "media/p/photos/d (1).jpg"}, ""},
+	}
+	for _, tt := range tests {
+		policy := model.UploadPolicy{OnConflict: tt.project}
+		target, status, err := resolveTarget(db, conflictConf, tt.folder, policy, tt.fileName, tt.requested, tt.batch)
+		if status != tt.status || (err == nil) != (status == http.StatusOK) {
+			t.Errorf("%s: got %d, %v, want %d", tt.name, status, err, tt.status)
+			continue
+		}
+		if status != http.StatusOK {
+			continue
+		}
+		existing := ""
+		if target.Existing != nil {
+			existing = target.Existing.ID
+		}
+		target.Existing = nil
+		if target != tt.want || existing != tt.existing {
+			t.Errorf("%s: got %+v replacing %q, want %+v replacing %q", tt.name, target, existing, tt.want, tt.existing)
+		}
+	}
+}
+
+func TestFreeKey(t *testing.T) {
+	db := conflictDB().open()
+	defer db.Close()
+
+	tests := []struct {
+		fileName string
+		batch    *batchNames
+		want     string
+	}{
+		{"c.jpg", nil, "media/p/photos/c.jpg"},
+		{"a.jpg", nil, "media/p/photos/a (2).jpg"},
+		{"b.jpg", nil, "media/p/photos/b (1).jpg"},
+		{"c.jpg", testBatch("x.jpg", "c.jpg"), "media/p/photos/c (1).jpg"},
+		{"b.jpg", testBatch("x.jpg", "b (1).jpg"), "media/p/photos/b (2).jpg"},
+	}
+	for _, tt := range tests {
+		if got := freeKey(db, conflictConf, photos, tt.fileName, tt.batch); got != tt.want {
+			t.Errorf("freeKey(%q) = %q, want %q", tt.fileName, got, tt.want)
+		}
+	}
+}
+
+func TestVersionFile(t *testing.T) {
+	fake := conflictDB()
+	db := fake.open()
+	defer db.Close()
+	store := storage.NewMemoryStorage()
+	file := fake.folders[2]
+	if err := store.Put(file.Path, strings.NewReader("first"), file.MimeType); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, version := range []string{"1", "2"} {
+		if err := versionFile(db, store, file); err != nil {
+			t.Fatalf("version %s: %v", version, err)
+		}
+		key := "media/p/photos/.versions/" + version + "/a.jpg"
+		if got := read(t, store, key); got != "first" {
+			t.Errorf("version %s: got %q, want %q", version, got, "first")
+		}
+	}
+	if len(fake.versions) != 2 {
+		t.Fatalf("got %d versions recorded, want 2", len(fake.versions))
+	}
+	if v := fake.versions[1]; v[0] != "1" || v[1] != "p" || v[2] != int64(2) || v[3] != "media/p/photos/.versions/2/a.jpg" {
+		t.Errorf("got version %v", v)
+	}
+
+	// a file missing from storage is not versioned
+	if err := versionFile(db, store, fake.folders[3]); err != storage.ErrNotFound {
+		t.Errorf("got %v, want %v", err, storage.ErrNotFound)
+	}
+	if len(fake.versions) != 2 {
+		t.Errorf("got %d versions recorded, want 2", len(fake.versions))
+	}
+}
+
+func read(t *testing.T, store storage.Storage, key string) string {
+	t.Helper()
+	r, _, err := store.Get(key)
+	if err != nil {
+		t.Fatalf("%s: %v", key, err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
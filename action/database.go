@@ -11,8 +11,8 @@ import (
 )
 
 func GetProject(db *sql.DB, projectID string, project *model.Project) (string, error) {
-	sqlStm := fmt.Sprintf("SELECT id, user_id, uuid, fqdn, protocol, base_path FROM projects where uuid = '%s' and is_active=1", projectID)
-	err := db.QueryRow(sqlStm).Scan(&project.ID, &project.UserID, &project.Uuid, &project.Fqdn, &project.Protocol, &project.BasePath)
+	// the project id comes from the url, so it is passed as a parameter
+	err := db.QueryRow("SELECT id, user_id, uuid, fqdn, protocol, base_path FROM projects where uuid = ? and is_active=1", projectID).Scan(&project.ID, &project.UserID, &project.Uuid, &project.Fqdn, &project.Protocol, &project.BasePath)
 
 	projectImageOrigin := fmt.Sprintf("%s://%s", project.Protocol, project.Fqdn)
 	if project.BasePath != "" {
@@ -36,25 +36,38 @@ func GetImage(db *sql.DB, isSmart bool, projectImageOrigin string, originPath st
 	analytic.UserID = project.UserID
 	analytic.ProjectID = project.ID
 
-	sqlStm := fmt.Sprintf("SELECT id, cdn_path, file_size FROM images where project_id = %s and origin_path = '%s' and transformation = '%s' and is_smart = %s", image.ProjectID, image.OriginPath, image.Transformation, image.IsSmart)
-	err := db.QueryRow(sqlStm).Scan(&image.ID, &image.CdnPath, &image.FileSize)
+	err := db.QueryRow("SELECT id, cdn_path, file_size, COALESCE(origin_etag, ''), COALESCE(origin_last_modified, ''), UNIX_TIMESTAMP(COALESCE(validated_at, created_at)), UNIX_TIMESTAMP(created_at) FROM images WHERE project_id=? AND origin_path=? AND transformation=? AND is_smart=?",
+		image.ProjectID, image.OriginPath, image.Transformation, image.IsSmart).Scan(&image.ID, &image.CdnPath, &image.FileSize, &image.OriginETag, &image.OriginLastModified, &image.ValidatedAt, &image.RenderedAt)
 
 	return err
 }
 
 func SaveImageUrl(db *sql.DB, image model.Image, analytic model.Analytic) {
-	sqlStm := fmt.Sprintf("INSERT INTO images (id, user_id, project_id, store_key, origin, origin_path, transformation, is_smart, cdn_path, file_size, created_at, updated_at, host_domain ) VALUES ( NULL, %s, %s, '%s', '%s', '%s', '%s', '%s', '%s', 0, NOW(), NOW(), 'transform.imageutil.io')", image.UserID, image.ProjectID, image.Key, image.Origin, image.OriginPath, image.Transformation, image.IsSmart, image.CdnPath)
-	insert, err := db.Exec(sqlStm)
+	insert, err := db.Exec("INSERT INTO images (id, user_id, project_id, store_key, origin, origin_path, transformation, is_smart, cdn_path, file_size, created_at, updated_at, host_domain) VALUES (NULL, ?, ?, ?, ?, ?, ?, ?, ?, 0, NOW(), NOW(), 'transform.imageutil.io')",
+		image.UserID, image.ProjectID, image.Key, image.Origin, image.OriginPath, image.Transformation, image.IsSmart, image.CdnPath)
 	if err != nil {
-		util.LogWarning("saveImageUrl : INSERT", sqlStm)
+		util.LogWarning("saveImageUrl : INSERT", image.OriginPath)
 		util.LogError("saveImageUrl : INSERT", err.Error())
 	} else {
 		id, _ := insert.LastInsertId()
 		analytic.ImageID = strconv.FormatInt(id, 10)
+		image.ID = analytic.ImageID
+		if image.OriginETag != "" || image.OriginLastModified != "" {
+			TouchImage(db, image)
+		}
 		SaveAnalytic(db, image, analytic, 1, 1, 0)
 	}
 }
 
+// TouchImage records that the source of an image was checked just now, and
+// the validators it had.
+func TouchImage(db *sql.DB, image model.Image) {
+	_, err := db.Exec("UPDATE images SET origin_etag=?, origin_last_modified=?, validated_at=NOW() WHERE id=?", image.OriginETag, image.OriginLastModified, image.ID)
+	if err != nil {
+		util.LogError("touchImage : UPDATE", err.Error())
+	}
+}
+
 func UpdateImageFileSize(db *sql.DB, image model.Image) {
 	sqlStm, err := db.Prepare("UPDATE images SET file_size=?  WHERE id=?")
 	if err != nil {
@@ -67,15 +80,14 @@ func UpdateImageFileSize(db *sql.DB, image model.Image) {
 }
 
 func SaveAnalytic(db *sql.DB, image model.Image, analytic model.Analytic, incrUniq int64, incrTotal int64, incrBytes int64) {
-	sqlStm := fmt.Sprintf("SELECT id, uniq_request, total_request, total_bytes FROM analytics where project_id = %s and DATE(created_at) = CURDATE()", analytic.ProjectID)
-	err := db.QueryRow(sqlStm).Scan(&analytic.ID, &analytic.UniqRequest, &analytic.TotalRequest, &analytic.TotalBytes)
+	err := db.QueryRow("SELECT id, uniq_request, total_request, total_bytes FROM analytics where project_id = ? and DATE(created_at) = CURDATE()", analytic.ProjectID).Scan(&analytic.ID, &analytic.UniqRequest, &analytic.TotalRequest, &analytic.TotalBytes)
 	if err != nil {
 		util.LogWarning("saveAnalytic : SELECT", err.Error())
 		analytic.UniqRequest = 1
 		analytic.TotalRequest = 1
 		analytic.TotalBytes = incrBytes
-		sqlStm = fmt.Sprintf("INSERT INTO analytics (id, user_id, project_id, uniq_request, total_request, total_bytes, last_image_id, created_at, updated_at) VALUES ( NULL, %s, %s, '%d', '%d', '%d', '%s', NOW(), NOW() )", analytic.UserID, analytic.ProjectID, analytic.UniqRequest, analytic.TotalRequest, analytic.TotalBytes, analytic.ImageID)
-		_, err := db.Exec(sqlStm)
+		_, err := db.Exec("INSERT INTO analytics (id, user_id, project_id, uniq_request, total_request, total_bytes, last_image_id, created_at, updated_at) VALUES ( NULL, ?, ?, ?, ?, ?, ?, NOW(), NOW() )",
+			analytic.UserID, analytic.ProjectID, analytic.UniqRequest, analytic.TotalRequest, analytic.TotalBytes, analytic.ImageID)
 		if err != nil {
 			util.LogError("saveAnalytic : INSERT", err.Error())
 		}
@@ -0,0 +1,202 @@
+package action
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/siddhartham/imageutil-thumbor/storage"
+)
+
+var errInvalidJpeg = errors.New("Invalid jpeg")
+
+// exifStripper streams a jpeg without its APP1 Exif segments. Segments are
+// parsed up to the start of scan, the image data after it is copied as is.
+// An orientation other than 1 is kept, in a minimal Exif segment of its
+// own, so photos taken sideways are still shown upright.
+type exifStripper struct {
+	r       *bufio.Reader
+	out     bytes.Buffer
+	started bool
+	inScan  bool
+}
+
+func newExifStripper(r io.Reader) io.Reader {
+	return &exifStripper{r: bufio.NewReader(r)}
+}
+
+// stripStored stores the jpeg at src, without its Exif data, at dst and
+// returns the size stored. dst is written as src is read, so it must be
+// another key.
+func stripStored(store storage.Storage, src string, dst string, mimeType string) (int64, error) {
+	body, _, err := store.Get(src)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	stored := &countingReader{r: newExifStripper(body)}
+	if err := store.Put(dst, stored, mimeType); err != nil {
+		return 0, err
+	}
+	return stored.n, nil
+}
+
+func (e *exifStripper) Read(p []byte) (int, error) {
+	for e.out.Len() == 0 && !e.inScan {
+		if err := e.next(); err != nil {
+			return 0, err
+		}
+	}
+	if e.out.Len() > 0 {
+		return e.out.Read(p)
+	}
+	return e.r.Read(p)
+}
+
+// next moves the next marker segment to out, unless it is Exif.
+func (e *exifStripper) next() error {
+	if !e.started {
+		soi := make([]byte, 2)
+		if _, err := io.ReadFull(e.r, soi); err != nil {
+			return err
+		}
+		if soi[0] != 0xFF || soi[1] != 0xD8 {
+			return errInvalidJpeg
+		}
+		e.started = true
+		e.out.Write(soi)
+		return nil
+	}
+
+	b, err := e.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b != 0xFF {
+		return errInvalidJpeg
+	}
+	marker, err := e.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	// fill bytes
+	for marker == 0xFF {
+		if marker, err = e.r.ReadByte(); err != nil {
+			return err
+		}
+	}
+
+	// markers without a payload
+	if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD9) {
+		e.out.Write([]byte{0xFF, marker})
+		return nil
+	}
+
+	size := make([]byte, 2)
+	if _, err := io.ReadFull(e.r, size); err != nil {
+		return err
+	}
+	length := int(size[0])<<8 | int(size[1])
+	if length < 2 {
+		return errInvalidJpeg
+	}
+	payload := make([]byte, length-2)
+	if _, err := io.ReadFull(e.r, payload); err != nil {
+		return err
+	}
+
+	if marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+		if orientation := tiffOrientation(payload[6:]); orientation != 1 {
+			e.out.Write(orientationSegment(orientation))
+		}
+		return nil
+	}
+	e.out.Write([]byte{0xFF, marker})
+	e.out.Write(size)
+	e.out.Write(payload)
+
+	// start of scan, the entropy coded data follows
+	if marker == 0xDA {
+		e.inScan = true
+	}
+	return nil
+}
+
+// orientationSegment returns an APP1 Exif segment holding only the
+// orientation tag, in a big endian TIFF structure of a single IFD.
+func orientationSegment(orientation int) []byte {
+	segment := []byte{0xFF, 0xE1, 0, 34}
+	segment = append(segment, "Exif\x00\x00MM\x00\x2A"...)
+	// offset of the IFD, its entry count and the orientation as a SHORT
+	segment = append(segment, 0, 0, 0, 8, 0, 1)
+	segment = append(segment, 0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(orientation), 0, 0)
+	// no next IFD
+	return append(segment, 0, 0, 0, 0)
+}
+
+// exifOrientation returns the EXIF orientation of a jpeg, 1 to 8, or 1
+// when it has none.
+func exifOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		// start of scan or end of image, no more metadata
+		if marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return 1
+		}
+		segment := data[i+4 : end]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		i = end
+	}
+	return 1
+}
+
+// tiffOrientation reads the orientation tag of the first IFD of the TIFF
+// structure EXIF data is kept in.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[offset : offset+2]))
+	for n := 0; n < count; n++ {
+		entry := offset + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:entry+2]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8 : entry+10]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
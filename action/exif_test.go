@@ -0,0 +1,149 @@
+package action
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/jpeg"
+	"io/ioutil"
+	"testing"
+
+	"github.com/siddhartham/imageutil-thumbor/storage"
+)
+
+// exifPayload returns the payload of an APP1 Exif segment in a little
+// endian TIFF structure, holding a make tag and the orientation, if any.
+func exifPayload(orientation int) []byte {
+	entries := [][]byte{entry(0x010F, 2, 4, []byte("Cam\x00"))}
+	if orientation > 0 {
+		entries = append(entries, entry(0x0112, 3, 1, []byte{byte(orientation), 0, 0, 0}))
+	}
+	payload := []byte("Exif\x00\x00II\x2A\x00\x08\x00\x00\x00")
+	payload = append(payload, byte(len(entries)), 0)
+	for _, e := range entries {
+		payload = append(payload, e...)
+	}
+	return append(payload, 0, 0, 0, 0)
+}
+
+// entry returns a little endian IFD entry with its value inline.
+func entry(tag uint16, kind uint16, count uint32, value []byte) []byte {
+	e := make([]byte, 8, 12)
+	binary.LittleEndian.PutUint16(e[0:], tag)
+	binary.LittleEndian.PutUint16(e[2:], kind)
+	binary.LittleEndian.PutUint32(e[4:], count)
+	return append(e, value...)
+}
+
+func TestExifStripper(t *testing.T) {
+	img := testJPEG(t, 16, 8)
+	xmp := append([]byte("http://ns.adobe.com/xap/1.0/\x00"), "<x:xmpmeta/>"...)
+
+	tests := []struct {
+		name        string
+		data        []byte
+		want        []byte
+		orientation int
+	}{
+		{"no exif", img, img, 1},
+		{"exif removed", withSegment(img, 0xE1, exifPayload(0)), img, 1},
+		{"upright orientation dropped", withSegment(img, 0xE1, exifPayload(1)), img, 1},
+		{"orientation kept", withSegment(img, 0xE1, exifPayload(6)), append(append(img[:2:2], orientationSegment(6)...), img[2:]...), 6},
+		{"every exif segment removed", withSegment(withSegment(img, 0xE1, exifPayload(0)), 0xE1, exifPayload(0)), img, 1},
+		{"xmp kept", withSegment(img, 0xE1, xmp), withSegment(img, 0xE1, xmp), 1},
+	}
+	for _, tt := range tests {
+		got, err := ioutil.ReadAll(newExifStripper(bytes.NewReader(tt.data)))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got %d bytes, want %d", tt.name, len(got), len(tt.want))
+		}
+		if orientation := exifOrientation(got); orientation != tt.orientation {
+			t.Errorf("%s: got orientation %d, want %d", tt.name, orientation, tt.orientation)
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(got)); err != nil {
+			t.Errorf("%s: stripped jpeg does not decode: %v", tt.name, err)
+		}
+	}
+}
+
+func TestExifStripperInvalid(t *testing.T) {
+	img := testJPEG(t, 16, 8)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"not a jpeg", []byte("GIF89a, not a jpeg")},
+		{"no marker", append(img[:2:2], 0x00, 0x10)},
+		{"short segment", append(img[:2:2], 0xFF, 0xE1, 0x00, 0x01)},
+	}
+	for _, tt := range tests {
+		if _, err := ioutil.ReadAll(newExifStripper(bytes.NewReader(tt.data))); err != errInvalidJpeg {
+			t.Errorf("%s: got %v, want %v", tt.name, err, errInvalidJpeg)
+		}
+	}
+}
+
+func TestOrientationSegment(t *testing.T) {
+	for orientation := 1; orientation <= 8; orientation++ {
+		segment := orientationSegment(orientation)
+		if length := int(binary.BigEndian.Uint16(segment[2:4])); length != len(segment)-2 {
+			t.Errorf("%d: segment length %d, want %d", orientation, length, len(segment)-2)
+		}
+		if got := tiffOrientation(segment[10:]); got != orientation {
+			t.Errorf("%d: got orientation %d", orientation, got)
+		}
+	}
+}
+
+func TestExifOrientation(t *testing.T) {
+	img := testJPEG(t, 16, 8)
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"no exif", img, 1},
+		{"little endian", withSegment(img, 0xE1, exifPayload(8)), 8},
+		{"big endian", append(append(img[:2:2], orientationSegment(3)...), img[2:]...), 3},
+		{"no orientation tag", withSegment(img, 0xE1, exifPayload(0)), 1},
+		{"out of range", withSegment(img, 0xE1, exifPayload(9)), 1},
+		{"not a jpeg", []byte("not a jpeg"), 1},
+		{"truncated", withSegment(img, 0xE1, exifPayload(6))[:20], 1},
+	}
+	for _, tt := range tests {
+		if got := exifOrientation(tt.data); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStripStored(t *testing.T) {
+	img := testJPEG(t, 16, 8)
+	store := storage.NewMemoryStorage()
+	if err := store.Put("staging/a.jpg", bytes.NewReader(withSegment(img, 0xE1, exifPayload(0))), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := stripStored(store, "staging/a.jpg", "photos/a.jpg", "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(img)) {
+		t.Errorf("got size %d, want %d", size, len(img))
+	}
+	body, obj, err := store.Get("photos/a.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	if got, _ := ioutil.ReadAll(body); !bytes.Equal(got, img) || obj.ContentType != "image/jpeg" {
+		t.Errorf("got %d bytes of %q, want %d of image/jpeg", len(got), obj.ContentType, len(img))
+	}
+
+	if _, err := stripStored(store, "staging/missing.jpg", "photos/b.jpg", "image/jpeg"); err != storage.ErrNotFound {
+		t.Errorf("got %v, want %v", err, storage.ErrNotFound)
+	}
+}
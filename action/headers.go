@@ -0,0 +1,120 @@
+package action
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/siddhartham/imageutil-thumbor/model"
+	"github.com/siddhartham/imageutil-thumbor/token"
+)
+
+// immutableAge is the max-age of images served from a signed url.
+const immutableAge = 365 * 24 * time.Hour
+
+// hintHeaders are the client hints dpr:auto and s:auto are resolved with,
+// by their current and legacy names.
+var hintHeaders = []string{"Sec-CH-DPR", "Sec-CH-Width", "Sec-CH-Viewport-Width", "DPR", "Width", "Viewport-Width"}
+
+// VaryBy returns the request headers an image varies by: Accept when its
+// format was negotiated, the client hints when its size was hinted.
+func VaryBy(negotiated bool, hinted bool) []string {
+	vary := []string{}
+	if negotiated {
+		vary = append(vary, "Accept")
+	}
+	if hinted {
+		vary = append(vary, hintHeaders...)
+	}
+	return vary
+}
+
+// acceptHints asks for the client hints in header. Browsers only take
+// Accept-CH from documents, the pages embedding images must send it too.
+func acceptHints(header http.Header) {
+	header.Set("Accept-CH", strings.Join(hintHeaders, ", "))
+}
+
+// ResultHeaders returns the caching headers of a rendered image: the
+// project's max-age, or a year and immutable when its url is signed, and a
+// strong ETag derived from the variant key, the render it is served from
+// and the validators of its source, so it changes when the image is
+// rendered again, after its source changed or was replaced. Images vary by
+// the request headers their variant was picked by, and ask for the client
+// hints their size can be picked by.
+func ResultHeaders(sc *model.ServerConf, projectID string, key string, image model.Image, signed bool, vary []string) http.Header {
+	header := http.Header{}
+	acceptHints(header)
+	if len(vary) > 0 {
+		header.Set("Vary", strings.Join(vary, ", "))
+	}
+	maxAge := cachePolicy(sc, projectID).MaxAge
+	switch {
+	case signed:
+		header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", int64(immutableAge.Seconds())))
+	case maxAge > 0:
+		header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int64(maxAge.Seconds())))
+	default:
+		header.Set("Cache-Control", "public, no-cache")
+	}
+
+	render := []string{key, image.ID, image.CdnPath, strconv.FormatInt(image.RenderedAt, 10), image.OriginETag, image.OriginLastModified}
+	sum := sha256.Sum256([]byte(strings.Join(render, "\x00")))
+	header.Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+
+	modTime := time.Now()
+	if image.RenderedAt > 0 {
+		modTime = time.Unix(image.RenderedAt, 0)
+	}
+	header.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	return header
+}
+
+// NotModified reports whether the client already has the image described
+// by header, by its If-None-Match or, without one, its If-Modified-Since.
+func NotModified(req *http.Request, header http.Header) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if match := req.Header.Get("If-None-Match"); match != "" {
+		etag := header.Get("ETag")
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modTime, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && !modTime.After(since)
+}
+
+// WriteNotModified answers a conditional request with a 304 and header.
+func WriteNotModified(w http.ResponseWriter, header http.Header) {
+	for name, values := range header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// CheckSignature reports whether an image url is signed, with the "sig"
+// query parameter. A signature that does not match is an error.
+func CheckSignature(sc *model.ServerConf, req *http.Request) (bool, error) {
+	signature := req.URL.Query().Get("sig")
+	if signature == "" {
+		return false, nil
+	}
+	if err := token.VerifyPath(sc.URLSigningKey, req.URL.EscapedPath(), signature); err != nil {
+		return false, err
+	}
+	return true, nil
+}
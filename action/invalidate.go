@@ -0,0 +1,61 @@
+package action
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/siddhartham/imageutil-thumbor/model"
+	"github.com/siddhartham/imageutil-thumbor/storage"
+	"github.com/siddhartham/imageutil-thumbor/util"
+)
+
+// mediaOriginPath returns the origin path the media routes record in the
+// images table for the media file stored at key.
+func mediaOriginPath(sc *model.ServerConf, key string) string {
+	return fmt.Sprintf("https://%s.%s/%s", sc.BucketName, sc.MediaEndpoint, key)
+}
+
+// invalidateImages forgets the images rendered from originPath, or from
+// every origin path starting with it when prefix is set: their rows are
+// deleted, so the next request renders them again, and so are the rendered
+// images kept in result storage. It returns the images invalidated.
+func invalidateImages(db *sql.DB, store storage.Storage, projectID string, originPath string, prefix bool) ([]model.Image, error) {
+	condition, arg := "origin_path=?", originPath
+	if prefix {
+		condition, arg = "origin_path LIKE ?", likePrefix(originPath)
+	}
+	rows, err := db.Query("SELECT id, COALESCE(cdn_path, ''), origin_path FROM images WHERE project_id=? AND "+condition, projectID, arg)
+	if err != nil {
+		return nil, err
+	}
+	images := []model.Image{}
+	for rows.Next() {
+		image := model.Image{ProjectID: projectID}
+		if err := rows.Scan(&image.ID, &image.CdnPath, &image.OriginPath); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		images = append(images, image)
+	}
+	rows.Close()
+	uncacheResults(projectID, originPath, prefix)
+
+	for _, image := range images {
+		if _, err := db.Exec("DELETE FROM images WHERE id=?", image.ID); err != nil {
+			return nil, err
+		}
+		// the row is gone, a result left behind is only wasted space
+		if image.CdnPath != "" {
+			if err := store.Delete(strings.TrimPrefix(image.CdnPath, "/")); err != nil && err != storage.ErrNotFound {
+				util.LogWarning("invalidateImages : Delete", err.Error())
+			}
+		}
+	}
+	return images, nil
+}
+
+// likePrefix returns the LIKE pattern matching the strings starting with s.
+func likePrefix(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(s) + "%"
+}
@@ -0,0 +1,541 @@
+package action
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/siddhartham/imageutil-thumbor/config"
+	"github.com/siddhartham/imageutil-thumbor/model"
+	"github.com/siddhartham/imageutil-thumbor/storage"
+	"github.com/siddhartham/imageutil-thumbor/token"
+	"github.com/siddhartham/imageutil-thumbor/util"
+)
+
+// The media library api manages the folders and files of a project, as
+// kept in the folders table:
+//
+//	GET    /api/projects/{project_id}/folders/{id}/children  lists a folder, "root" for the top level
+//	GET    /api/projects/{project_id}/folders/{id}           returns a folder or file
+//	POST   /api/projects/{project_id}/folders                creates a folder
+//	PATCH  /api/projects/{project_id}/folders/{id}           renames and/or moves a folder or file
+//	DELETE /api/projects/{project_id}/folders/{id}           deletes a folder or file, recursively
+//	POST   /api/projects/{project_id}/folders/{id}/upload_token  mints an upload token for a folder
+//
+// Requests are authenticated with a manage token of the project, minted
+// with `main token mint -scope manage`, as "Authorization: Bearer <token>".
+// Renaming and moving keep the storage paths, so the media urls of the
+// files keep working.
+
+const (
+	libraryPageSize    = 50
+	libraryMaxPageSize = 200
+	// LibraryRoot is the id standing for the top level of the library.
+	LibraryRoot = "root"
+)
+
+var ErrNotFolder = errors.New("Not a folder")
+
+type libraryItem struct {
+	ID           string `json:"id"`
+	ParentID     string `json:"parent_id"`
+	IsFile       bool   `json:"is_file"`
+	Name         string `json:"name"`
+	Path         string `json:"path"`
+	OriginalName string `json:"original_name,omitempty"`
+	MimeType     string `json:"mime_type,omitempty"`
+	FileSize     int64  `json:"file_size,omitempty"`
+	Width        int64  `json:"width,omitempty"`
+	Height       int64  `json:"height,omitempty"`
+	Format       string `json:"format,omitempty"`
+	// OnConflict is the conflict policy of uploads to a folder, empty for
+	// the project's.
+	OnConflict string `json:"on_conflict,omitempty"`
+}
+
+type libraryPage struct {
+	Items   []libraryItem `json:"items"`
+	Page    int           `json:"page"`
+	PerPage int           `json:"per_page"`
+	Total   int64         `json:"total"`
+}
+
+type libraryChange struct {
+	Name       *string `json:"name"`
+	ParentID   *string `json:"parent_id"`
+	OnConflict *string `json:"on_conflict"`
+}
+
+type uploadTokenRequest struct {
+	ExpiresIn int64    `json:"expires_in"`
+	MaxSize   int64    `json:"max_size"`
+	Types     []string `json:"types"`
+	MaxFiles  int64    `json:"max_files"`
+}
+
+type uploadTokenResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// LibraryListHandler lists the children of a folder, folders first, a page
+// at a time.
+func LibraryListHandler(db *sql.DB, store storage.Storage, sc *model.ServerConf, res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	if _, status, err := checkManageToken(sc, req, vars["project_id"]); err != nil {
+		uploadError(res, "LibraryListHandler : checkManageToken", status, err)
+		return
+	}
+
+	if vars["id"] != LibraryRoot {
+		parent, err := getLibraryItem(db, vars["project_id"], vars["id"])
+		if err != nil {
+			uploadError(res, "LibraryListHandler : getLibraryItem", libraryStatus(err), err)
+			return
+		}
+		if parent.IsFile == "1" {
+			uploadError(res, "LibraryListHandler : getLibraryItem", http.StatusBadRequest, ErrNotFolder)
+			return
+		}
+	}
+
+	page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(req.URL.Query().Get("per_page"))
+	if perPage < 1 {
+		perPage = libraryPageSize
+	}
+	if perPage > libraryMaxPageSize {
+		perPage = libraryMaxPageSize
+	}
+
+	parent, parentArgs := parentCondition(vars["id"])
+	result := libraryPage{Items: []libraryItem{}, Page: page, PerPage: perPage}
+	args := append([]interface{}{vars["project_id"]}, parentArgs...)
+	err := db.QueryRow("SELECT COUNT(*) FROM folders WHERE project_id=? AND "+parent, args...).Scan(&result.Total)
+	if err != nil {
+		uploadError(res, "LibraryListHandler : COUNT", http.StatusInternalServerError, err)
+		return
+	}
+
+	rows, err := db.Query("SELECT "+libraryColumns+" FROM folders WHERE project_id=? AND "+parent+" ORDER BY is_file, name LIMIT ? OFFSET ?",
+		append(args, perPage, (page-1)*perPage)...)
+	if err != nil {
+		uploadError(res, "LibraryListHandler : SELECT", http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		item, err := scanLibraryItem(rows)
+		if err != nil {
+			uploadError(res, "LibraryListHandler : Scan", http.StatusInternalServerError, err)
+			return
+		}
+		result.Items = append(result.Items, toLibraryItem(item))
+	}
+
+	writeJSON(res, http.StatusOK, result)
+}
+
+// LibraryGetHandler returns a folder or file.
+func LibraryGetHandler(db *sql.DB, store storage.Storage, sc *model.ServerConf, res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	if _, status, err := checkManageToken(sc, req, vars["project_id"]); err != nil {
+		uploadError(res, "LibraryGetHandler : checkManageToken", status, err)
+		return
+	}
+
+	item, err := getLibraryItem(db, vars["project_id"], vars["id"])
+	if err != nil {
+		uploadError(res, "LibraryGetHandler : getLibraryItem", libraryStatus(err), err)
+		return
+	}
+	writeJSON(res, http.StatusOK, toLibraryItem(item))
+}
+
+// LibraryCreateHandler creates a folder named name in parent_id, the top
+// level when empty. The folder's path is its parent's path and its name,
+// numbered when already used.
+func LibraryCreateHandler(db *sql.DB, store storage.Storage, sc *model.ServerConf, res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	claims, status, err := checkManageToken(sc, req, vars["project_id"])
+	if err != nil {
+		uploadError(res, "LibraryCreateHandler : checkManageToken", status, err)
+		return
+	}
+
+	change := libraryChange{}
+	if err := json.NewDecoder(req.Body).Decode(&change); err != nil || change.Name == nil {
+		uploadError(res, "LibraryCreateHandler : Decode", http.StatusBadRequest, errors.New("Expected a JSON body with a name"))
+		return
+	}
+	if err := validItemName(*change.Name); err != nil {
+		uploadError(res, "LibraryCreateHandler : validItemName", http.StatusBadRequest, err)
+		return
+	}
+
+	folder := model.Folder{UserID: claims.UserID, ProjectID: vars["project_id"], IsFile: "0", Name: *change.Name}
+	if change.OnConflict != nil {
+		if err := validConflictPolicy(*change.OnConflict); err != nil {
+			uploadError(res, "LibraryCreateHandler : validConflictPolicy", http.StatusBadRequest, err)
+			return
+		}
+		folder.ConflictPolicy = *change.OnConflict
+	}
+	parentPath := ""
+	if change.ParentID != nil && *change.ParentID != "" && *change.ParentID != LibraryRoot {
+		parent, err := getLibraryFolder(db, folder.ProjectID, *change.ParentID)
+		if err != nil {
+			uploadError(res, "LibraryCreateHandler : getLibraryFolder", libraryStatus(err), err)
+			return
+		}
+		folder.FolderID = parent.ID
+		parentPath = parent.Path
+	}
+	if siblingExists(db, folder.ProjectID, folder.FolderID, folder.Name, "") {
+		uploadError(res, "LibraryCreateHandler : siblingExists", http.StatusConflict, errors.New("An item with the same name already exists in this folder"))
+		return
+	}
+	folder.Path = uniqueName(path.Join(parentPath, folder.Name), func(p string) bool {
+		id := ""
+		return db.QueryRow("SELECT id FROM folders WHERE project_id=? AND is_file=0 AND path=?", folder.ProjectID, p).Scan(&id) == nil
+	})
+
+	insert, err := db.Exec("INSERT INTO folders (id, user_id, project_id, folder_id, is_file, name, path, conflict_policy, created_at, updated_at) VALUES (NULL, ?, ?, ?, 0, ?, ?, ?, NOW(), NOW())",
+		folder.UserID, folder.ProjectID, nullable(folder.FolderID), folder.Name, folder.Path, nullable(folder.ConflictPolicy))
+	if err != nil {
+		uploadError(res, "LibraryCreateHandler : INSERT", http.StatusInternalServerError, err)
+		return
+	}
+	id, _ := insert.LastInsertId()
+	folder.ID = strconv.FormatInt(id, 10)
+
+	util.LogInfo("LibraryCreateHandler : ", folder.Path)
+	writeJSON(res, http.StatusCreated, toLibraryItem(folder))
+}
+
+// LibraryUpdateHandler renames a folder or file with name and moves it to
+// parent_id, "root" for the top level. Files keep the key they are stored
+// at, new uploads get keys of their own (see freeKey).
+func LibraryUpdateHandler(db *sql.DB, store storage.Storage, sc *model.ServerConf, res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	if _, status, err := checkManageToken(sc, req, vars["project_id"]); err != nil {
+		uploadError(res, "LibraryUpdateHandler : checkManageToken", status, err)
+		return
+	}
+
+	item, err := getLibraryItem(db, vars["project_id"], vars["id"])
+	if err != nil {
+		uploadError(res, "LibraryUpdateHandler : getLibraryItem", libraryStatus(err), err)
+		return
+	}
+	change := libraryChange{}
+	if err := json.NewDecoder(req.Body).Decode(&change); err != nil {
+		uploadError(res, "LibraryUpdateHandler : Decode", http.StatusBadRequest, err)
+		return
+	}
+
+	if change.Name != nil {
+		if err := validItemName(*change.Name); err != nil {
+			uploadError(res, "LibraryUpdateHandler : validItemName", http.StatusBadRequest, err)
+			return
+		}
+		item.Name = *change.Name
+	}
+	if change.OnConflict != nil {
+		if item.IsFile == "1" {
+			uploadError(res, "LibraryUpdateHandler : validConflictPolicy", http.StatusBadRequest, ErrNotFolder)
+			return
+		}
+		if err := validConflictPolicy(*change.OnConflict); err != nil {
+			uploadError(res, "LibraryUpdateHandler : validConflictPolicy", http.StatusBadRequest, err)
+			return
+		}
+		item.ConflictPolicy = *change.OnConflict
+	}
+	if change.ParentID != nil {
+		parentID := *change.ParentID
+		if parentID == LibraryRoot {
+			parentID = ""
+		}
+		if parentID != "" {
+			if _, err := getLibraryFolder(db, item.ProjectID, parentID); err != nil {
+				uploadError(res, "LibraryUpdateHandler : getLibraryFolder", libraryStatus(err), err)
+				return
+			}
+			if item.IsFile == "0" && isWithin(db, item.ProjectID, parentID, item.ID) {
+				uploadError(res, "LibraryUpdateHandler : isWithin", http.StatusBadRequest, errors.New("A folder cannot be moved into itself"))
+				return
+			}
+		}
+		item.FolderID = parentID
+	}
+	if siblingExists(db, item.ProjectID, item.FolderID, item.Name, item.ID) {
+		uploadError(res, "LibraryUpdateHandler : siblingExists", http.StatusConflict, errors.New("An item with the same name already exists in this folder"))
+		return
+	}
+
+	_, err = db.Exec("UPDATE folders SET name=?, folder_id=?, conflict_policy=?, updated_at=NOW() WHERE project_id=? AND id=?", item.Name, nullable(item.FolderID), nullable(item.ConflictPolicy), item.ProjectID, item.ID)
+	if err != nil {
+		uploadError(res, "LibraryUpdateHandler : UPDATE", http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(res, http.StatusOK, toLibraryItem(item))
+}
+
+// LibraryDeleteHandler deletes a file, or a folder with everything in it,
+// from the library and from storage.
+func LibraryDeleteHandler(db *sql.DB, store storage.Storage, sc *model.ServerConf, res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	if _, status, err := checkManageToken(sc, req, vars["project_id"]); err != nil {
+		uploadError(res, "LibraryDeleteHandler : checkManageToken", status, err)
+		return
+	}
+
+	item, err := getLibraryItem(db, vars["project_id"], vars["id"])
+	if err != nil {
+		uploadError(res, "LibraryDeleteHandler : getLibraryItem", libraryStatus(err), err)
+		return
+	}
+
+	// breadth first, so deleting in reverse removes children before parents
+	items := []model.Folder{item}
+	for i := 0; i < len(items); i++ {
+		if items[i].IsFile == "1" {
+			continue
+		}
+		rows, err := db.Query("SELECT "+libraryColumns+" FROM folders WHERE project_id=? AND folder_id=?", item.ProjectID, items[i].ID)
+		if err != nil {
+			uploadError(res, "LibraryDeleteHandler : SELECT", http.StatusInternalServerError, err)
+			return
+		}
+		for rows.Next() {
+			child, err := scanLibraryItem(rows)
+			if err != nil {
+				rows.Close()
+				uploadError(res, "LibraryDeleteHandler : Scan", http.StatusInternalServerError, err)
+				return
+			}
+			items = append(items, child)
+		}
+		rows.Close()
+	}
+
+	for i := len(items) - 1; i >= 0; i-- {
+		if items[i].IsFile == "1" && items[i].Path != "" {
+			if err := deleteVersions(db, store, items[i]); err != nil {
+				uploadError(res, "LibraryDeleteHandler : deleteVersions", http.StatusInternalServerError, err)
+				return
+			}
+			if err := store.Delete(items[i].Path); err != nil && err != storage.ErrNotFound {
+				uploadError(res, "LibraryDeleteHandler : Delete", http.StatusInternalServerError, err)
+				return
+			}
+			images, err := invalidateImages(db, store, items[i].ProjectID, mediaOriginPath(sc, items[i].Path), false)
+			if err != nil {
+				util.LogWarning("LibraryDeleteHandler : invalidateImages", err.Error())
+			}
+			purgeCdnInBackground(sc, items[i].ProjectID, images)
+		}
+		if _, err := db.Exec("DELETE FROM folders WHERE project_id=? AND id=?", items[i].ProjectID, items[i].ID); err != nil {
+			uploadError(res, "LibraryDeleteHandler : DELETE", http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	util.LogInfo("LibraryDeleteHandler : ", fmt.Sprintf("%s, %d items", item.Path, len(items)))
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// LibraryUploadTokenHandler mints an upload token for a folder.
+func LibraryUploadTokenHandler(db *sql.DB, store storage.Storage, sc *model.ServerConf, res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	claims, status, err := checkManageToken(sc, req, vars["project_id"])
+	if err != nil {
+		uploadError(res, "LibraryUploadTokenHandler : checkManageToken", status, err)
+		return
+	}
+
+	folder, err := getLibraryFolder(db, vars["project_id"], vars["id"])
+	if err != nil {
+		uploadError(res, "LibraryUploadTokenHandler : getLibraryFolder", libraryStatus(err), err)
+		return
+	}
+	options := uploadTokenRequest{}
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&options); err != nil {
+			uploadError(res, "LibraryUploadTokenHandler : Decode", http.StatusBadRequest, err)
+			return
+		}
+	}
+	if options.ExpiresIn <= 0 {
+		options.ExpiresIn = int64((24 * time.Hour).Seconds())
+	}
+
+	expiresAt := time.Now().Add(time.Duration(options.ExpiresIn) * time.Second)
+	signed, err := token.Sign(sc.UploadTokenSecret, token.Claims{
+		Scope:      token.ScopeUpload,
+		UserID:     claims.UserID,
+		ProjectID:  folder.ProjectID,
+		FolderID:   folder.ID,
+		FolderPath: folder.Path,
+		ExpiresAt:  expiresAt.Unix(),
+		MaxSize:    options.MaxSize,
+		Types:      options.Types,
+		MaxFiles:   options.MaxFiles,
+	})
+	if err != nil {
+		uploadError(res, "LibraryUploadTokenHandler : Sign", http.StatusInternalServerError, err)
+		return
+	}
+
+	res.Header().Set("Cache-Control", "no-store")
+	writeJSON(res, http.StatusCreated, uploadTokenResponse{Token: signed, ExpiresAt: expiresAt.UTC()})
+}
+
+// checkManageToken verifies the bearer token of the request grants managing
+// the library of projectID.
+func checkManageToken(sc *model.ServerConf, req *http.Request, projectID string) (*token.Claims, int, error) {
+	bearer := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if bearer == "" || bearer == req.Header.Get("Authorization") {
+		return nil, http.StatusUnauthorized, errors.New("Missing bearer token")
+	}
+	claims, err := token.Verify(sc.UploadTokenSecret, bearer)
+	if err != nil {
+		return nil, http.StatusUnauthorized, err
+	}
+	if claims.Scope != token.ScopeManage || claims.ProjectID != projectID {
+		return nil, http.StatusForbidden, errors.New("Token does not grant managing this project")
+	}
+	return claims, http.StatusOK, nil
+}
+
+const libraryColumns = "id, COALESCE(folder_id, ''), is_file, name, COALESCE(path, ''), user_id, project_id, COALESCE(original_name, ''), COALESCE(mime_type, ''), COALESCE(file_size, 0), COALESCE(width, 0), COALESCE(height, 0), COALESCE(format, ''), COALESCE(conflict_policy, '')"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanLibraryItem(row scanner) (model.Folder, error) {
+	item := model.Folder{}
+	err := row.Scan(&item.ID, &item.FolderID, &item.IsFile, &item.Name, &item.Path, &item.UserID, &item.ProjectID,
+		&item.OriginalName, &item.MimeType, &item.FileSize, &item.Width, &item.Height, &item.Format, &item.ConflictPolicy)
+	if item.FolderID == "0" {
+		item.FolderID = ""
+	}
+	return item, err
+}
+
+func getLibraryItem(db *sql.DB, projectID string, id string) (model.Folder, error) {
+	return scanLibraryItem(db.QueryRow("SELECT "+libraryColumns+" FROM folders WHERE project_id=? AND id=?", projectID, id))
+}
+
+func getLibraryFolder(db *sql.DB, projectID string, id string) (model.Folder, error) {
+	folder, err := getLibraryItem(db, projectID, id)
+	if err == nil && folder.IsFile == "1" {
+		return folder, ErrNotFolder
+	}
+	return folder, err
+}
+
+// libraryStatus returns the status to answer a failed item lookup with.
+func libraryStatus(err error) int {
+	switch err {
+	case sql.ErrNoRows:
+		return http.StatusNotFound
+	case ErrNotFolder:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// parentCondition returns the condition selecting the children of parentID.
+// Top level items have no folder_id, or a 0 one.
+func parentCondition(parentID string) (string, []interface{}) {
+	if parentID == LibraryRoot || parentID == "" {
+		return "(folder_id IS NULL OR folder_id=0)", nil
+	}
+	return "folder_id=?", []interface{}{parentID}
+}
+
+// siblingExists reports whether parentID has an item named name, other
+// than the item exceptID.
+func siblingExists(db *sql.DB, projectID string, parentID string, name string, exceptID string) bool {
+	parent, args := parentCondition(parentID)
+	id := ""
+	args = append([]interface{}{projectID, name, exceptID}, args...)
+	return db.QueryRow("SELECT id FROM folders WHERE project_id=? AND name=? AND id<>? AND "+parent, args...).Scan(&id) == nil
+}
+
+// isWithin reports whether folder id is ancestorID or one of its descendants.
+func isWithin(db *sql.DB, projectID string, id string, ancestorID string) bool {
+	for id != "" && id != "0" {
+		if id == ancestorID {
+			return true
+		}
+		parentID := ""
+		if err := db.QueryRow("SELECT COALESCE(folder_id, '') FROM folders WHERE project_id=? AND id=?", projectID, id).Scan(&parentID); err != nil {
+			return false
+		}
+		id = parentID
+	}
+	return false
+}
+
+func validItemName(name string) error {
+	if strings.TrimSpace(name) == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return fmt.Errorf("Invalid name %q", name)
+	}
+	return nil
+}
+
+// validConflictPolicy checks a folder's conflict policy, empty to use the
+// project's.
+func validConflictPolicy(mode string) error {
+	if mode != "" && !config.ValidConflict(mode) {
+		return fmt.Errorf("Invalid on_conflict %q", mode)
+	}
+	return nil
+}
+
+// nullable returns nil for an empty value, stored as NULL.
+func nullable(id string) interface{} {
+	if id == "" {
+		return nil
+	}
+	return id
+}
+
+func toLibraryItem(folder model.Folder) libraryItem {
+	return libraryItem{
+		ID:           folder.ID,
+		ParentID:     folder.FolderID,
+		IsFile:       folder.IsFile == "1",
+		Name:         folder.Name,
+		Path:         folder.Path,
+		OriginalName: folder.OriginalName,
+		MimeType:     folder.MimeType,
+		FileSize:     folder.FileSize,
+		Width:        folder.Width,
+		Height:       folder.Height,
+		Format:       folder.Format,
+		OnConflict:   folder.ConflictPolicy,
+	}
+}
+
+func writeJSON(res http.ResponseWriter, status int, v interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	if err := json.NewEncoder(res).Encode(v); err != nil {
+		util.LogError("writeJSON : Encode", err.Error())
+	}
+}
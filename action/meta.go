@@ -0,0 +1,253 @@
+package action
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/siddhartham/imageutil-thumbor/model"
+	"github.com/siddhartham/imageutil-thumbor/storage"
+	"github.com/siddhartham/imageutil-thumbor/util"
+	"golang.org/x/image/draw"
+)
+
+// The metadata of a source image is served without the client downloading
+// it:
+//
+//	GET /{project_id}/meta/{image}        an image of the project origin
+//	GET /{project_id}/media/meta/{image}  an image of the project media
+//
+// It is decoded here once, then kept in an images row of transformation
+// "meta", indexed by the origin path as its rendered images are, so a
+// purge or a replaced media file drops it with them.
+
+const (
+	// metaTransformation is the transformation of the images rows keeping
+	// the metadata of a source.
+	metaTransformation = "meta"
+	// MetaMaxSourceBytes is the largest source decoded for its metadata.
+	MetaMaxSourceBytes = 20 << 20
+	// MetaMaxPixels is the largest image decoded whole for its dominant
+	// colour, 16MB of pixels. Larger ones only get their header read.
+	MetaMaxPixels = 4000000
+	// MetaConcurrency is how many sources are read and decoded at once.
+	MetaConcurrency = 4
+)
+
+var metaClient = &http.Client{Timeout: 10 * time.Second}
+
+// metaSlots bounds the sources being read and decoded, as the routes need
+// no authentication.
+var metaSlots = make(chan struct{}, MetaConcurrency)
+
+// ImageMeta is the metadata of a source image. Width and height are as
+// stored, before the EXIF orientation is applied.
+type ImageMeta struct {
+	Width         int    `json:"width"`
+	Height        int    `json:"height"`
+	Format        string `json:"format"`
+	MimeType      string `json:"mime_type"`
+	FileSize      int64  `json:"file_size"`
+	DominantColor string `json:"dominant_color,omitempty"`
+	Orientation   int    `json:"orientation"`
+}
+
+// MetaHandler serves the metadata of an image of the project, from source
+// origin or media.
+func MetaHandler(db *sql.DB, store storage.Storage, sc *model.ServerConf, source string, res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	var project model.Project
+	projectImageOrigin, err := GetProject(db, vars["project_id"], &project)
+	if err != nil {
+		uploadError(res, "MetaHandler : GetProject", http.StatusNotFound, errors.New("Project not found"))
+		return
+	}
+
+	key := fmt.Sprintf("%s/%s", sc.MediaStorage, vars["image"])
+	originPath := vars["image"]
+	if source == model.SourceMedia {
+		originPath = mediaOriginPath(sc, key)
+	}
+
+	header := http.Header{}
+	if maxAge := cachePolicy(sc, project.ID).MaxAge; maxAge > 0 {
+		header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int64(maxAge.Seconds())))
+	}
+
+	var cached string
+	err = db.QueryRow("SELECT COALESCE(meta, '') FROM images WHERE project_id=? AND origin_path=? AND transformation=? AND is_smart=0",
+		project.ID, originPath, metaTransformation).Scan(&cached)
+	if err != nil && err != sql.ErrNoRows {
+		util.LogWarning("MetaHandler : SELECT", err.Error())
+	}
+	if cached != "" {
+		writeMeta(res, header, []byte(cached))
+		return
+	}
+
+	select {
+	case metaSlots <- struct{}{}:
+		defer func() { <-metaSlots }()
+	case <-req.Context().Done():
+		uploadError(res, "MetaHandler : wait", http.StatusServiceUnavailable, req.Context().Err())
+		return
+	}
+
+	var data []byte
+	if source == model.SourceMedia {
+		data, err = readMedia(store, key)
+	} else {
+		data, err = fetchSource(fmt.Sprintf("%s/%s", projectImageOrigin, originPath))
+	}
+	if err == storage.ErrNotFound {
+		uploadError(res, "MetaHandler : read", http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		uploadError(res, "MetaHandler : read", http.StatusBadGateway, err)
+		return
+	}
+
+	meta, err := decodeMeta(data, MetaMaxPixels)
+	if err != nil {
+		uploadError(res, "MetaHandler : decodeMeta", http.StatusUnprocessableEntity, err)
+		return
+	}
+	encoded, err := json.Marshal(meta)
+	if err != nil {
+		uploadError(res, "MetaHandler : Marshal", http.StatusInternalServerError, err)
+		return
+	}
+
+	Background(func() {
+		_, err := db.Exec("INSERT INTO images (id, user_id, project_id, store_key, origin, origin_path, transformation, is_smart, cdn_path, file_size, meta, created_at, updated_at, host_domain) VALUES (NULL, ?, ?, '', ?, ?, ?, 0, '', ?, ?, NOW(), NOW(), 'transform.imageutil.io')",
+			project.UserID, project.ID, projectImageOrigin, originPath, metaTransformation, meta.FileSize, string(encoded))
+		if err != nil {
+			util.LogError("MetaHandler : INSERT", err.Error())
+		}
+	})
+	writeMeta(res, header, encoded)
+}
+
+func writeMeta(res http.ResponseWriter, header http.Header, meta []byte) {
+	for name, values := range header {
+		res.Header()[name] = values
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	res.Write(meta)
+	res.Write([]byte("\n"))
+}
+
+// fetchSource downloads a source image of a project origin.
+func fetchSource(source string) ([]byte, error) {
+	resp, err := metaClient.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, storage.ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Source returned %s", resp.Status)
+	}
+	return readLimited(resp.Body)
+}
+
+// readMedia reads a source image of the media storage.
+func readMedia(store storage.Storage, key string) ([]byte, error) {
+	body, _, err := store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return readLimited(body)
+}
+
+func readLimited(r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, MetaMaxSourceBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MetaMaxSourceBytes {
+		return nil, errors.New("Source image is too large")
+	}
+	return data, nil
+}
+
+// decodeMeta decodes the metadata of an image. The dominant colour is only
+// looked for in images of at most maxPixels, which are decoded whole.
+func decodeMeta(data []byte, maxPixels int64) (*ImageMeta, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	meta := &ImageMeta{
+		Width:       config.Width,
+		Height:      config.Height,
+		Format:      format,
+		MimeType:    http.DetectContentType(data),
+		FileSize:    int64(len(data)),
+		Orientation: 1,
+	}
+	if format == "jpeg" {
+		meta.Orientation = exifOrientation(data)
+	}
+
+	if maxPixels > 0 && int64(config.Width)*int64(config.Height) > maxPixels {
+		return meta, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		util.LogWarning("decodeMeta : Decode", err.Error())
+		return meta, nil
+	}
+	meta.DominantColor = dominantColor(img)
+	return meta, nil
+}
+
+// dominantColor returns the most common colour of img, as "#rrggbb": img
+// is scaled down, its pixels grouped by colour, and the average of the
+// largest group taken. Transparent pixels are left out.
+func dominantColor(img image.Image) string {
+	small := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	type group struct{ n, r, g, b int }
+	groups := map[int]*group{}
+	var best *group
+	for i := 0; i+3 < len(small.Pix); i += 4 {
+		r, g, b, a := int(small.Pix[i]), int(small.Pix[i+1]), int(small.Pix[i+2]), small.Pix[i+3]
+		if a < 128 {
+			continue
+		}
+		// 4 bits a channel
+		bucket := (r>>4)<<8 | (g>>4)<<4 | b>>4
+		gr, ok := groups[bucket]
+		if !ok {
+			gr = &group{}
+			groups[bucket] = gr
+		}
+		gr.n++
+		gr.r += r
+		gr.g += g
+		gr.b += b
+		if best == nil || gr.n > best.n {
+			best = gr
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return fmt.Sprintf("#%02x%02x%02x", best.r/best.n, best.g/best.n, best.b/best.n)
+}
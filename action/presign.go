@@ -0,0 +1,251 @@
+package action
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/siddhartham/imageutil-thumbor/model"
+	"github.com/siddhartham/imageutil-thumbor/storage"
+	"github.com/siddhartham/imageutil-thumbor/util"
+)
+
+// Presigned uploads let clients put big files straight into the bucket,
+// without streaming them through this service:
+//
+//	POST /upload/{uploadToken}/{fileName}/presign?size=&content_type=  returns the url to PUT the file to
+//	POST /upload/{uploadToken}/{fileName}/presign/complete?key=        adds the uploaded file to its folder
+//
+// The presign takes the size and content type of the file, which the url
+// only accepts, sent with the headers it answers with. The file is put
+// private under the staging/ prefix of the bucket, never where it will be
+// served from, so the bucket policy must not make that prefix public.
+// Staged files not completed within presignStagingTTL are deleted by the
+// sweeper. The completion checks the staged object against the upload
+// policy, then copies it to the folder, stripping its EXIF data when the
+// policy says so, replacing the file it conflicts with only then. A
+// rejected object is deleted from staging, the folder is left as it was.
+// The completion takes the name and key the presign answered with, and the
+// same on_conflict.
+
+const (
+	// PresignExpiry is how long a presigned upload url stays valid.
+	PresignExpiry = 15 * time.Minute
+	// presignStaging is the prefix of the keys presigned uploads are put to.
+	presignStaging = "staging"
+	// presignStagingTTL is how long a staged file waits for its completion.
+	presignStagingTTL = time.Hour
+)
+
+type presignedUpload struct {
+	Name      string            `json:"name"`
+	URL       string            `json:"url"`
+	Method    string            `json:"method"`
+	Key       string            `json:"key"`
+	Headers   map[string]string `json:"headers"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+// PresignHandler returns a presigned url to PUT fileName to, at a staging
+// key of the folder.
+func PresignHandler(db *sql.DB, store storage.Storage, sc *model.ServerConf, res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	util.LogInfo("PresignHandler", vars["uploadToken"])
+	folder, policy, target, status, err := checkTokenAndGetFolder(db, sc, vars["uploadToken"], vars["fileName"], req.URL.Query().Get("on_conflict"))
+	if err != nil {
+		uploadError(res, "PresignHandler : checkTokenAndGetFolder", status, err)
+		return
+	}
+	put, status, err := presignedObject(req, policy)
+	if err != nil {
+		uploadError(res, "PresignHandler : presignedObject", status, err)
+		return
+	}
+
+	id, err := randomID()
+	if err != nil {
+		uploadError(res, "PresignHandler : randomID", http.StatusInternalServerError, err)
+		return
+	}
+	key := path.Join(stagingPrefix(folder), id, target.Name)
+	url, signed, err := store.SignedURL(http.MethodPut, key, PresignExpiry, put)
+	if err == storage.ErrNotSupported {
+		uploadError(res, "PresignHandler : SignedURL", http.StatusNotImplemented, err)
+		return
+	}
+	if err != nil {
+		uploadError(res, "PresignHandler : SignedURL", http.StatusInternalServerError, err)
+		return
+	}
+
+	headers := map[string]string{}
+	for name := range signed {
+		headers[http.CanonicalHeaderKey(name)] = signed.Get(name)
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(http.StatusOK)
+	json.NewEncoder(res).Encode(presignedUpload{
+		Name:      target.Name,
+		URL:       url,
+		Method:    http.MethodPut,
+		Key:       key,
+		Headers:   headers,
+		ExpiresAt: time.Now().Add(PresignExpiry).UTC(),
+	})
+}
+
+// PresignCompleteHandler checks the file put to the presigned url exists
+// and is an acceptable image, then moves it from staging to its folder.
+func PresignCompleteHandler(db *sql.DB, store storage.Storage, sc *model.ServerConf, res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	util.LogInfo("PresignCompleteHandler", vars["uploadToken"])
+	folder, policy, target, status, err := checkTokenAndGetFolder(db, sc, vars["uploadToken"], vars["fileName"], req.URL.Query().Get("on_conflict"))
+	// the presign picked a free name, it was taken since
+	if err == nil && target.Name != vars["fileName"] {
+		status, err = http.StatusConflict, errors.New("File with same name already exists in this folder")
+	}
+	if err != nil {
+		uploadError(res, "PresignCompleteHandler : checkTokenAndGetFolder", status, err)
+		return
+	}
+
+	// only the staging keys of the folder are taken, for the file presigned
+	key := req.URL.Query().Get("key")
+	if !strings.HasPrefix(key, stagingPrefix(folder)+"/") || path.Base(key) != target.Name || path.Clean(key) != key {
+		uploadError(res, "PresignCompleteHandler : key", http.StatusBadRequest, errors.New("Invalid key"))
+		return
+	}
+	obj, err := store.Stat(key)
+	if err == storage.ErrNotFound {
+		uploadError(res, "PresignCompleteHandler : Stat", http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		uploadError(res, "PresignCompleteHandler : Stat", http.StatusInternalServerError, err)
+		return
+	}
+
+	if obj.Size > policy.MaxSize {
+		deleteStaged(store, key)
+		uploadError(res, "PresignCompleteHandler : size", http.StatusRequestEntityTooLarge, ErrTooLarge)
+		return
+	}
+
+	// Only the first bytes are read, to validate the image header
+	body, _, err := store.Get(key)
+	if err != nil {
+		uploadError(res, "PresignCompleteHandler : Get", http.StatusInternalServerError, err)
+		return
+	}
+	_, mimeType, header, err := sniff(body)
+	body.Close()
+	if err != nil {
+		uploadError(res, "PresignCompleteHandler : get file header", http.StatusBadGateway, err)
+		return
+	}
+	if err := validateImage(header, policy); err != nil {
+		deleteStaged(store, key)
+		uploadError(res, "PresignCompleteHandler : validateImage", validationStatus(err), err)
+		return
+	}
+	if status, err := claimFile(db, policy); err != nil {
+		deleteStaged(store, key)
+		uploadError(res, "PresignCompleteHandler : claimFile", status, err)
+		return
+	}
+
+	// keep the file being replaced as a version
+	if target.Existing != nil && target.Mode == model.ConflictVersion {
+		if err := versionFile(db, store, *target.Existing); err != nil {
+			releaseFile(db, policy)
+			uploadError(res, "PresignCompleteHandler : versionFile", http.StatusInternalServerError, err)
+			return
+		}
+	}
+	// the staged object is copied as it was put, or without its Exif data
+	size := obj.Size
+	if header.Format == "jpeg" && *policy.StripExif {
+		size, err = stripStored(store, key, target.Key, mimeType)
+	} else {
+		err = store.Copy(key, target.Key)
+	}
+	if err != nil {
+		releaseFile(db, policy)
+		uploadError(res, "PresignCompleteHandler : Copy", http.StatusInternalServerError, err)
+		return
+	}
+	deleteStaged(store, key)
+
+	if target.Existing != nil {
+		_, err = replaceFile(db, store, sc, *target.Existing, size, mimeType, vars["fileName"], header)
+	} else {
+		_, err = saveFileToDb(db, &folder, target.Name, target.Key, size, mimeType, vars["fileName"], header)
+	}
+	if err != nil {
+		releaseFile(db, policy)
+		uploadError(res, "PresignCompleteHandler : saveFileToDb", http.StatusInternalServerError, err)
+		return
+	}
+
+	util.LogInfo("PresignCompleteHandler : ", target.Key)
+	res.WriteHeader(http.StatusOK)
+	res.Write([]byte("Uploaded!"))
+}
+
+// presignedObject returns the size and content type a presigned upload is
+// granted for, which the upload policy must allow.
+func presignedObject(req *http.Request, policy model.UploadPolicy) (*storage.Object, int, error) {
+	query := req.URL.Query()
+	size, err := strconv.ParseInt(query.Get("size"), 10, 64)
+	if err != nil || size <= 0 {
+		return nil, http.StatusBadRequest, errors.New("Invalid size")
+	}
+	if size > policy.MaxSize {
+		return nil, http.StatusRequestEntityTooLarge, ErrTooLarge
+	}
+
+	contentType := query.Get("content_type")
+	for _, format := range policy.Formats {
+		if contentType == "image/"+strings.TrimSpace(format) {
+			return &storage.Object{Size: size, ContentType: contentType}, http.StatusOK, nil
+		}
+	}
+	return nil, http.StatusUnsupportedMediaType, fmt.Errorf("Content type %q is not allowed", contentType)
+}
+
+// sweepStaging deletes the staged files whose upload was never completed.
+func sweepStaging(store storage.Storage, now time.Time) {
+	objects, err := store.List(presignStaging + "/")
+	if err != nil {
+		util.LogWarning("sweepStaging : List", err.Error())
+		return
+	}
+	for _, obj := range objects {
+		if now.Sub(obj.ModTime) > presignStagingTTL {
+			deleteStaged(store, obj.Key)
+		}
+	}
+}
+
+// stagingPrefix returns the prefix of the staging keys of folder.
+func stagingPrefix(folder model.Folder) string {
+	return path.Join(presignStaging, folder.ID)
+}
+
+// deleteStaged deletes a staged object, rejected or copied to its folder.
+func deleteStaged(store storage.Storage, key string) {
+	if err := store.Delete(key); err != nil {
+		util.LogWarning("deleteStaged : Delete", err.Error())
+	}
+}
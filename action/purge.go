@@ -0,0 +1,138 @@
+package action
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/siddhartham/imageutil-thumbor/model"
+	"github.com/siddhartham/imageutil-thumbor/storage"
+	"github.com/siddhartham/imageutil-thumbor/util"
+)
+
+// PurgeHandler invalidates the rendered images of a project, so they are
+// rendered again from the origin on the next request:
+//
+//	POST /api/projects/{project_id}/purge  {"origin_path": "..."}, {"prefix": "..."} or {"all": true}
+//
+// origin_path and prefix match the origin path the images were rendered
+// from: the path under the project origin, the media bucket url or the
+// remote url. It takes a manage token of the project, as the media library
+// api does. When a CDN purge hook is configured, the purged files are
+// posted to it too.
+func PurgeHandler(db *sql.DB, store storage.Storage, sc *model.ServerConf, res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	if _, status, err := checkManageToken(sc, req, vars["project_id"]); err != nil {
+		uploadError(res, "PurgeHandler : checkManageToken", status, err)
+		return
+	}
+
+	purge := purgeRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&purge); err != nil {
+		uploadError(res, "PurgeHandler : Decode", http.StatusBadRequest, err)
+		return
+	}
+	originPath, prefix := purge.OriginPath, false
+	switch {
+	case purge.OriginPath != "" && purge.Prefix == "" && !purge.All:
+	case purge.OriginPath == "" && purge.Prefix != "" && !purge.All:
+		originPath, prefix = purge.Prefix, true
+	case purge.OriginPath == "" && purge.Prefix == "" && purge.All:
+		prefix = true
+	default:
+		uploadError(res, "PurgeHandler : Decode", http.StatusBadRequest, errors.New("Expected one of origin_path, prefix or all"))
+		return
+	}
+
+	images, err := invalidateImages(db, store, vars["project_id"], originPath, prefix)
+	if err != nil {
+		uploadError(res, "PurgeHandler : invalidateImages", http.StatusInternalServerError, err)
+		return
+	}
+	util.LogInfo("PurgeHandler : "+vars["project_id"], fmt.Sprintf("%s, %d images", originPath, len(images)))
+
+	result := purgeResult{Purged: len(images)}
+	if sc.CdnPurgeURL != "" && len(images) > 0 {
+		if err := purgeCdn(sc, vars["project_id"], images); err != nil {
+			util.LogError("PurgeHandler : purgeCdn", err.Error())
+			result.CdnError = err.Error()
+		} else {
+			result.CdnPurged = true
+		}
+	}
+	writeJSON(res, http.StatusOK, result)
+}
+
+type purgeRequest struct {
+	OriginPath string `json:"origin_path"`
+	Prefix     string `json:"prefix"`
+	All        bool   `json:"all"`
+}
+
+type purgeResult struct {
+	Purged    int    `json:"purged"`
+	CdnPurged bool   `json:"cdn_purged"`
+	CdnError  string `json:"cdn_error,omitempty"`
+}
+
+type cdnPurge struct {
+	ProjectID string   `json:"project_id"`
+	Files     []string `json:"files"`
+}
+
+var purgeClient = &http.Client{Timeout: 10 * time.Second}
+
+// purgeCdn posts the cdn paths of images to the CDN purge hook, as
+// {"project_id": "...", "files": ["/path", ...]}.
+func purgeCdn(sc *model.ServerConf, projectID string, images []model.Image) error {
+	purge := cdnPurge{ProjectID: projectID, Files: []string{}}
+	for _, image := range images {
+		if image.CdnPath != "" {
+			purge.Files = append(purge.Files, strings.Replace(image.CdnPath, fmt.Sprintf("%s/", sc.ResultStorage), "", 1))
+		}
+	}
+	if len(purge.Files) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(purge)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, sc.CdnPurgeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if sc.CdnPurgeToken != "" {
+		req.Header.Set("Authorization", "Bearer "+sc.CdnPurgeToken)
+	}
+	resp, err := purgeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("CDN purge hook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// purgeCdnInBackground purges images from the CDN when a hook is
+// configured, without holding up the request.
+func purgeCdnInBackground(sc *model.ServerConf, projectID string, images []model.Image) {
+	if sc.CdnPurgeURL == "" || len(images) == 0 {
+		return
+	}
+	Background(func() {
+		if err := purgeCdn(sc, projectID, images); err != nil {
+			util.LogError("purgeCdn", err.Error())
+		}
+	})
+}
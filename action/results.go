@@ -0,0 +1,213 @@
+package action
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/siddhartham/imageutil-thumbor/cache"
+	"github.com/siddhartham/imageutil-thumbor/model"
+)
+
+// results is the local cache of rendered images, nil when it is disabled.
+var results *cache.Cache
+
+// SetResultCache sets the local cache the proxy serves rendered images
+// from, and the invalidations drop them from.
+func SetResultCache(c *cache.Cache) {
+	results = c
+}
+
+// ResultKey returns the key a rendered image is cached at locally: the
+// images row it is indexed by. Keys start with the project and origin path,
+// so the images of a source can be dropped by prefix.
+func ResultKey(projectID string, originPath string, isSmart bool, transformation string) string {
+	smart := "0"
+	if isSmart {
+		smart = "1"
+	}
+	return strings.Join([]string{projectID, originPath, smart, transformation}, "|")
+}
+
+// uncacheResults drops the locally cached images of originPath, or of every
+// origin path starting with it when prefix is set. The cache is per node:
+// only the node handling the purge, revalidation or replace drops them, the
+// others keep serving theirs until they expire, cache_max_age at most.
+func uncacheResults(projectID string, originPath string, prefix bool) {
+	if results == nil {
+		return
+	}
+	key := projectID + "|" + originPath
+	if !prefix {
+		key += "|"
+	}
+	results.DeletePrefix(key)
+}
+
+// ServeCachedResult serves the rendered image cached locally at key, with
+// header and the ETag it was cached with, answering Range and conditional
+// requests too. It returns the entry served, or nil when there is none or
+// the request asks not to use cached copies.
+func ServeCachedResult(w http.ResponseWriter, req *http.Request, key string, header http.Header) *cache.Entry {
+	if results == nil || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return nil
+	}
+	if strings.Contains(req.Header.Get("Cache-Control"), "no-cache") {
+		return nil
+	}
+	r, entry, ok := results.Get(key)
+	if !ok {
+		return nil
+	}
+	defer r.Close()
+
+	for name, values := range header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Content-Type", entry.ContentType)
+	if entry.ETag != "" {
+		w.Header().Set("ETag", entry.ETag)
+	}
+	w.Header().Set("X-Cache", "HIT")
+	http.ServeContent(w, req, "", entry.ModTime, r)
+	return entry
+}
+
+// ResultWriter passes a rendered image through, replacing the caching
+// headers of the upstream with this service's ones. When the local cache
+// is enabled it keeps a copy of the body, to cache it once the response
+// is complete.
+type ResultWriter struct {
+	http.ResponseWriter
+	header       http.Header
+	status       int
+	cacheControl string
+	record       bool
+	body         bytes.Buffer
+	over         bool
+	limit        int64
+}
+
+// RecordResult returns the writer to serve a rendered image through, which
+// sets header on successful responses. The image is recorded to cache it
+// with CacheResult when the cache is enabled and the request is a GET.
+func RecordResult(w http.ResponseWriter, req *http.Request, sc *model.ServerConf, header http.Header) *ResultWriter {
+	return &ResultWriter{
+		ResponseWriter: w,
+		header:         header,
+		record:         results != nil && req.Method == http.MethodGet,
+		limit:          sc.CacheMaxEntry,
+	}
+}
+
+func (r *ResultWriter) WriteHeader(status int) {
+	if r.status != 0 {
+		return
+	}
+	r.status = status
+	r.cacheControl = r.Header().Get("Cache-Control")
+	if status == http.StatusOK || status == http.StatusPartialContent {
+		r.Header().Del("Expires")
+		for name, values := range r.header {
+			r.Header()[name] = values
+		}
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *ResultWriter) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.record && !r.over {
+		if r.limit > 0 && int64(r.body.Len()+len(p)) > r.limit {
+			r.over = true
+			r.body.Reset()
+		} else {
+			r.body.Write(p)
+		}
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *ResultWriter) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CacheResult caches the rendered image recorded by r at key, when the
+// response can be cached: a complete 200 the upstream allows to cache. It
+// is kept for the cache max age, less when the upstream max-age or the
+// project revalidation is sooner.
+func CacheResult(r *ResultWriter, sc *model.ServerConf, key string, projectID string, imageID string) {
+	if !r.record || r.status != http.StatusOK || r.over {
+		return
+	}
+	header := r.Header()
+	if header.Get("Content-Range") != "" {
+		return
+	}
+	if length := header.Get("Content-Length"); length != "" && length != strconv.Itoa(r.body.Len()) {
+		return
+	}
+
+	maxAge, ok := upstreamMaxAge(r.cacheControl)
+	if !ok {
+		return
+	}
+	if maxAge == 0 || maxAge > sc.CacheMaxAge {
+		maxAge = sc.CacheMaxAge
+	}
+	if after := cachePolicy(sc, projectID).RevalidateAfter; after > 0 && after < maxAge {
+		maxAge = after
+	}
+	modTime, _ := http.ParseTime(header.Get("Last-Modified"))
+	entry := cache.Entry{
+		Key:         key,
+		ContentType: header.Get("Content-Type"),
+		ImageID:     imageID,
+		ETag:        header.Get("ETag"),
+		ModTime:     modTime,
+	}
+	results.Put(entry, r.body.Bytes(), maxAge)
+}
+
+// upstreamMaxAge returns how long a response may be cached by its
+// Cache-Control, 0 when it does not say, and false when it may not be.
+func upstreamMaxAge(cacheControl string) (time.Duration, bool) {
+	var maxAge, sMaxAge time.Duration = -1, -1
+	for _, directive := range strings.Split(strings.ToLower(cacheControl), ",") {
+		name, value := strings.TrimSpace(directive), ""
+		if i := strings.Index(name, "="); i >= 0 {
+			name, value = strings.TrimSpace(name[:i]), strings.Trim(strings.TrimSpace(name[i+1:]), `"`)
+		}
+		switch name {
+		case "no-store", "no-cache", "private":
+			return 0, false
+		case "max-age", "s-maxage":
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				continue
+			}
+			if name == "max-age" {
+				maxAge = time.Duration(seconds) * time.Second
+			} else {
+				sMaxAge = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	// s-maxage is for shared caches, as this one is
+	if sMaxAge >= 0 {
+		maxAge = sMaxAge
+	}
+	switch {
+	case maxAge == 0:
+		return 0, false
+	case maxAge < 0:
+		return 0, true
+	}
+	return maxAge, true
+}
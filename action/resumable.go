@@ -0,0 +1,436 @@
+package action
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/siddhartham/imageutil-thumbor/model"
+	"github.com/siddhartham/imageutil-thumbor/storage"
+	"github.com/siddhartham/imageutil-thumbor/util"
+)
+
+// Resumable uploads send a file in chunks, so a client on a bad network
+// only resends the chunk that failed instead of the whole file:
+//
+//	POST   /upload/{uploadToken}/{fileName}/resumable             Upload-Length: <size>
+//	PATCH  /upload/{uploadToken}/{fileName}/resumable/{uploadID}  Upload-Offset: <offset>, body is the chunk
+//	HEAD   /upload/{uploadToken}/{fileName}/resumable/{uploadID}  tells the offset to resume from
+//	PUT    /upload/{uploadToken}/{fileName}/resumable/{uploadID}  completes the upload
+//	DELETE /upload/{uploadToken}/{fileName}/resumable/{uploadID}  aborts the upload
+//
+// Every chunk but the last one is ResumableChunkSize bytes, as each chunk
+// becomes a part of a multipart upload in storage, and each request has
+// upload_timeout to send it. Every request is checked against the upload
+// token. The upload state is kept in the resumable_uploads table, and an
+// upload idle for ResumableExpiry is aborted by the sweeper, its stored
+// parts with it. The parts are stored as sent, so when the upload policy
+// strips EXIF data the assembled file is stripped on completion, through a
+// staging key. A name conflict is resolved when the upload starts, with the
+// upload going on under the name answered with, and checked again on
+// completion.
+
+const (
+	// ResumableChunkSize is the size of the chunks, the minimum part size of
+	// S3 multipart uploads.
+	ResumableChunkSize = 5 * MB
+	// ResumableExpiry is how long an upload can go without a chunk.
+	ResumableExpiry = 24 * time.Hour
+)
+
+var ErrNoMultipart = errors.New("Storage does not support resumable uploads")
+
+type resumableStatus struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Offset    int64  `json:"offset"`
+	Size      int64  `json:"size"`
+	ChunkSize int64  `json:"chunk_size"`
+}
+
+// ResumableInitHandler starts a resumable upload of fileName.
+func ResumableInitHandler(db *sql.DB, store storage.Storage, sc *model.ServerConf, res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	util.LogInfo("ResumableInitHandler", vars["uploadToken"])
+	onConflict := req.URL.Query().Get("on_conflict")
+	folder, policy, target, status, err := checkTokenAndGetFolder(db, sc, vars["uploadToken"], vars["fileName"], onConflict)
+	if err != nil {
+		uploadError(res, "ResumableInitHandler : checkTokenAndGetFolder", status, err)
+		return
+	}
+	if _, ok := store.(storage.MultipartStorage); !ok {
+		uploadError(res, "ResumableInitHandler : MultipartStorage", http.StatusNotImplemented, ErrNoMultipart)
+		return
+	}
+
+	size, err := strconv.ParseInt(req.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size <= 0 {
+		uploadError(res, "ResumableInitHandler : Upload-Length", http.StatusBadRequest, errors.New("Invalid Upload-Length header"))
+		return
+	}
+	if size > policy.MaxSize {
+		uploadError(res, "ResumableInitHandler : Upload-Length", http.StatusRequestEntityTooLarge, ErrTooLarge)
+		return
+	}
+
+	upload := model.Upload{
+		UploadToken: vars["uploadToken"],
+		UserID:      folder.UserID,
+		ProjectID:   folder.ProjectID,
+		FolderID:    folder.ID,
+		FileName:    target.Name,
+		Key:         target.Key,
+		Size:        size,
+		Parts:       "[]",
+		OnConflict:  onConflict,
+	}
+	if target.Mode != "" {
+		upload.OnConflict = target.Mode
+	}
+	upload.ID, err = randomID()
+	if err != nil {
+		uploadError(res, "ResumableInitHandler : randomID", http.StatusInternalServerError, err)
+		return
+	}
+	_, err = db.Exec("INSERT INTO resumable_uploads (id, upload_token, user_id, project_id, folder_id, file_name, store_key, storage_upload_id, size, upload_offset, parts, on_conflict, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, '', ?, 0, ?, ?, NOW(), NOW())",
+		upload.ID, upload.UploadToken, upload.UserID, upload.ProjectID, upload.FolderID, upload.FileName, upload.Key, upload.Size, upload.Parts, upload.OnConflict)
+	if err != nil {
+		uploadError(res, "ResumableInitHandler : INSERT", http.StatusInternalServerError, err)
+		return
+	}
+
+	res.Header().Set("Location", fmt.Sprintf("/upload/%s/%s/resumable/%s", url.PathEscape(upload.UploadToken), url.PathEscape(upload.FileName), upload.ID))
+	writeResumableStatus(res, http.StatusCreated, upload)
+}
+
+// ResumableStatusHandler answers a HEAD request with the offset the upload
+// resumes from.
+func ResumableStatusHandler(db *sql.DB, store storage.Storage, sc *model.ServerConf, res http.ResponseWriter, req *http.Request) {
+	upload, status, err := getResumableUpload(db, mux.Vars(req))
+	if err != nil {
+		uploadError(res, "ResumableStatusHandler : getResumableUpload", status, err)
+		return
+	}
+	if _, _, status, err := checkToken(db, sc, upload.UploadToken); err != nil {
+		uploadError(res, "ResumableStatusHandler : checkToken", status, err)
+		return
+	}
+
+	res.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	res.Header().Set("Upload-Length", strconv.FormatInt(upload.Size, 10))
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(http.StatusOK)
+}
+
+// ResumableChunkHandler stores the chunk starting at the Upload-Offset of the
+// request. The offset has to be the one the upload is at, so a chunk sent
+// twice is rejected rather than stored twice.
+func ResumableChunkHandler(db *sql.DB, store storage.Storage, sc *model.ServerConf, res http.ResponseWriter, req *http.Request) {
+	upload, status, err := getResumableUpload(db, mux.Vars(req))
+	if err != nil {
+		uploadError(res, "ResumableChunkHandler : getResumableUpload", status, err)
+		return
+	}
+	_, policy, status, err := checkToken(db, sc, upload.UploadToken)
+	if err != nil {
+		uploadError(res, "ResumableChunkHandler : checkToken", status, err)
+		return
+	}
+	multipartStore, ok := store.(storage.MultipartStorage)
+	if !ok {
+		uploadError(res, "ResumableChunkHandler : MultipartStorage", http.StatusNotImplemented, ErrNoMultipart)
+		return
+	}
+
+	offset, err := strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		uploadError(res, "ResumableChunkHandler : Upload-Offset", http.StatusBadRequest, errors.New("Invalid Upload-Offset header"))
+		return
+	}
+	if offset != upload.Offset {
+		res.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		uploadError(res, "ResumableChunkHandler : Upload-Offset", http.StatusConflict, fmt.Errorf("Upload is at offset %d", upload.Offset))
+		return
+	}
+
+	// Read the chunk, it is at most ResumableChunkSize
+	expected := upload.Size - upload.Offset
+	if expected > ResumableChunkSize {
+		expected = ResumableChunkSize
+	}
+	if req.ContentLength > expected {
+		uploadError(res, "ResumableChunkHandler : ContentLength", http.StatusRequestEntityTooLarge, ErrTooLarge)
+		return
+	}
+	chunk, err := ioutil.ReadAll(io.LimitReader(req.Body, expected+1))
+	if err != nil {
+		uploadError(res, "ResumableChunkHandler : read chunk", http.StatusBadRequest, err)
+		return
+	}
+	if int64(len(chunk)) != expected {
+		uploadError(res, "ResumableChunkHandler : read chunk", http.StatusBadRequest, fmt.Errorf("Chunk must be %d bytes, got %d", expected, len(chunk)))
+		return
+	}
+
+	// The first chunk holds the image header, validate it before storing
+	// anything. The storage upload is only started then, once the content
+	// type is known.
+	if upload.Offset == 0 {
+		_, mimeType, header, err := sniff(bytes.NewReader(chunk))
+		if err != nil {
+			uploadError(res, "ResumableChunkHandler : get file header", http.StatusBadRequest, err)
+			return
+		}
+		if err := validateImage(header, policy); err != nil {
+			uploadError(res, "ResumableChunkHandler : validateImage", validationStatus(err), err)
+			return
+		}
+		upload.MimeType = mimeType
+		upload.Width = header.Width
+		upload.Height = header.Height
+		upload.Format = header.Format
+		upload.StorageUploadID, err = multipartStore.CreateMultipart(upload.Key, mimeType)
+		if err != nil {
+			uploadError(res, "ResumableChunkHandler : CreateMultipart", http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	parts := []storage.Part{}
+	if err := json.Unmarshal([]byte(upload.Parts), &parts); err != nil {
+		uploadError(res, "ResumableChunkHandler : parts", http.StatusInternalServerError, err)
+		return
+	}
+	part, err := multipartStore.PutPart(upload.Key, upload.StorageUploadID, int(upload.Offset/ResumableChunkSize)+1, chunk)
+	if err != nil {
+		uploadError(res, "ResumableChunkHandler : PutPart", http.StatusInternalServerError, err)
+		return
+	}
+	parts = append(parts, part)
+	partsJSON, _ := json.Marshal(parts)
+
+	// Only move the offset if no other request moved it in the meantime
+	result, err := db.Exec("UPDATE resumable_uploads SET upload_offset=?, parts=?, storage_upload_id=?, mime_type=?, width=?, height=?, format=?, updated_at=NOW() WHERE id=? AND upload_offset=?",
+		upload.Offset+int64(len(chunk)), string(partsJSON), upload.StorageUploadID, upload.MimeType, upload.Width, upload.Height, upload.Format, upload.ID, upload.Offset)
+	if err != nil {
+		uploadError(res, "ResumableChunkHandler : UPDATE", http.StatusInternalServerError, err)
+		return
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected != 1 {
+		if upload.Offset == 0 {
+			multipartStore.AbortMultipart(upload.Key, upload.StorageUploadID)
+		}
+		uploadError(res, "ResumableChunkHandler : UPDATE", http.StatusConflict, errors.New("Chunk was uploaded concurrently"))
+		return
+	}
+
+	res.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset+int64(len(chunk)), 10))
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// ResumableCompleteHandler assembles the chunks once they are all uploaded
+// and adds the file to its folder.
+func ResumableCompleteHandler(db *sql.DB, store storage.Storage, sc *model.ServerConf, res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	upload, status, err := getResumableUpload(db, vars)
+	if err != nil {
+		uploadError(res, "ResumableCompleteHandler : getResumableUpload", status, err)
+		return
+	}
+	multipartStore, ok := store.(storage.MultipartStorage)
+	if !ok {
+		uploadError(res, "ResumableCompleteHandler : MultipartStorage", http.StatusNotImplemented, ErrNoMultipart)
+		return
+	}
+	if upload.Offset != upload.Size {
+		res.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		uploadError(res, "ResumableCompleteHandler : offset", http.StatusConflict, fmt.Errorf("Upload is at offset %d of %d", upload.Offset, upload.Size))
+		return
+	}
+
+	// the token may have expired or the name been taken since the upload started
+	folder, policy, target, status, err := checkTokenAndGetFolder(db, sc, upload.UploadToken, upload.FileName, upload.OnConflict)
+	if err == nil && (target.Name != upload.FileName || target.Key != upload.Key) {
+		status, err = http.StatusConflict, errors.New("File with same name already exists in this folder")
+	}
+	if err != nil {
+		uploadError(res, "ResumableCompleteHandler : checkTokenAndGetFolder", status, err)
+		return
+	}
+	if status, err := claimFile(db, policy); err != nil {
+		uploadError(res, "ResumableCompleteHandler : claimFile", status, err)
+		return
+	}
+	if target.Existing != nil && target.Mode == model.ConflictVersion {
+		if err := versionFile(db, store, *target.Existing); err != nil {
+			releaseFile(db, policy)
+			uploadError(res, "ResumableCompleteHandler : versionFile", http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	parts := []storage.Part{}
+	if err := json.Unmarshal([]byte(upload.Parts), &parts); err != nil {
+		releaseFile(db, policy)
+		uploadError(res, "ResumableCompleteHandler : parts", http.StatusInternalServerError, err)
+		return
+	}
+	if err := multipartStore.CompleteMultipart(upload.Key, upload.StorageUploadID, parts); err != nil {
+		releaseFile(db, policy)
+		uploadError(res, "ResumableCompleteHandler : CompleteMultipart", http.StatusInternalServerError, err)
+		return
+	}
+
+	size := upload.Size
+	if upload.Format == "jpeg" && *policy.StripExif {
+		size, err = stripAssembled(store, folder, upload)
+		if err != nil {
+			// a new file is not left in the folder with its Exif data
+			if target.Existing == nil {
+				deleteStaged(store, upload.Key)
+			}
+			releaseFile(db, policy)
+			uploadError(res, "ResumableCompleteHandler : stripAssembled", http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	header := imageHeader{Width: upload.Width, Height: upload.Height, Format: upload.Format}
+	if target.Existing != nil {
+		_, err = replaceFile(db, store, sc, *target.Existing, size, upload.MimeType, upload.FileName, header)
+	} else {
+		_, err = saveFileToDb(db, &folder, upload.FileName, upload.Key, size, upload.MimeType, upload.FileName, header)
+	}
+	if err != nil {
+		releaseFile(db, policy)
+		uploadError(res, "ResumableCompleteHandler : saveFileToDb", http.StatusInternalServerError, err)
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM resumable_uploads WHERE id=?", upload.ID); err != nil {
+		util.LogWarning("ResumableCompleteHandler : DELETE", err.Error())
+	}
+
+	util.LogInfo("ResumableCompleteHandler : ", upload.Key)
+	res.WriteHeader(http.StatusOK)
+	res.Write([]byte("Uploaded!"))
+}
+
+// stripAssembled strips the Exif data of the jpeg assembled at the key of
+// upload, into a staging key of folder first as the key cannot be written
+// while it is read. It returns the size stored.
+func stripAssembled(store storage.Storage, folder model.Folder, upload model.Upload) (int64, error) {
+	staged := path.Join(stagingPrefix(folder), upload.ID, upload.FileName)
+	defer deleteStaged(store, staged)
+	size, err := stripStored(store, upload.Key, staged, upload.MimeType)
+	if err != nil {
+		return 0, err
+	}
+	return size, store.Copy(staged, upload.Key)
+}
+
+// ResumableAbortHandler drops an upload and the chunks stored so far.
+func ResumableAbortHandler(db *sql.DB, store storage.Storage, sc *model.ServerConf, res http.ResponseWriter, req *http.Request) {
+	upload, status, err := getResumableUpload(db, mux.Vars(req))
+	if err != nil {
+		uploadError(res, "ResumableAbortHandler : getResumableUpload", status, err)
+		return
+	}
+	if _, _, status, err := checkToken(db, sc, upload.UploadToken); err != nil {
+		uploadError(res, "ResumableAbortHandler : checkToken", status, err)
+		return
+	}
+
+	if err := abortResumable(db, store, upload); err != nil {
+		uploadError(res, "ResumableAbortHandler : abortResumable", http.StatusInternalServerError, err)
+		return
+	}
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// abortResumable drops an upload and the parts stored so far.
+func abortResumable(db *sql.DB, store storage.Storage, upload model.Upload) error {
+	if multipartStore, ok := store.(storage.MultipartStorage); ok && upload.StorageUploadID != "" {
+		if err := multipartStore.AbortMultipart(upload.Key, upload.StorageUploadID); err != nil && err != storage.ErrNotFound {
+			util.LogWarning("abortResumable : AbortMultipart", err.Error())
+		}
+	}
+	_, err := db.Exec("DELETE FROM resumable_uploads WHERE id=?", upload.ID)
+	return err
+}
+
+// sweepResumable aborts the uploads idle for longer than ResumableExpiry.
+func sweepResumable(db *sql.DB, store storage.Storage) {
+	rows, err := db.Query("SELECT id, store_key, storage_upload_id FROM resumable_uploads WHERE updated_at < DATE_SUB(NOW(), INTERVAL ? SECOND)", int64(ResumableExpiry.Seconds()))
+	if err != nil {
+		util.LogWarning("sweepResumable : SELECT", err.Error())
+		return
+	}
+	expired := []model.Upload{}
+	for rows.Next() {
+		upload := model.Upload{}
+		if err := rows.Scan(&upload.ID, &upload.Key, &upload.StorageUploadID); err != nil {
+			util.LogWarning("sweepResumable : Scan", err.Error())
+			continue
+		}
+		expired = append(expired, upload)
+	}
+	rows.Close()
+
+	for _, upload := range expired {
+		if err := abortResumable(db, store, upload); err != nil {
+			util.LogWarning("sweepResumable : abortResumable", err.Error())
+		}
+	}
+}
+
+// getResumableUpload returns the upload of the request, which has to have
+// been started with the same upload token and file name, and not be expired.
+func getResumableUpload(db *sql.DB, vars map[string]string) (model.Upload, int, error) {
+	upload := model.Upload{}
+	err := db.QueryRow("SELECT id, upload_token, user_id, project_id, folder_id, file_name, store_key, storage_upload_id, size, upload_offset, parts, COALESCE(on_conflict, ''), COALESCE(mime_type, ''), COALESCE(width, 0), COALESCE(height, 0), COALESCE(format, '') FROM resumable_uploads WHERE id=? AND upload_token=? AND file_name=? AND updated_at >= DATE_SUB(NOW(), INTERVAL ? SECOND)",
+		vars["uploadID"], vars["uploadToken"], vars["fileName"], int64(ResumableExpiry.Seconds())).Scan(
+		&upload.ID, &upload.UploadToken, &upload.UserID, &upload.ProjectID, &upload.FolderID, &upload.FileName, &upload.Key, &upload.StorageUploadID,
+		&upload.Size, &upload.Offset, &upload.Parts, &upload.OnConflict, &upload.MimeType, &upload.Width, &upload.Height, &upload.Format)
+	if err == sql.ErrNoRows {
+		return upload, http.StatusNotFound, errors.New("Upload not found")
+	}
+	if err != nil {
+		return upload, http.StatusInternalServerError, err
+	}
+	return upload, http.StatusOK, nil
+}
+
+func randomID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func writeResumableStatus(res http.ResponseWriter, status int, upload model.Upload) {
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(resumableStatus{
+		ID:        upload.ID,
+		Name:      upload.FileName,
+		Offset:    upload.Offset,
+		Size:      upload.Size,
+		ChunkSize: ResumableChunkSize,
+	})
+}
@@ -0,0 +1,161 @@
+package action
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/siddhartham/imageutil-thumbor/config"
+	"github.com/siddhartham/imageutil-thumbor/model"
+	"github.com/siddhartham/imageutil-thumbor/storage"
+	"github.com/siddhartham/imageutil-thumbor/util"
+)
+
+// Rendered images are kept for good by default. When revalidate_after is
+// set, for the server or per project in project_cache, an image served
+// longer than that has its source checked against the origin with a
+// conditional request. A source that changed has its rendered images
+// invalidated, as a purge would, and the request renders it again.
+
+var revalidateClient = &http.Client{Timeout: 5 * time.Second}
+
+// revalidating holds the ids of the images being revalidated, so a burst of
+// requests for a stale image checks its source once.
+var revalidating sync.Map
+
+// cachePolicy returns the cache policy of a project, the project's own
+// settings completed with the server wide ones.
+func cachePolicy(sc *model.ServerConf, projectID string) model.CachePolicy {
+	widths, _ := config.ParseWidths(sc.Widths)
+	policy := model.CachePolicy{RevalidateAfter: sc.RevalidateAfter, MaxAge: sc.MaxAge, Widths: widths}
+
+	project, ok := sc.ProjectCache[projectID]
+	if !ok {
+		return policy
+	}
+	if project.RevalidateAfter != 0 {
+		policy.RevalidateAfter = project.RevalidateAfter
+	}
+	if project.MaxAge != 0 {
+		policy.MaxAge = project.MaxAge
+	}
+	if len(project.Widths) > 0 {
+		policy.Widths = append([]int{}, project.Widths...)
+		sort.Ints(policy.Widths)
+	}
+	return policy
+}
+
+// Widths returns the widths the project's dpr scaled and client hinted
+// sizes are snapped to, ascending.
+func Widths(sc *model.ServerConf, projectID string) []int {
+	return cachePolicy(sc, projectID).Widths
+}
+
+// Revalidates reports whether the sources of the project's images are
+// checked for changes.
+func Revalidates(sc *model.ServerConf, projectID string) bool {
+	return cachePolicy(sc, projectID).RevalidateAfter > 0
+}
+
+// Stale reports whether the source of a rendered image is due a check.
+func Stale(sc *model.ServerConf, image model.Image) bool {
+	after := cachePolicy(sc, image.ProjectID).RevalidateAfter
+	return after > 0 && time.Since(time.Unix(image.ValidatedAt, 0)) >= after
+}
+
+// RevalidateImage checks whether the source of a rendered image changed
+// since it was rendered. When it did, the images rendered from it are
+// invalidated, image gets the new validators, and it returns true so the
+// image is rendered again. When the source cannot be checked, the rendered
+// image keeps being served.
+func RevalidateImage(db *sql.DB, store storage.Storage, sc *model.ServerConf, source string, image *model.Image) bool {
+	if _, busy := revalidating.LoadOrStore(image.ID, true); busy {
+		return false
+	}
+	defer revalidating.Delete(image.ID)
+
+	status, etag, lastModified, err := originValidators(source, *image)
+	if err != nil {
+		util.LogWarning("RevalidateImage : originValidators", err.Error())
+		return false
+	}
+
+	changed := status == http.StatusOK &&
+		(image.OriginETag != "" || image.OriginLastModified != "") &&
+		(etag != "" || lastModified != "") &&
+		(etag != image.OriginETag || lastModified != image.OriginLastModified)
+	if !changed {
+		// rendered before validators were kept, they are only recorded
+		if status == http.StatusOK && image.OriginETag == "" && image.OriginLastModified == "" {
+			image.OriginETag, image.OriginLastModified = etag, lastModified
+		}
+		touched := *image
+		Background(func() {
+			TouchImage(db, touched)
+		})
+		return false
+	}
+
+	util.LogInfo("RevalidateImage : changed", source)
+	images, err := invalidateImages(db, store, image.ProjectID, image.OriginPath, false)
+	if err != nil {
+		util.LogError("RevalidateImage : invalidateImages", err.Error())
+		return false
+	}
+	purgeCdnInBackground(sc, image.ProjectID, images)
+
+	image.ID = ""
+	image.CdnPath = ""
+	image.FileSize = 0
+	image.OriginETag, image.OriginLastModified = etag, lastModified
+	return true
+}
+
+// OriginValidators returns the ETag and Last-Modified of a source, to be
+// kept with the image rendered from it.
+func OriginValidators(source string) (string, string) {
+	_, etag, lastModified, err := originValidators(source, model.Image{})
+	if err != nil {
+		util.LogWarning("OriginValidators", err.Error())
+	}
+	return etag, lastModified
+}
+
+// originValidators asks the origin for the validators of a source, with a
+// HEAD conditional on the ones image has. Origins refusing HEAD are asked
+// with a GET, whose body is not read.
+func originValidators(source string, image model.Image) (int, string, string, error) {
+	var resp *http.Response
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		req, err := http.NewRequest(method, source, nil)
+		if err != nil {
+			return 0, "", "", err
+		}
+		if image.OriginETag != "" {
+			req.Header.Set("If-None-Match", image.OriginETag)
+		}
+		if image.OriginLastModified != "" {
+			req.Header.Set("If-Modified-Since", image.OriginLastModified)
+		}
+		resp, err = revalidateClient.Do(req)
+		if err != nil {
+			return 0, "", "", err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			break
+		}
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.StatusCode, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"), nil
+	case http.StatusNotModified:
+		return resp.StatusCode, image.OriginETag, image.OriginLastModified, nil
+	}
+	return resp.StatusCode, "", "", fmt.Errorf("Origin returned %s for %s", resp.Status, source)
+}
@@ -0,0 +1,54 @@
+package action
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/siddhartham/imageutil-thumbor/util"
+)
+
+// schema lists the tables and columns this version reads and writes beyond
+// the original ones, with the migration in migrations/ adding them.
+var schema = []struct {
+	table     string
+	columns   string
+	migration string
+}{
+	{"images", "origin_etag, origin_last_modified, validated_at", "0001_images_origin_validators.sql"},
+	{"resumable_uploads", "id, upload_token, store_key, storage_upload_id, upload_offset, parts, mime_type, width, height, format, updated_at", "0002_resumable_uploads.sql"},
+	{"images", "meta", "0003_images_meta.sql"},
+	{"folders", "width, height, format", "0004_folders_image_header.sql"},
+	{"folders", "conflict_policy", "0005_folder_versions.sql"},
+	{"folder_versions", "id, file_id, project_id, version, path, original_name, mime_type, file_size, width, height, format, created_at", "0005_folder_versions.sql"},
+	{"upload_token_uses", "jti, uses, max_files, expires_at", "0006_upload_token_uses.sql"},
+}
+
+// CheckSchema checks the database has the tables and columns of schema, so
+// a missing migration stops the server at start rather than failing every
+// query. A database that cannot be reached is only warned about, as it
+// was before.
+func CheckSchema(db *sql.DB) error {
+	if err := db.Ping(); err != nil {
+		util.LogWarning("CheckSchema : Ping", err.Error())
+		return nil
+	}
+	missing := []string{}
+	seen := map[string]bool{}
+	for _, s := range schema {
+		rows, err := db.Query(fmt.Sprintf("SELECT %s FROM %s LIMIT 0", s.columns, s.table))
+		if err != nil {
+			util.LogError("CheckSchema : "+s.table, err.Error())
+			if !seen[s.migration] {
+				seen[s.migration] = true
+				missing = append(missing, s.migration)
+			}
+			continue
+		}
+		rows.Close()
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("Database schema is out of date, apply migrations/%s", strings.Join(missing, ", migrations/"))
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package action
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/siddhartham/imageutil-thumbor/config"
+	"github.com/siddhartham/imageutil-thumbor/model"
+	"github.com/siddhartham/imageutil-thumbor/srcset"
+	"github.com/siddhartham/imageutil-thumbor/storage"
+	"github.com/siddhartham/imageutil-thumbor/util"
+)
+
+// SrcsetHandler returns the srcset, sizes and <picture> sources of an
+// image of the project, built by the configured proxy routes:
+//
+//	GET /api/projects/{project_id}/srcset?image=...&transformation=...&breakpoints=320,640
+//
+// Optional parameters are sizes, formats (the <picture> sources, e.g.
+// "avif,webp"), source (origin, media or remote), smart, sign (to sign the
+// urls with the url signing key), base_url (the request's own host by
+// default) and output, json or html, which asks for the client hints the
+// s:auto and dpr:auto urls are sized by. Breakpoints default to the
+// project's widths. It takes a manage token of the project, as signed urls
+// are cached for good.
+func SrcsetHandler(db *sql.DB, store storage.Storage, sc *model.ServerConf, res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	if _, status, err := checkManageToken(sc, req, vars["project_id"]); err != nil {
+		uploadError(res, "SrcsetHandler : checkManageToken", status, err)
+		return
+	}
+
+	query := req.URL.Query()
+	options := srcset.Options{
+		BaseURL:        query.Get("base_url"),
+		Image:          query.Get("image"),
+		Transformation: query.Get("transformation"),
+		Sizes:          query.Get("sizes"),
+	}
+	if options.Image == "" {
+		uploadError(res, "SrcsetHandler : image", http.StatusBadRequest, errors.New("Missing image"))
+		return
+	}
+	if options.BaseURL == "" {
+		options.BaseURL = requestBaseURL(req)
+	}
+
+	err := db.QueryRow("SELECT uuid FROM projects WHERE id=? AND is_active=1", vars["project_id"]).Scan(&options.ProjectID)
+	if err == sql.ErrNoRows {
+		uploadError(res, "SrcsetHandler : SELECT", http.StatusNotFound, errors.New("Project not found"))
+		return
+	}
+	if err != nil {
+		uploadError(res, "SrcsetHandler : SELECT", http.StatusInternalServerError, err)
+		return
+	}
+
+	source := query.Get("source")
+	if source == "" {
+		source = model.SourceOrigin
+	}
+	smart, _ := strconv.ParseBool(query.Get("smart"))
+	route, ok := findRoute(sc, source, smart)
+	if !ok {
+		uploadError(res, "SrcsetHandler : findRoute", http.StatusBadRequest, fmt.Errorf("No %s route, smart %t", source, smart))
+		return
+	}
+	options.Route = route.Path
+
+	options.Widths = Widths(sc, vars["project_id"])
+	if breakpoints := query.Get("breakpoints"); breakpoints != "" {
+		options.Widths, err = config.ParseWidths(breakpoints)
+		if err != nil {
+			uploadError(res, "SrcsetHandler : breakpoints", http.StatusBadRequest, fmt.Errorf("breakpoints %s", err))
+			return
+		}
+	}
+	for _, format := range strings.Split(query.Get("formats"), ",") {
+		if format = strings.TrimSpace(format); format != "" {
+			options.Formats = append(options.Formats, format)
+		}
+	}
+	if sign, _ := strconv.ParseBool(query.Get("sign")); sign {
+		if sc.URLSigningKey == "" {
+			uploadError(res, "SrcsetHandler : sign", http.StatusBadRequest, errors.New("No url signing key is configured"))
+			return
+		}
+		options.SigningKey = sc.URLSigningKey
+	}
+
+	set, err := srcset.Build(options)
+	if err != nil {
+		uploadError(res, "SrcsetHandler : Build", http.StatusBadRequest, err)
+		return
+	}
+	util.LogInfo("SrcsetHandler : "+vars["project_id"], options.Image)
+
+	if query.Get("output") == "html" {
+		acceptHints(res.Header())
+		res.Header().Set("Content-Type", "text/html; charset=utf-8")
+		res.WriteHeader(http.StatusOK)
+		res.Write([]byte(set.HTML(query.Get("alt"))))
+		return
+	}
+	writeJSON(res, http.StatusOK, set)
+}
+
+// findRoute returns the first proxy route serving images from source,
+// smart or not.
+func findRoute(sc *model.ServerConf, source string, smart bool) (model.Route, bool) {
+	for _, route := range sc.Routes {
+		if route.Source == source && route.Smart == smart {
+			return route, true
+		}
+	}
+	return model.Route{}, false
+}
+
+// requestBaseURL returns the scheme and host a request was made to.
+func requestBaseURL(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	if proto := req.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + req.Host
+}
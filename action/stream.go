@@ -0,0 +1,130 @@
+package action
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/siddhartham/imageutil-thumbor/model"
+)
+
+// multipartOverhead is allowed on top of the file size limit for the part
+// headers and boundaries of the request body.
+const multipartOverhead = 1 * MB
+
+var ErrTooLarge = errors.New("File is too large")
+
+// sizeLimitReader counts the bytes read and fails with ErrTooLarge as soon
+// as more than limit bytes have been read.
+type sizeLimitReader struct {
+	r     io.Reader
+	limit int64
+	n     int64
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.limit {
+		return n, ErrTooLarge
+	}
+	return n, err
+}
+
+// uploadPolicy returns the upload policy of a project, the project's own
+// settings completed with the server wide ones.
+func uploadPolicy(sc *model.ServerConf, projectID string) model.UploadPolicy {
+	stripExif := sc.StripExif
+	policy := model.UploadPolicy{
+		MaxSize:    sc.MaxUploadSize,
+		Formats:    strings.Split(sc.UploadFormats, ","),
+		MaxWidth:   sc.MaxUploadWidth,
+		MaxHeight:  sc.MaxUploadHeight,
+		MaxPixels:  sc.MaxUploadPixels,
+		StripExif:  &stripExif,
+		OnConflict: sc.UploadConflict,
+	}
+
+	project, ok := sc.ProjectUploads[projectID]
+	if !ok {
+		return policy
+	}
+	if project.MaxSize > 0 {
+		policy.MaxSize = project.MaxSize
+	}
+	if len(project.Formats) > 0 {
+		policy.Formats = project.Formats
+	}
+	if project.MaxWidth > 0 {
+		policy.MaxWidth = project.MaxWidth
+	}
+	if project.MaxHeight > 0 {
+		policy.MaxHeight = project.MaxHeight
+	}
+	if project.MaxPixels > 0 {
+		policy.MaxPixels = project.MaxPixels
+	}
+	if project.StripExif != nil {
+		policy.StripExif = project.StripExif
+	}
+	if project.OnConflict != "" {
+		policy.OnConflict = project.OnConflict
+	}
+	return policy
+}
+
+// nextFilePart returns the next part of the multipart body named "file",
+// skipping any other form fields.
+func nextFilePart(mr *multipart.Reader) (*multipart.Part, error) {
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "file" && part.FileName() != "" {
+			return part, nil
+		}
+		part.Close()
+	}
+}
+
+// sniff detects the content type from the first bytes of r and decodes the
+// image header found in them, returning a reader that still yields them.
+// The header is left empty when r is not an image.
+func sniff(r io.Reader) (io.Reader, string, imageHeader, error) {
+	header := imageHeader{}
+	br := bufio.NewReaderSize(r, headerPeekSize)
+	head, err := br.Peek(headerPeekSize)
+	if err != nil && err != io.EOF {
+		return nil, "", header, err
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(head))
+	if err == nil {
+		header = imageHeader{Width: int64(config.Width), Height: int64(config.Height), Format: format}
+	}
+	return br, http.DetectContentType(head), header, nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// tooLarge reports whether err comes from a body or file exceeding its limit.
+func tooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.Is(err, ErrTooLarge) || errors.As(err, &maxBytesErr)
+}
@@ -0,0 +1,224 @@
+package action
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/siddhartham/imageutil-thumbor/model"
+)
+
+func TestSizeLimitReader(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int
+		limit int64
+		err   error
+	}{
+		{"under the limit", 10, 20, nil},
+		{"at the limit", 20, 20, nil},
+		{"over the limit", 21, 20, ErrTooLarge},
+		{"empty", 0, 0, nil},
+	}
+	for _, tt := range tests {
+		r := &sizeLimitReader{r: bytes.NewReader(make([]byte, tt.size)), limit: tt.limit}
+		_, err := ioutil.ReadAll(r)
+		if err != tt.err {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestUploadPolicy(t *testing.T) {
+	off := false
+	sc := &model.ServerConf{
+		MaxUploadSize:   10 * MB,
+		UploadFormats:   "jpeg,png",
+		MaxUploadWidth:  4000,
+		MaxUploadHeight: 3000,
+		MaxUploadPixels: 12000000,
+		StripExif:       true,
+		UploadConflict:  "rename",
+		ProjectUploads: map[string]model.UploadPolicy{
+			"small": {MaxSize: 1 * MB, Formats: []string{"png"}, StripExif: &off, OnConflict: "version"},
+			"wide":  {MaxWidth: 8000, MaxPixels: 24000000},
+		},
+	}
+
+	tests := []struct {
+		project   string
+		maxSize   int64
+		formats   string
+		maxWidth  int64
+		maxPixels int64
+		stripExif bool
+		conflict  string
+	}{
+		{"other", 10 * MB, "jpeg,png", 4000, 12000000, true, "rename"},
+		{"small", 1 * MB, "png", 4000, 12000000, false, "version"},
+		{"wide", 10 * MB, "jpeg,png", 8000, 24000000, true, "rename"},
+	}
+	for _, tt := range tests {
+		p := uploadPolicy(sc, tt.project)
+		if p.MaxSize != tt.maxSize || strings.Join(p.Formats, ",") != tt.formats || p.MaxWidth != tt.maxWidth || p.MaxHeight != 3000 || p.MaxPixels != tt.maxPixels || *p.StripExif != tt.stripExif || p.OnConflict != tt.conflict {
+			t.Errorf("%s: got %+v", tt.project, p)
+		}
+	}
+
+	// the server wide setting is not shared with the policies
+	*uploadPolicy(sc, "other").StripExif = false
+	if !sc.StripExif {
+		t.Error("the policy changed the server config")
+	}
+}
+
+func TestTooLarge(t *testing.T) {
+	rec := httptest.NewRecorder()
+	body := http.MaxBytesReader(rec, ioutil.NopCloser(strings.NewReader("0123456789")), 5)
+	_, maxBytesErr := ioutil.ReadAll(body)
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"file limit", ErrTooLarge, true},
+		{"wrapped file limit", fmt.Errorf("storing: %w", ErrTooLarge), true},
+		{"body limit", maxBytesErr, true},
+		{"other error", io.ErrUnexpectedEOF, false},
+		{"no error", nil, false},
+	}
+	for _, tt := range tests {
+		if got := tooLarge(tt.err); got != tt.want {
+			t.Errorf("%s: got %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCountingReader(t *testing.T) {
+	c := &countingReader{r: strings.NewReader("hello world")}
+	if _, err := ioutil.ReadAll(c); err != nil {
+		t.Fatal(err)
+	}
+	if c.n != 11 {
+		t.Errorf("got %d, want 11", c.n)
+	}
+}
+
+// testPNG returns a png of the given size.
+func testPNG(t *testing.T, width int, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testJPEG returns a jpeg of the given size.
+func testJPEG(t *testing.T, width int, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// withSegment returns the jpeg data with a marker segment of the given
+// payload inserted right after its start of image.
+func withSegment(data []byte, marker byte, payload []byte) []byte {
+	segment := []byte{0xFF, marker, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}
+	segment = append(segment, payload...)
+	return append(append(append([]byte{}, data[:2]...), segment...), data[2:]...)
+}
+
+// withPadding returns the jpeg data with n more bytes of APP2 segments
+// ahead of its frame header.
+func withPadding(data []byte, n int) []byte {
+	for n > 0 {
+		size := n - 4
+		if size > 60000 {
+			size = 60000
+		}
+		if size < 0 {
+			size = 0
+		}
+		data = withSegment(data, 0xE2, make([]byte, size))
+		n -= size + 4
+	}
+	return data
+}
+
+func TestSniff(t *testing.T) {
+	img := testPNG(t, 30, 20)
+	// a jpeg whose header is found after large metadata segments
+	padded := withPadding(testJPEG(t, 40, 10), 100<<10)
+	// and one whose header is past what is peeked at
+	tooPadded := withPadding(testJPEG(t, 40, 10), headerPeekSize)
+
+	tests := []struct {
+		name        string
+		data        []byte
+		contentType string
+		header      imageHeader
+	}{
+		{"png", img, "image/png", imageHeader{Width: 30, Height: 20, Format: "png"}},
+		{"jpeg after metadata", padded, "image/jpeg", imageHeader{Width: 40, Height: 10, Format: "jpeg"}},
+		{"header past the peek", tooPadded, "image/jpeg", imageHeader{}},
+		{"text", []byte("hello world"), "text/plain; charset=utf-8", imageHeader{}},
+		{"empty", nil, "text/plain; charset=utf-8", imageHeader{}},
+	}
+	for _, tt := range tests {
+		r, contentType, header, err := sniff(bytes.NewReader(tt.data))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if contentType != tt.contentType || header != tt.header {
+			t.Errorf("%s: got %q, %+v, want %q, %+v", tt.name, contentType, header, tt.contentType, tt.header)
+		}
+		// the peeked bytes are still read
+		if data, _ := ioutil.ReadAll(r); !bytes.Equal(data, tt.data) {
+			t.Errorf("%s: got %d bytes back, want %d", tt.name, len(data), len(tt.data))
+		}
+	}
+}
+
+func TestNextFilePart(t *testing.T) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	w.WriteField("folder", "photos")
+	w.WriteField("file", "a field named file")
+	part, _ := w.CreateFormFile("file", "a.png")
+	part.Write([]byte("first"))
+	part, _ = w.CreateFormFile("other", "b.png")
+	part.Write([]byte("other"))
+	part, _ = w.CreateFormFile("file", "c.png")
+	part.Write([]byte("second"))
+	w.Close()
+
+	mr := multipart.NewReader(&body, w.Boundary())
+	for _, want := range []string{"a.png:first", "c.png:second"} {
+		part, err := nextFilePart(mr)
+		if err != nil {
+			t.Fatalf("%s: %v", want, err)
+		}
+		data, _ := ioutil.ReadAll(part)
+		if got := part.FileName() + ":" + string(data); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	if _, err := nextFilePart(mr); err != io.EOF {
+		t.Errorf("got %v, want %v", err, io.EOF)
+	}
+}
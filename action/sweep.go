@@ -0,0 +1,34 @@
+package action
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/siddhartham/imageutil-thumbor/storage"
+)
+
+// sweepInterval is how often the uploads clients abandoned are looked for.
+const sweepInterval = 10 * time.Minute
+
+// StartSweeper cleans up the uploads clients abandoned and the file counts
+// of expired upload tokens, every sweep interval until the returned func is
+// called. Every node sweeps, deleting what another node deleted first is
+// harmless.
+func StartSweeper(db *sql.DB, store storage.Storage) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				sweepStaging(store, now)
+				sweepResumable(db, store)
+				sweepTokenUses(db)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
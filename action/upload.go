@@ -4,19 +4,16 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"mime/multipart"
+	"io"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/gorilla/mux"
 	"github.com/siddhartham/imageutil-thumbor/model"
+	"github.com/siddhartham/imageutil-thumbor/storage"
+	"github.com/siddhartham/imageutil-thumbor/token"
 	"github.com/siddhartham/imageutil-thumbor/util"
 )
 
@@ -24,15 +21,13 @@ const (
 	MB = 1 << 20
 )
 
-type Sizer interface {
-	Size() int64
-}
+var ErrNoMoreFiles = errors.New("Upload token allows no more files")
 
-func UploadHandler(db *sql.DB, res http.ResponseWriter, req *http.Request) {
+func UploadHandler(db *sql.DB, store storage.Storage, sc *model.ServerConf, res http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 
 	util.LogInfo("UploadHandler", vars["uploadToken"])
-	folder, status, err := checkTokenAndGetFolder(db, vars["uploadToken"], vars["fileName"])
+	folder, policy, target, status, err := checkTokenAndGetFolder(db, sc, vars["uploadToken"], vars["fileName"], req.URL.Query().Get("on_conflict"))
 	if err != nil {
 		util.LogError("UploadHandler : checkTokenAndGetFolder", err.Error())
 		res.WriteHeader(status)
@@ -40,57 +35,115 @@ func UploadHandler(db *sql.DB, res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if err := req.ParseMultipartForm(5 * MB); err != nil {
-		util.LogError("UploadHandler : ParseMultipartForm", err.Error())
-		res.WriteHeader(http.StatusBadRequest)
-		res.Write([]byte(err.Error()))
+	// Limit upload size, before anything is read
+	limit := policy.MaxSize
+	if req.ContentLength > limit+multipartOverhead {
+		util.LogError("UploadHandler : ContentLength", ErrTooLarge.Error())
+		res.WriteHeader(http.StatusRequestEntityTooLarge)
+		res.Write([]byte(ErrTooLarge.Error()))
 		return
 	}
+	req.Body = http.MaxBytesReader(res, req.Body, limit+multipartOverhead)
 
-	// Limit upload size
-	req.Body = http.MaxBytesReader(res, req.Body, 10*MB) // 10 Mb
-
-	// Create a buffer to store the header of the file in
-	fileHeader := make([]byte, 512)
-
-	file, multipartFileHeader, err := req.FormFile("file")
+	// Stream the file part, nothing is buffered to memory or disk
+	mr, err := req.MultipartReader()
 	if err != nil {
-		util.LogError("UploadHandler : get file", err.Error())
-		res.WriteHeader(http.StatusBadRequest)
-		res.Write([]byte(err.Error()))
-		return
-	}
-	defer file.Close()
-
-	// Copy the headers into the FileHeader buffer
-	if _, err := file.Read(fileHeader); err != nil {
-		util.LogError("UploadHandler : get file header", err.Error())
+		util.LogError("UploadHandler : MultipartReader", err.Error())
 		res.WriteHeader(http.StatusBadRequest)
 		res.Write([]byte(err.Error()))
 		return
 	}
 
-	path, err := uploadFile(vars["fileName"], file, folder)
+	part, err := nextFilePart(mr)
 	if err != nil {
-		util.LogError("UploadHandler : uploadFile", err.Error())
-		res.WriteHeader(http.StatusInternalServerError)
+		util.LogError("UploadHandler : get file", err.Error())
+		status := http.StatusBadRequest
+		if tooLarge(err) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		res.WriteHeader(status)
 		res.Write([]byte(err.Error()))
 		return
 	}
+	defer part.Close()
 
-	_, err = saveFileToDb(db, &folder, vars["fileName"], path, file.(Sizer).Size(), http.DetectContentType(fileHeader), multipartFileHeader.Filename)
+	_, status, err = storeUpload(db, store, sc, folder, policy, target, part.FileName(), part)
 	if err != nil {
-		util.LogError("UploadHandler : saveFileToDb", err.Error())
-		res.WriteHeader(http.StatusInternalServerError)
+		res.WriteHeader(status)
 		res.Write([]byte(err.Error()))
 		return
 	}
 
+	// the name differs when the upload was renamed
+	res.Header().Set("X-Upload-Name", target.Name)
 	res.WriteHeader(http.StatusOK)
 	res.Write([]byte("Uploaded!"))
 }
 
-func saveFileToDb(db *sql.DB, folder *model.Folder, name string, path string, fileSize int64, mimeType string, originalName string) (model.Folder, error) {
+// storeUpload validates the image read from r against the policy, stores it
+// in storage and adds it to folder, or replaces the file the target names.
+// It returns the status to answer with when it fails.
+func storeUpload(db *sql.DB, store storage.Storage, sc *model.ServerConf, folder model.Folder, policy model.UploadPolicy, target uploadTarget, originalName string, r io.Reader) (model.Folder, int, error) {
+	// Sniff the content type and image header from the first bytes of the file
+	file := &sizeLimitReader{r: r, limit: policy.MaxSize}
+	body, mimeType, header, err := sniff(file)
+	if err != nil {
+		util.LogError("storeUpload : get file header", err.Error())
+		if tooLarge(err) {
+			return model.Folder{}, http.StatusRequestEntityTooLarge, err
+		}
+		return model.Folder{}, http.StatusBadRequest, err
+	}
+
+	// Only accept images the project allows
+	if err := validateImage(header, policy); err != nil {
+		util.LogError("storeUpload : validateImage", err.Error())
+		return model.Folder{}, validationStatus(err), err
+	}
+	if header.Format == "jpeg" && *policy.StripExif {
+		body = newExifStripper(body)
+	}
+
+	if status, err := claimFile(db, policy); err != nil {
+		util.LogError("storeUpload : claimFile", err.Error())
+		return model.Folder{}, status, err
+	}
+
+	// keep the file being replaced as a version
+	if target.Existing != nil && target.Mode == model.ConflictVersion {
+		if err := versionFile(db, store, *target.Existing); err != nil {
+			util.LogError("storeUpload : versionFile", err.Error())
+			releaseFile(db, policy)
+			return model.Folder{}, http.StatusInternalServerError, err
+		}
+	}
+
+	stored := &countingReader{r: body}
+	path, err := uploadFile(store, target.Key, stored, mimeType)
+	if err != nil {
+		util.LogError("storeUpload : uploadFile", err.Error())
+		releaseFile(db, policy)
+		if tooLarge(err) || file.n > policy.MaxSize {
+			return model.Folder{}, http.StatusRequestEntityTooLarge, err
+		}
+		return model.Folder{}, http.StatusInternalServerError, err
+	}
+
+	var saved model.Folder
+	if target.Existing != nil {
+		saved, err = replaceFile(db, store, sc, *target.Existing, stored.n, mimeType, originalName, header)
+	} else {
+		saved, err = saveFileToDb(db, &folder, target.Name, path, stored.n, mimeType, originalName, header)
+	}
+	if err != nil {
+		util.LogError("storeUpload : saveFileToDb", err.Error())
+		releaseFile(db, policy)
+		return model.Folder{}, http.StatusInternalServerError, err
+	}
+	return saved, http.StatusOK, nil
+}
+
+func saveFileToDb(db *sql.DB, folder *model.Folder, name string, path string, fileSize int64, mimeType string, originalName string, header imageHeader) (model.Folder, error) {
 	file := model.Folder{
 		UserID:       folder.UserID,
 		ProjectID:    folder.ProjectID,
@@ -101,85 +154,194 @@ func saveFileToDb(db *sql.DB, folder *model.Folder, name string, path string, fi
 		OriginalName: originalName,
 		MimeType:     mimeType,
 		FileSize:     fileSize,
+		Width:        header.Width,
+		Height:       header.Height,
+		Format:       header.Format,
 	}
 
-	sqlStm := fmt.Sprintf("INSERT INTO folders (id, user_id, project_id, folder_id, is_file, name, path, created_at, updated_at, original_name, mime_type, file_size) VALUES ( NULL, %s, %s, %s, %s, '%s', '%s', NOW(), NOW(), '%s', '%s', %d)", file.UserID, file.ProjectID, file.FolderID, file.IsFile, file.Name, file.Path, file.OriginalName, file.MimeType, file.FileSize)
-	_, err := db.Exec(sqlStm)
+	// file names come from the client, so they are passed as parameters
+	insert, err := db.Exec("INSERT INTO folders (id, user_id, project_id, folder_id, is_file, name, path, created_at, updated_at, original_name, mime_type, file_size, width, height, format) VALUES ( NULL, ?, ?, ?, ?, ?, ?, NOW(), NOW(), ?, ?, ?, ?, ?, ?)",
+		file.UserID, file.ProjectID, file.FolderID, file.IsFile, file.Name, file.Path, file.OriginalName, file.MimeType, file.FileSize, file.Width, file.Height, file.Format)
 	if err != nil {
 		return file, err
 	}
+	id, _ := insert.LastInsertId()
+	file.ID = strconv.FormatInt(id, 10)
 
 	return file, nil
 }
 
-func checkTokenAndGetFolder(db *sql.DB, uploadToken string, fileName string) (model.Folder, int, error) {
-	folder := model.Folder{}
-
+// checkTokenAndGetFolder checks the upload token and decides where fileName
+// is uploaded to, onConflict overriding the conflict policy when set.
+func checkTokenAndGetFolder(db *sql.DB, sc *model.ServerConf, uploadToken string, fileName string, onConflict string) (model.Folder, model.UploadPolicy, uploadTarget, int, error) {
 	if fileName == "" || len(fileName) < 5 {
-		return folder, http.StatusUnauthorized, errors.New("Invalid filename")
+		return model.Folder{}, model.UploadPolicy{}, uploadTarget{}, http.StatusUnauthorized, errors.New("Invalid filename")
+	}
+
+	folder, policy, status, err := checkToken(db, sc, uploadToken)
+	if err != nil {
+		return folder, policy, uploadTarget{}, status, err
 	}
 
+	target, status, err := resolveTarget(db, sc, folder, policy, fileName, onConflict, nil)
+	return folder, policy, target, status, err
+}
+
+// checkToken returns the folder an upload token grants uploads to and the
+// upload policy, narrowed by the token's claims. Signed tokens are verified
+// without a database lookup, legacy ones are matched against the folders
+// table when still accepted.
+func checkToken(db *sql.DB, sc *model.ServerConf, uploadToken string) (model.Folder, model.UploadPolicy, int, error) {
+	if !token.IsSigned(uploadToken) {
+		if !sc.LegacyUploadTokens {
+			return model.Folder{}, model.UploadPolicy{}, http.StatusUnauthorized, errors.New("Invalid upload token")
+		}
+		folder, status, err := checkLegacyToken(db, uploadToken)
+		return folder, uploadPolicy(sc, folder.ProjectID), status, err
+	}
+
+	claims, err := token.Verify(sc.UploadTokenSecret, uploadToken)
+	if err != nil {
+		return model.Folder{}, model.UploadPolicy{}, http.StatusUnauthorized, err
+	}
+	if claims.Scope != token.ScopeUpload || claims.FolderID == "" {
+		return model.Folder{}, model.UploadPolicy{}, http.StatusUnauthorized, errors.New("Invalid upload token")
+	}
+	folder := model.Folder{
+		ID:          claims.FolderID,
+		UserID:      claims.UserID,
+		ProjectID:   claims.ProjectID,
+		Path:        claims.FolderPath,
+		UploadToken: uploadToken,
+	}
+
+	policy := uploadPolicy(sc, folder.ProjectID)
+	if claims.MaxSize > 0 && claims.MaxSize < policy.MaxSize {
+		policy.MaxSize = claims.MaxSize
+	}
+	if len(claims.Types) > 0 {
+		formats := []string{}
+		for _, format := range policy.Formats {
+			for _, allowed := range claims.Types {
+				if strings.TrimSpace(format) == allowed {
+					formats = append(formats, allowed)
+				}
+			}
+		}
+		policy.Formats = formats
+	}
+	if claims.MaxFiles > 0 {
+		// the files uploaded with the token are counted in upload_token_uses
+		_, err := db.Exec("INSERT IGNORE INTO upload_token_uses (jti, uses, max_files, expires_at) VALUES (?, 0, ?, FROM_UNIXTIME(?))", claims.ID, claims.MaxFiles, claims.ExpiresAt)
+		if err != nil {
+			return folder, policy, http.StatusInternalServerError, err
+		}
+		uploaded := int64(0)
+		err = db.QueryRow("SELECT uses FROM upload_token_uses WHERE jti=?", claims.ID).Scan(&uploaded)
+		if err != nil {
+			return folder, policy, http.StatusInternalServerError, err
+		}
+		if uploaded >= claims.MaxFiles {
+			return folder, policy, http.StatusForbidden, ErrNoMoreFiles
+		}
+		policy.MaxFiles = claims.MaxFiles - uploaded
+		policy.TokenID = claims.ID
+	}
+
+	return folder, policy, http.StatusOK, nil
+}
+
+// claimFile counts a file against the max_files of the upload token of
+// policy, at once so concurrent uploads cannot go over it. Tokens without
+// max_files count nothing.
+func claimFile(db *sql.DB, policy model.UploadPolicy) (int, error) {
+	if policy.TokenID == "" {
+		return http.StatusOK, nil
+	}
+	result, err := db.Exec("UPDATE upload_token_uses SET uses=uses+1 WHERE jti=? AND uses < max_files", policy.TokenID)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected != 1 {
+		return http.StatusForbidden, ErrNoMoreFiles
+	}
+	return http.StatusOK, nil
+}
+
+// releaseFile gives back the file claimed for an upload that then failed.
+func releaseFile(db *sql.DB, policy model.UploadPolicy) {
+	if policy.TokenID == "" {
+		return
+	}
+	if _, err := db.Exec("UPDATE upload_token_uses SET uses=uses-1 WHERE jti=? AND uses > 0", policy.TokenID); err != nil {
+		util.LogWarning("releaseFile : UPDATE", err.Error())
+	}
+}
+
+// sweepTokenUses deletes the file counts of the upload tokens expired.
+func sweepTokenUses(db *sql.DB) {
+	if _, err := db.Exec("DELETE FROM upload_token_uses WHERE expires_at < NOW()"); err != nil {
+		util.LogWarning("sweepTokenUses : DELETE", err.Error())
+	}
+}
+
+// checkLegacyToken returns the folder of a user_project_x_expiry token.
+func checkLegacyToken(db *sql.DB, uploadToken string) (model.Folder, int, error) {
+	folder := model.Folder{}
+
 	tokens := strings.Split(uploadToken, "_")
 	if len(tokens) != 4 {
 		return folder, http.StatusUnauthorized, errors.New("Invalid upload token")
 	}
 
-	dateValidity, err := strconv.ParseUint(tokens[3], 10, 32)
+	dateValidity, err := strconv.ParseInt(tokens[3], 10, 64)
 	if err != nil {
 		return folder, http.StatusUnauthorized, err
 	}
-	currentTime := int32(time.Now().Unix())
-	if currentTime > int32(dateValidity) {
-		return folder, http.StatusUnauthorized, errors.New("Upload token is already expired")
+	if time.Now().Unix() > dateValidity {
+		return folder, http.StatusUnauthorized, token.ErrExpired
 	}
 
-	sqlStm := fmt.Sprintf("SELECT id, user_id, project_id, name, path FROM folders where upload_token = '%s' and project_id=%s and user_id=%s", uploadToken, tokens[1], tokens[0])
-	err = db.QueryRow(sqlStm).Scan(&folder.ID, &folder.UserID, &folder.ProjectID, &folder.Name, &folder.Path)
+	err = db.QueryRow("SELECT id, user_id, project_id, name, path FROM folders where upload_token = ? and project_id=? and user_id=?", uploadToken, tokens[1], tokens[0]).Scan(&folder.ID, &folder.UserID, &folder.ProjectID, &folder.Name, &folder.Path)
 	if err != nil {
 		return folder, http.StatusUnauthorized, err
 	}
+	folder.UploadToken = uploadToken
 
+	return folder, http.StatusOK, nil
+}
+
+// fileExists reports whether folder already has a file named fileName.
+func fileExists(db *sql.DB, folder model.Folder, fileName string) bool {
 	file := model.Folder{}
-	sqlStm = fmt.Sprintf("SELECT id FROM folders where project_id=%s and user_id=%s and folder_id=%s and name='%s'", folder.ProjectID, folder.UserID, folder.ID, fileName)
-	err = db.QueryRow(sqlStm).Scan(&file.ID)
-	if err == nil {
-		return folder, http.StatusConflict, errors.New("File with same name already exists in this folder")
-	}
+	err := db.QueryRow("SELECT id FROM folders where project_id=? and user_id=? and folder_id=? and name=?", folder.ProjectID, folder.UserID, folder.ID, fileName).Scan(&file.ID)
+	return err == nil
+}
 
-	return folder, http.StatusOK, nil
+// keyTaken reports whether a file of the folder's project is stored at key.
+// Renamed and moved files keep the key they were uploaded to.
+func keyTaken(db *sql.DB, folder model.Folder, key string) bool {
+	id := ""
+	err := db.QueryRow("SELECT id FROM folders WHERE project_id=? AND is_file=1 AND path=?", folder.ProjectID, key).Scan(&id)
+	return err == nil
 }
 
-func uploadFile(fileName string, f multipart.File, folder model.Folder) (string, error) {
-	endpoint := os.Getenv("MEDIAENDPOINT")
-	region := os.Getenv("MEDIAREGION")
-	spaceKey := os.Getenv("SPACEKEY")
-	spaceSecret := os.Getenv("SPACESECRET")
-	doBucket := os.Getenv("BUCKETNAME")
-	storageFolder := os.Getenv("MEDIASTORAGE")
-
-	destPath := fmt.Sprintf("%s/%s/%s", storageFolder, folder.Path, fileName)
-
-	sess := session.Must(session.NewSession(&aws.Config{
-		Endpoint: &endpoint,
-		Region:   &region,
-		Credentials: credentials.NewStaticCredentialsFromCreds(credentials.Value{
-			AccessKeyID:     spaceKey,
-			SecretAccessKey: spaceSecret,
-		}),
-	}))
-
-	// Create an uploader with the session and default options
-	uploader := s3manager.NewUploader(sess)
-
-	// Upload the file to do
-	result, err := uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(doBucket),
-		Key:    aws.String(destPath),
-		Body:   f,
-	})
-	if err != nil {
-		return "", fmt.Errorf("failed to upload file, %v", err)
+func uploadFile(store storage.Storage, destPath string, f io.Reader, mimeType string) (string, error) {
+	if err := store.Put(destPath, f, mimeType); err != nil {
+		return "", fmt.Errorf("failed to upload file, %w", err)
 	}
-	util.LogInfo("UploadHandler : ", aws.StringValue(&result.Location))
+	util.LogInfo("UploadHandler : ", destPath)
 	return destPath, nil
 }
+
+// mediaKey returns the storage key of a file uploaded to folder.
+func mediaKey(sc *model.ServerConf, folder model.Folder, fileName string) string {
+	return fmt.Sprintf("%s/%s/%s", sc.MediaStorage, folder.Path, fileName)
+}
+
+// uploadError logs the failed step and answers with err.
+func uploadError(res http.ResponseWriter, step string, status int, err error) {
+	util.LogError(step, err.Error())
+	res.WriteHeader(status)
+	res.Write([]byte(err.Error()))
+}
@@ -0,0 +1,75 @@
+package action
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"github.com/siddhartham/imageutil-thumbor/model"
+	_ "golang.org/x/image/webp"
+)
+
+// headerPeekSize is how much of an upload is looked at to decode the image
+// header, enough for jpegs carrying large EXIF or ICC segments first.
+const headerPeekSize = 128 << 10
+
+// imageHeader is what the header of an uploaded image tells about it.
+type imageHeader struct {
+	Width  int64
+	Height int64
+	Format string
+}
+
+// validationError is an upload rejected for its content, with the status
+// to answer with.
+type validationError struct {
+	status int
+	msg    string
+}
+
+func (e *validationError) Error() string {
+	return e.msg
+}
+
+// validateImage checks the decoded image header against the upload policy:
+// the format must be allowed and the dimensions within bounds. The pixel
+// count limit rejects decompression bombs, small files that decode to huge
+// images, before anything is stored.
+func validateImage(header imageHeader, policy model.UploadPolicy) error {
+	if header.Format == "" {
+		return &validationError{http.StatusUnsupportedMediaType, "File is not a supported image"}
+	}
+
+	allowed := false
+	for _, format := range policy.Formats {
+		if strings.TrimSpace(format) == header.Format {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return &validationError{http.StatusUnsupportedMediaType, fmt.Sprintf("Image format %s is not allowed, expected one of %s", header.Format, strings.Join(policy.Formats, ", "))}
+	}
+
+	if header.Width > policy.MaxWidth || header.Height > policy.MaxHeight {
+		return &validationError{http.StatusUnprocessableEntity, fmt.Sprintf("Image is %dx%d, the maximum is %dx%d", header.Width, header.Height, policy.MaxWidth, policy.MaxHeight)}
+	}
+	if header.Width*header.Height > policy.MaxPixels {
+		return &validationError{http.StatusUnprocessableEntity, fmt.Sprintf("Image has %d pixels, the maximum is %d", header.Width*header.Height, policy.MaxPixels)}
+	}
+
+	return nil
+}
+
+// validationStatus returns the status to answer a rejected upload with.
+func validationStatus(err error) int {
+	var verr *validationError
+	if errors.As(err, &verr) {
+		return verr.status
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,65 @@
+package action
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/siddhartham/imageutil-thumbor/model"
+)
+
+func TestValidateImage(t *testing.T) {
+	policy := model.UploadPolicy{
+		Formats:   []string{"jpeg", " png"},
+		MaxWidth:  1000,
+		MaxHeight: 800,
+		MaxPixels: 500000,
+	}
+	tests := []struct {
+		name   string
+		header imageHeader
+		status int
+	}{
+		{"allowed", imageHeader{Width: 600, Height: 800, Format: "jpeg"}, 0},
+		{"format listed with spaces", imageHeader{Width: 10, Height: 10, Format: "png"}, 0},
+		{"not an image", imageHeader{}, http.StatusUnsupportedMediaType},
+		{"format not allowed", imageHeader{Width: 10, Height: 10, Format: "gif"}, http.StatusUnsupportedMediaType},
+		{"too wide", imageHeader{Width: 1001, Height: 10, Format: "jpeg"}, http.StatusUnprocessableEntity},
+		{"too high", imageHeader{Width: 10, Height: 801, Format: "jpeg"}, http.StatusUnprocessableEntity},
+		// within both bounds, but decoding to too many pixels
+		{"too many pixels", imageHeader{Width: 1000, Height: 600, Format: "jpeg"}, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		err := validateImage(tt.header, policy)
+		if tt.status == 0 {
+			if err != nil {
+				t.Errorf("%s: got %v, want no error", tt.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: got no error, want %d", tt.name, tt.status)
+			continue
+		}
+		if got := validationStatus(err); got != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.name, got, tt.status)
+		}
+	}
+}
+
+func TestValidationStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"validation", &validationError{http.StatusUnprocessableEntity, "too large"}, http.StatusUnprocessableEntity},
+		{"wrapped", fmt.Errorf("file: %w", &validationError{http.StatusUnsupportedMediaType, "not an image"}), http.StatusUnsupportedMediaType},
+		{"other", ErrTooLarge, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if got := validationStatus(tt.err); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
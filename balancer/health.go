@@ -0,0 +1,48 @@
+package balancer
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/siddhartham/imageutil-thumbor/util"
+)
+
+// HealthCheck polls path on every upstream each interval and takes the ones
+// not answering 200 out of rotation until they recover. It blocks until the
+// pool is stopped, so run it in a goroutine.
+func (p *Pool) HealthCheck(path string, interval time.Duration) {
+	client := &http.Client{Timeout: interval}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, upstream := range p.upstreams {
+			p.check(client, upstream, path)
+		}
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Pool) check(client *http.Client, upstream *Upstream, path string) {
+	healthy := false
+	resp, err := client.Get(fmt.Sprintf("http://%s%s", upstream.Host, path))
+	if err == nil {
+		resp.Body.Close()
+		healthy = resp.StatusCode == http.StatusOK
+	}
+
+	upstream.mu.Lock()
+	changed := upstream.healthy != healthy
+	upstream.healthy = healthy
+	upstream.mu.Unlock()
+
+	if changed && healthy {
+		util.LogSuccess("Pool : HealthCheck", fmt.Sprintf("%s is back up", upstream.Host))
+	} else if changed {
+		util.LogError("Pool : HealthCheck", fmt.Sprintf("%s is down", upstream.Host))
+	}
+}
@@ -0,0 +1,219 @@
+package balancer
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/siddhartham/imageutil-thumbor/util"
+)
+
+const (
+	LeastConn = "least-conn"
+	Hash      = "hash"
+
+	// virtual nodes per upstream on the consistent hash ring
+	replicas = 100
+)
+
+var ErrNoUpstream = errors.New("No healthy upstream available")
+
+// Upstream is one renderer instance of a pool.
+type Upstream struct {
+	Host string
+
+	active    int64
+	mu        sync.Mutex
+	healthy   bool
+	failures  int
+	openUntil time.Time
+}
+
+// available reports whether the upstream is healthy and its circuit is not
+// open. Once the cool down has passed the circuit is half open and the
+// upstream gets traffic again until it fails.
+func (u *Upstream) available(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.healthy && !now.Before(u.openUntil)
+}
+
+func (u *Upstream) success() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failures = 0
+	u.openUntil = time.Time{}
+}
+
+func (u *Upstream) failure(threshold int, coolDown time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failures++
+	if u.failures >= threshold {
+		u.openUntil = time.Now().Add(coolDown)
+		util.LogWarning("Upstream : circuit open", fmt.Sprintf("%s failed %d times", u.Host, u.failures))
+	}
+}
+
+// Pool balances requests across renderer upstreams. It is an
+// http.RoundTripper, so the proxy uses it as the transport for renderer
+// requests and the pool picks the upstream host.
+//
+// Idempotent requests that fail with a connection error or a 502/503/504
+// are retried on another upstream. An upstream failing FailureThreshold
+// times in a row is taken out of rotation for CoolDown.
+type Pool struct {
+	Strategy         string
+	Transport        http.RoundTripper
+	MaxRetries       int
+	FailureThreshold int
+	CoolDown         time.Duration
+
+	upstreams []*Upstream
+	ring      []uint32
+	ringHosts map[uint32]*Upstream
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+func NewPool(hosts []string, strategy string) (*Pool, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New("Pool needs at least one upstream")
+	}
+	if strategy == "" {
+		strategy = LeastConn
+	}
+	if strategy != LeastConn && strategy != Hash {
+		return nil, fmt.Errorf("Unknown balancing strategy %q", strategy)
+	}
+
+	p := &Pool{
+		Strategy: strategy,
+		Transport: &http.Transport{
+			Dial: (&net.Dialer{
+				Timeout: 5 * time.Second,
+			}).Dial,
+		},
+		MaxRetries:       len(hosts) - 1,
+		FailureThreshold: 3,
+		CoolDown:         10 * time.Second,
+		ringHosts:        map[uint32]*Upstream{},
+		stop:             make(chan struct{}),
+	}
+	for _, host := range hosts {
+		upstream := &Upstream{Host: host, healthy: true}
+		p.upstreams = append(p.upstreams, upstream)
+		for i := 0; i < replicas; i++ {
+			key := crc32.ChecksumIEEE([]byte(host + "#" + strconv.Itoa(i)))
+			p.ring = append(p.ring, key)
+			p.ringHosts[key] = upstream
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool { return p.ring[i] < p.ring[j] })
+
+	return p, nil
+}
+
+// Upstreams returns the upstreams of the pool.
+func (p *Pool) Upstreams() []*Upstream {
+	return p.upstreams
+}
+
+// Stop stops the health checks of the pool.
+func (p *Pool) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+}
+
+func (p *Pool) RoundTrip(req *http.Request) (*http.Response, error) {
+	retries := 0
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		retries = p.MaxRetries
+	}
+
+	tried := map[*Upstream]bool{}
+	var resp *http.Response
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		upstream := p.pick(req.URL.Path, tried)
+		if upstream == nil {
+			if err == nil {
+				err = ErrNoUpstream
+			}
+			break
+		}
+		tried[upstream] = true
+
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		outreq := req.Clone(req.Context())
+		outreq.URL.Host = upstream.Host
+
+		atomic.AddInt64(&upstream.active, 1)
+		resp, err = p.Transport.RoundTrip(outreq)
+		atomic.AddInt64(&upstream.active, -1)
+
+		if err == nil && !retryable(resp.StatusCode) {
+			upstream.success()
+			return resp, nil
+		}
+
+		upstream.failure(p.FailureThreshold, p.CoolDown)
+		if err != nil {
+			util.LogWarning("Pool : RoundTrip : "+upstream.Host, err.Error())
+		} else {
+			util.LogWarning("Pool : RoundTrip : "+upstream.Host, resp.Status)
+		}
+	}
+
+	if resp != nil {
+		return resp, nil
+	}
+	return nil, err
+}
+
+func retryable(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// pick returns the upstream for key, skipping the ones already tried and the
+// ones that are unhealthy or have an open circuit.
+func (p *Pool) pick(key string, tried map[*Upstream]bool) *Upstream {
+	now := time.Now()
+	usable := func(u *Upstream) bool {
+		return !tried[u] && u.available(now)
+	}
+
+	if p.Strategy == Hash {
+		hash := crc32.ChecksumIEEE([]byte(key))
+		start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i] >= hash })
+		for i := 0; i < len(p.ring); i++ {
+			upstream := p.ringHosts[p.ring[(start+i)%len(p.ring)]]
+			if usable(upstream) {
+				return upstream
+			}
+		}
+		return nil
+	}
+
+	var best *Upstream
+	for _, upstream := range p.upstreams {
+		if !usable(upstream) {
+			continue
+		}
+		if best == nil || atomic.LoadInt64(&upstream.active) < atomic.LoadInt64(&best.active) {
+			best = upstream
+		}
+	}
+	return best
+}
@@ -0,0 +1,324 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/siddhartham/imageutil-thumbor/util"
+)
+
+// sweepInterval is how often expired entries are looked for, on Put.
+const sweepInterval = time.Minute
+
+// Entry describes a cached rendered image.
+type Entry struct {
+	Key         string
+	ContentType string
+	// ImageID is the images row the entry was rendered for, when known.
+	ImageID string
+	ETag    string
+	Size    int64
+	ModTime time.Time
+	Expires time.Time
+
+	data []byte
+	path string
+}
+
+// Reader reads a cached entry. It can seek, to serve Range requests.
+type Reader interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// Cache keeps rendered images on the node, in memory and on disk, each tier
+// bounded in size and evicting the least recently used entries first.
+// Entries expire after the max age given to Put. The disk tier is emptied
+// on start, as its index is only kept in memory.
+type Cache struct {
+	mu       sync.Mutex
+	memory   *tier
+	disk     *tier
+	dir      string
+	maxEntry int64
+	swept    time.Time
+}
+
+// New returns a cache keeping up to memorySize bytes in memory and
+// diskSize bytes under dir, with no entry larger than maxEntry. A tier of
+// size 0, or an empty dir, is disabled.
+func New(memorySize int64, dir string, diskSize int64, maxEntry int64) (*Cache, error) {
+	c := &Cache{maxEntry: maxEntry}
+	if memorySize > 0 {
+		c.memory = newTier(memorySize)
+	}
+	if dir != "" && diskSize > 0 {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		if err := clearDir(dir); err != nil {
+			return nil, err
+		}
+		c.dir = dir
+		c.disk = newTier(diskSize)
+		c.disk.onEvict = func(e *Entry) {
+			if err := os.Remove(e.path); err != nil && !os.IsNotExist(err) {
+				util.LogWarning("Cache : evict", err.Error())
+			}
+		}
+	}
+	return c, nil
+}
+
+// Get returns a reader of the entry cached at key. Entries read from disk
+// that fit the memory tier are moved up to it. Files are read without the
+// lock, so disk reads do not hold up the other lookups.
+func (c *Cache) Get(key string) (Reader, *Entry, bool) {
+	c.mu.Lock()
+	now := time.Now()
+	if e, ok := c.memory.get(key, now); ok {
+		c.mu.Unlock()
+		return nopCloser{bytes.NewReader(e.data)}, e, true
+	}
+	e, ok := c.disk.get(key, now)
+	if !ok {
+		c.mu.Unlock()
+		return nil, nil, false
+	}
+	found := *e
+	c.mu.Unlock()
+
+	if c.memory != nil && found.Size <= c.memory.max/16 {
+		data, err := ioutil.ReadFile(found.path)
+		if err == nil {
+			hot := found
+			hot.data, hot.path = data, ""
+			c.mu.Lock()
+			// unless it was dropped or replaced while being read
+			if c.onDisk(key, found.path) {
+				c.memory.add(&hot)
+			}
+			c.mu.Unlock()
+			return nopCloser{bytes.NewReader(data)}, &hot, true
+		}
+	}
+	f, err := os.Open(found.path)
+	if err != nil {
+		// evicted while being read is a miss too
+		if !os.IsNotExist(err) {
+			util.LogWarning("Cache : Get", err.Error())
+		}
+		c.mu.Lock()
+		if c.onDisk(key, found.path) {
+			c.disk.remove(key)
+		}
+		c.mu.Unlock()
+		return nil, nil, false
+	}
+	return f, &found, true
+}
+
+// onDisk reports whether the disk entry at key is still the one written to
+// path. The lock must be held.
+func (c *Cache) onDisk(key string, path string) bool {
+	if c.disk == nil {
+		return false
+	}
+	el, ok := c.disk.items[key]
+	return ok && el.Value.(*Entry).path == path
+}
+
+// Put caches data for maxAge, described by entry, at entry.Key. Entries
+// larger than the max entry size are not kept.
+func (c *Cache) Put(entry Entry, data []byte, maxAge time.Duration) {
+	size := int64(len(data))
+	if maxAge <= 0 || size == 0 || (c.maxEntry > 0 && size > c.maxEntry) {
+		return
+	}
+	now := time.Now()
+	e := &entry
+	e.Size, e.Expires, e.data = size, now.Add(maxAge), nil
+	if e.ModTime.IsZero() {
+		e.ModTime = now
+	}
+	key := e.Key
+
+	// written before taking the lock, a reader of the previous entry at key
+	// keeps its open file
+	if c.disk != nil {
+		e.path = c.path(key, now)
+		if err := writeFile(e.path, data); err != nil {
+			util.LogWarning("Cache : Put", err.Error())
+			e.path = ""
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.swept) >= sweepInterval {
+		c.memory.sweep(now)
+		c.disk.sweep(now)
+		c.swept = now
+	}
+	if c.memory != nil && size <= c.memory.max/16 {
+		hot := *e
+		hot.data, hot.path = data, ""
+		c.memory.add(&hot)
+	}
+	if e.path != "" {
+		c.disk.add(e)
+	}
+}
+
+// DeletePrefix drops the entries whose key starts with prefix.
+func (c *Cache) DeletePrefix(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.memory.removePrefix(prefix)
+	c.disk.removePrefix(prefix)
+}
+
+// path returns where the entry for key put at now is written, under a
+// directory named after the first byte of its hash to keep them small.
+func (c *Cache) path(key string, now time.Time) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(c.dir, name[:2], name+"-"+now.Format("150405.000000000"))
+}
+
+// clearDir removes the entries a previous run left in dir, leaving
+// anything else there alone.
+func clearDir(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if _, err := hex.DecodeString(f.Name()); err != nil || !f.IsDir() || len(f.Name()) != 2 {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, f.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
+
+// tier is a size bounded LRU of entries. A nil tier is empty and keeps
+// nothing.
+type tier struct {
+	max     int64
+	size    int64
+	ll      *list.List
+	items   map[string]*list.Element
+	onEvict func(*Entry)
+}
+
+func newTier(max int64) *tier {
+	return &tier{max: max, ll: list.New(), items: map[string]*list.Element{}}
+}
+
+func (t *tier) get(key string, now time.Time) (*Entry, bool) {
+	if t == nil {
+		return nil, false
+	}
+	el, ok := t.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*Entry)
+	if !now.Before(e.Expires) {
+		t.removeElement(el)
+		return nil, false
+	}
+	t.ll.MoveToFront(el)
+	return e, true
+}
+
+func (t *tier) add(e *Entry) {
+	if t == nil {
+		return
+	}
+	if e.Size > t.max {
+		if t.onEvict != nil {
+			t.onEvict(e)
+		}
+		return
+	}
+	if el, ok := t.items[e.Key]; ok {
+		t.removeElement(el)
+	}
+	t.items[e.Key] = t.ll.PushFront(e)
+	t.size += e.Size
+	for t.size > t.max {
+		t.removeElement(t.ll.Back())
+	}
+}
+
+func (t *tier) remove(key string) {
+	if t == nil {
+		return
+	}
+	if el, ok := t.items[key]; ok {
+		t.removeElement(el)
+	}
+}
+
+func (t *tier) removePrefix(prefix string) {
+	if t == nil {
+		return
+	}
+	for key, el := range t.items {
+		if strings.HasPrefix(key, prefix) {
+			t.removeElement(el)
+		}
+	}
+}
+
+// sweep drops the expired entries.
+func (t *tier) sweep(now time.Time) {
+	if t == nil {
+		return
+	}
+	for _, el := range t.items {
+		if !now.Before(el.Value.(*Entry).Expires) {
+			t.removeElement(el)
+		}
+	}
+}
+
+func (t *tier) removeElement(el *list.Element) {
+	e := t.ll.Remove(el).(*Entry)
+	delete(t.items, e.Key)
+	t.size -= e.Size
+	if t.onEvict != nil {
+		t.onEvict(e)
+	}
+}
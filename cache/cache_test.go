@@ -0,0 +1,247 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTier(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(time.Hour)
+	tests := []struct {
+		name string
+		ops  func(t *tier)
+		keys string
+		size int64
+	}{
+		{"fits", func(t *tier) {
+			t.add(&Entry{Key: "a", Size: 10, Expires: expires})
+			t.add(&Entry{Key: "b", Size: 20, Expires: expires})
+		}, "ba", 30},
+		{"least recent evicted", func(t *tier) {
+			t.add(&Entry{Key: "a", Size: 10, Expires: expires})
+			t.add(&Entry{Key: "b", Size: 10, Expires: expires})
+			t.add(&Entry{Key: "c", Size: 10, Expires: expires})
+			t.add(&Entry{Key: "d", Size: 10, Expires: expires})
+		}, "dcb", 30},
+		{"read entries kept", func(t *tier) {
+			t.add(&Entry{Key: "a", Size: 10, Expires: expires})
+			t.add(&Entry{Key: "b", Size: 10, Expires: expires})
+			t.add(&Entry{Key: "c", Size: 10, Expires: expires})
+			t.get("a", now)
+			t.add(&Entry{Key: "d", Size: 10, Expires: expires})
+		}, "dac", 30},
+		{"replaced", func(t *tier) {
+			t.add(&Entry{Key: "a", Size: 10, Expires: expires})
+			t.add(&Entry{Key: "b", Size: 10, Expires: expires})
+			t.add(&Entry{Key: "a", Size: 15, Expires: expires})
+		}, "ab", 25},
+		{"too large", func(t *tier) {
+			t.add(&Entry{Key: "a", Size: 10, Expires: expires})
+			t.add(&Entry{Key: "b", Size: 31, Expires: expires})
+		}, "a", 10},
+		{"several evicted", func(t *tier) {
+			t.add(&Entry{Key: "a", Size: 10, Expires: expires})
+			t.add(&Entry{Key: "b", Size: 10, Expires: expires})
+			t.add(&Entry{Key: "c", Size: 25, Expires: expires})
+		}, "c", 25},
+		{"expired on get", func(t *tier) {
+			t.add(&Entry{Key: "a", Size: 10, Expires: now})
+			t.add(&Entry{Key: "b", Size: 10, Expires: expires})
+			t.get("a", now)
+		}, "b", 10},
+		{"expired swept", func(t *tier) {
+			t.add(&Entry{Key: "a", Size: 10, Expires: now.Add(time.Minute)})
+			t.add(&Entry{Key: "b", Size: 10, Expires: expires})
+			t.add(&Entry{Key: "c", Size: 10, Expires: now})
+			t.sweep(now.Add(time.Minute))
+		}, "b", 10},
+		{"prefix removed", func(t *tier) {
+			t.add(&Entry{Key: "x/a", Size: 10, Expires: expires})
+			t.add(&Entry{Key: "y/b", Size: 10, Expires: expires})
+			t.add(&Entry{Key: "x/c", Size: 10, Expires: expires})
+			t.removePrefix("x/")
+		}, "y/b", 10},
+	}
+	for _, tt := range tests {
+		tr := newTier(30)
+		tt.ops(tr)
+
+		keys := ""
+		for el := tr.ll.Front(); el != nil; el = el.Next() {
+			keys += el.Value.(*Entry).Key
+		}
+		if keys != tt.keys || tr.size != tt.size || len(tr.items) != tr.ll.Len() {
+			t.Errorf("%s: got %q of %d bytes, want %q of %d", tt.name, keys, tr.size, tt.keys, tt.size)
+		}
+	}
+}
+
+func TestNilTier(t *testing.T) {
+	var tr *tier
+	tr.add(&Entry{Key: "a", Size: 1})
+	tr.remove("a")
+	tr.removePrefix("")
+	tr.sweep(time.Now())
+	if _, ok := tr.get("a", time.Now()); ok {
+		t.Error("a nil tier kept an entry")
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	c, err := New(1600, "", 0, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("0123456789abcdefghij")
+	c.Put(Entry{Key: "a", ContentType: "image/webp", ETag: `"a"`}, data, time.Hour)
+	c.Put(Entry{Key: "too-large"}, make([]byte, 51), time.Hour)
+	c.Put(Entry{Key: "not-for-memory"}, make([]byte, 101), time.Hour)
+	c.Put(Entry{Key: "no-max-age"}, data, 0)
+	c.Put(Entry{Key: "expired"}, data, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	r, e, ok := c.Get("a")
+	if !ok {
+		t.Fatal("a was not cached")
+	}
+	defer r.Close()
+	if e.Size != int64(len(data)) || e.ContentType != "image/webp" || e.ETag != `"a"` || e.ModTime.IsZero() {
+		t.Errorf("got entry %+v", e)
+	}
+	if got := readRange(t, r, 10, 5); got != "abcde" {
+		t.Errorf("got range %q, want %q", got, "abcde")
+	}
+
+	for _, key := range []string{"too-large", "not-for-memory", "no-max-age", "expired", "missing"} {
+		if _, _, ok := c.Get(key); ok {
+			t.Errorf("%s: got a hit, want a miss", key)
+		}
+	}
+
+	c.DeletePrefix("a")
+	if _, _, ok := c.Get("a"); ok {
+		t.Error("a was not deleted")
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	c, err := New(0, dir, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("0123456789"), 4)
+	c.Put(Entry{Key: "a"}, data, time.Hour)
+	c.Put(Entry{Key: "b"}, data, time.Hour)
+	pathA := c.disk.items["a"].Value.(*Entry).path
+	if _, err := os.Stat(pathA); err != nil {
+		t.Fatal(err)
+	}
+
+	r, e, ok := c.Get("b")
+	if !ok {
+		t.Fatal("b was not cached")
+	}
+	if _, isFile := r.(*os.File); !isFile || e.Size != 40 {
+		t.Errorf("got %T of %d bytes, want a file of 40", r, e.Size)
+	}
+	if got := readRange(t, r, 35, 10); got != "56789" {
+		t.Errorf("got range %q, want %q", got, "56789")
+	}
+	r.Close()
+
+	// a was used least recently, its file goes with it
+	c.Put(Entry{Key: "c"}, data, time.Hour)
+	if _, _, ok := c.Get("a"); ok {
+		t.Error("a was not evicted")
+	}
+	if _, err := os.Stat(pathA); !os.IsNotExist(err) {
+		t.Errorf("got %v, want the file of a removed", err)
+	}
+
+	pathB := c.disk.items["b"].Value.(*Entry).path
+	c.DeletePrefix("b")
+	if _, err := os.Stat(pathB); !os.IsNotExist(err) {
+		t.Errorf("got %v, want the file of b removed", err)
+	}
+
+	// a file removed under the cache is a miss
+	os.Remove(c.disk.items["c"].Value.(*Entry).path)
+	if _, _, ok := c.Get("c"); ok {
+		t.Error("c was found without its file")
+	}
+	if _, ok := c.disk.items["c"]; ok {
+		t.Error("c was not dropped")
+	}
+}
+
+func TestDiskEntriesMovedToMemory(t *testing.T) {
+	c, err := New(160, t.TempDir(), 1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Put(Entry{Key: "a"}, []byte("0123456789"), time.Hour)
+	c.memory.remove("a")
+
+	r, _, ok := c.Get("a")
+	if !ok {
+		t.Fatal("a was not cached")
+	}
+	if _, isFile := r.(*os.File); isFile {
+		t.Error("a was read from its file, want it from memory")
+	}
+	r.Close()
+	if _, ok := c.memory.items["a"]; !ok {
+		t.Error("a was not moved to memory")
+	}
+}
+
+func TestNewClearsDir(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"ab/0123-1", "zz/keep", "keep.txt", "a0"} {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := New(0, dir, 100, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		kept bool
+	}{
+		{"ab", false},
+		{"zz/keep", true},
+		{"keep.txt", true},
+		// a file, not an entry directory
+		{"a0", true},
+	}
+	for _, tt := range tests {
+		_, err := os.Stat(filepath.Join(dir, tt.name))
+		if kept := err == nil; kept != tt.kept {
+			t.Errorf("%s: got kept %t, want %t", tt.name, kept, tt.kept)
+		}
+	}
+}
+
+// readRange reads up to n bytes of r from offset.
+func readRange(t *testing.T, r Reader, offset int64, n int64) string {
+	t.Helper()
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,455 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/siddhartham/imageutil-thumbor/balancer"
+	"github.com/siddhartham/imageutil-thumbor/model"
+	"github.com/siddhartham/imageutil-thumbor/renderer"
+	"github.com/siddhartham/imageutil-thumbor/storage"
+	"gopkg.in/yaml.v2"
+)
+
+const redacted = "********"
+
+// Defaults returns the configuration used for settings given nowhere else.
+func Defaults() *model.ServerConf {
+	return &model.ServerConf{
+		Port:            ":9000",
+		GracefulTimeout: 15 * time.Second,
+		Renderer:        renderer.Thumbor,
+		Balancer:        balancer.LeastConn,
+		Storage:         storage.S3,
+		MaxUploadSize:   10 << 20,
+		UploadFormats:   "jpeg,png,gif,webp",
+		MaxUploadWidth:  10000,
+		MaxUploadHeight: 10000,
+		MaxUploadPixels: 50000000,
+		UploadConflict:  model.ConflictReject,
+		UploadTimeout:   10 * time.Minute,
+		CacheDiskSize:   1 << 30,
+		CacheMaxEntry:   5 << 20,
+		CacheMaxAge:     time.Hour,
+		MaxAge:          24 * time.Hour,
+		Widths:          "320,480,640,768,1024,1280,1536,1920,2560",
+		Routes: []model.Route{
+			{Path: "/{project_id}/media/{transformation}/smart/{image:.*}", Source: model.SourceMedia, Smart: true},
+			{Path: "/{project_id}/media/{transformation}/{image:.*}", Source: model.SourceMedia},
+			{Path: "/{project_id}/{transformation}/smart/{image:.*}", Source: model.SourceOrigin, Smart: true},
+			{Path: "/{project_id}/{transformation}/{image:.*}", Source: model.SourceOrigin},
+		},
+	}
+}
+
+// Load builds the server configuration. Settings are taken from, in order of
+// precedence, the command line flags, the environment (including a .env file
+// in the working directory), the YAML file given with -config or $CONFIG and
+// finally the defaults.
+func Load(args []string) (*model.ServerConf, error) {
+	sc := Defaults()
+
+	fs := flag.NewFlagSet("imageutil", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG"), "path to a YAML config file ($CONFIG)")
+	flags := map[string]*fieldFlag{}
+	eachField(sc, func(field reflect.StructField, value reflect.Value) {
+		name := field.Tag.Get("flag")
+		flags[name] = &fieldFlag{isBool: value.Kind() == reflect.Bool}
+		fs.Var(flags[name], name, fmt.Sprintf("overrides %s in the config file and $%s", field.Tag.Get("yaml"), field.Tag.Get("env")))
+	})
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("Unexpected arguments %v", fs.Args())
+	}
+
+	// config file
+	if *configFile != "" {
+		data, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(data, sc); err != nil {
+			return nil, fmt.Errorf("Invalid config file %s : %s", *configFile, err.Error())
+		}
+	}
+
+	// environment, the real one wins over .env
+	dotenv, err := godotenv.Read()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Invalid .env file : %s", err.Error())
+	}
+	err = nil
+	eachField(sc, func(field reflect.StructField, value reflect.Value) {
+		env := os.Getenv(field.Tag.Get("env"))
+		if env == "" {
+			env = dotenv[field.Tag.Get("env")]
+		}
+		if env != "" && err == nil {
+			if setErr := setValue(value, env); setErr != nil {
+				err = fmt.Errorf("Invalid $%s : %s", field.Tag.Get("env"), setErr.Error())
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// flags
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "config" || err != nil {
+			return
+		}
+		eachField(sc, func(field reflect.StructField, value reflect.Value) {
+			if field.Tag.Get("flag") == f.Name {
+				if setErr := setValue(value, flags[f.Name].value); setErr != nil {
+					err = fmt.Errorf("Invalid -%s : %s", f.Name, setErr.Error())
+				}
+			}
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sc, nil
+}
+
+// fieldFlag keeps the value of the flag of a setting, set on the setting
+// once the config file and environment are read. The flags of bool
+// settings need no value, -strip-exif is -strip-exif=true.
+type fieldFlag struct {
+	value  string
+	isBool bool
+}
+
+func (f *fieldFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.value
+}
+
+func (f *fieldFlag) Set(value string) error {
+	f.value = value
+	return nil
+}
+
+func (f *fieldFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// Validate checks that the required settings are present and consistent,
+// reporting every problem at once.
+func Validate(sc *model.ServerConf) error {
+	problems := []string{}
+
+	eachField(sc, func(field reflect.StructField, value reflect.Value) {
+		if field.Tag.Get("required") == "true" && value.IsZero() {
+			problems = append(problems, missing(field))
+		}
+	})
+
+	requireField := func(name string, neededBy string) {
+		field, _ := reflect.TypeOf(*sc).FieldByName(name)
+		if reflect.ValueOf(*sc).FieldByName(name).IsZero() {
+			problems = append(problems, fmt.Sprintf("%s (needed by the %s)", missing(field), neededBy))
+		}
+	}
+	switch sc.Renderer {
+	case renderer.Thumbor, renderer.Imgproxy, renderer.Local:
+	default:
+		problems = append(problems, fmt.Sprintf("renderer must be one of %s, %s or %s, got %q", renderer.Thumbor, renderer.Imgproxy, renderer.Local, sc.Renderer))
+	}
+	for _, rendererName := range Renderers(sc) {
+		switch rendererName {
+		case renderer.Thumbor:
+			requireField("ThumborSecret", "thumbor renderer")
+			if sc.ThumborHost == "" && sc.ThumborHosts == "" {
+				requireField("ThumborHosts", "thumbor renderer")
+			}
+		case renderer.Imgproxy:
+			requireField("ImgproxyHost", "imgproxy renderer")
+		}
+	}
+
+	switch sc.Storage {
+	case storage.S3:
+		requireField("BucketName", "s3 storage")
+		requireField("MediaEndpoint", "s3 storage")
+	case storage.Filesystem:
+		requireField("StoragePath", "fs storage")
+	case storage.Memory:
+	default:
+		problems = append(problems, fmt.Sprintf("storage must be one of %s, %s or %s, got %q", storage.S3, storage.Filesystem, storage.Memory, sc.Storage))
+	}
+
+	if sc.Balancer != balancer.LeastConn && sc.Balancer != balancer.Hash {
+		problems = append(problems, fmt.Sprintf("balancer must be %s or %s, got %q", balancer.LeastConn, balancer.Hash, sc.Balancer))
+	}
+	if !strings.HasPrefix(sc.Port, ":") {
+		problems = append(problems, fmt.Sprintf("port must look like :9000, got %q", sc.Port))
+	}
+
+	for _, name := range []string{"MaxUploadSize", "MaxUploadWidth", "MaxUploadHeight", "MaxUploadPixels"} {
+		field, _ := reflect.TypeOf(*sc).FieldByName(name)
+		if reflect.ValueOf(*sc).FieldByName(name).Int() <= 0 {
+			problems = append(problems, fmt.Sprintf("%s must be positive", field.Tag.Get("yaml")))
+		}
+	}
+	if strings.TrimSpace(sc.UploadFormats) == "" {
+		problems = append(problems, "upload_formats must list at least one format")
+	}
+	if !ValidConflict(sc.UploadConflict) {
+		problems = append(problems, fmt.Sprintf("upload_conflict must be one of %s, %s, %s or %s, got %q", model.ConflictReject, model.ConflictOverwrite, model.ConflictRename, model.ConflictVersion, sc.UploadConflict))
+	}
+	for projectID, policy := range sc.ProjectUploads {
+		if policy.OnConflict != "" && !ValidConflict(policy.OnConflict) {
+			problems = append(problems, fmt.Sprintf("project_uploads[%s] on_conflict must be one of %s, %s, %s or %s, got %q", projectID, model.ConflictReject, model.ConflictOverwrite, model.ConflictRename, model.ConflictVersion, policy.OnConflict))
+		}
+	}
+	if sc.UploadTimeout <= 0 {
+		problems = append(problems, "upload_timeout must be positive")
+	}
+	if sc.RevalidateAfter < 0 {
+		problems = append(problems, "revalidate_after must not be negative")
+	}
+	if _, err := ParseWidths(sc.Widths); err != nil {
+		problems = append(problems, fmt.Sprintf("widths %s", err))
+	}
+	if sc.CacheMemorySize < 0 || sc.CacheDiskSize < 0 || sc.CacheMaxEntry < 0 {
+		problems = append(problems, "cache_memory_size, cache_disk_size and cache_max_entry must not be negative")
+	}
+	if sc.CacheMaxAge < 0 || sc.MaxAge < 0 {
+		problems = append(problems, "cache_max_age and max_age must not be negative")
+	}
+	for projectID, policy := range sc.ProjectCache {
+		if policy.RevalidateAfter < 0 || policy.MaxAge < 0 {
+			problems = append(problems, fmt.Sprintf("project_cache[%s] revalidate_after and max_age must not be negative", projectID))
+		}
+		for _, width := range policy.Widths {
+			if width <= 0 {
+				problems = append(problems, fmt.Sprintf("project_cache[%s] widths must be positive, got %d", projectID, width))
+			}
+		}
+	}
+	if !sc.LegacyUploadTokens {
+		requireField("UploadTokenSecret", "signed upload tokens")
+	}
+
+	if len(sc.Routes) == 0 {
+		problems = append(problems, "routes must have at least one route")
+	}
+	for i, route := range sc.Routes {
+		for _, variable := range []string{"{project_id}", "{transformation}", "{image"} {
+			if !strings.Contains(route.Path, variable) {
+				problems = append(problems, fmt.Sprintf("routes[%d] path %q has no %s} variable", i, route.Path, strings.TrimSuffix(variable, "}")))
+			}
+		}
+		switch route.Source {
+		case model.SourceOrigin, model.SourceMedia, model.SourceRemote:
+		default:
+			problems = append(problems, fmt.Sprintf("routes[%d] source must be one of %s, %s or %s, got %q", i, model.SourceOrigin, model.SourceMedia, model.SourceRemote, route.Source))
+		}
+		switch route.Renderer {
+		case "", renderer.Thumbor, renderer.Imgproxy, renderer.Local:
+		default:
+			problems = append(problems, fmt.Sprintf("routes[%d] renderer must be one of %s, %s or %s, got %q", i, renderer.Thumbor, renderer.Imgproxy, renderer.Local, route.Renderer))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("Invalid configuration:\n  - " + strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
+
+// ParseWidths parses a comma separated list of widths, sorted ascending.
+func ParseWidths(list string) ([]int, error) {
+	widths := []int{}
+	for _, item := range strings.Split(list, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		width, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil || width <= 0 {
+			return nil, fmt.Errorf("must list positive widths, got %q", item)
+		}
+		widths = append(widths, width)
+	}
+	if len(widths) == 0 {
+		return nil, errors.New("must list at least one width")
+	}
+	sort.Ints(widths)
+	return widths, nil
+}
+
+// ValidConflict reports whether mode is a known upload conflict policy.
+func ValidConflict(mode string) bool {
+	switch mode {
+	case model.ConflictReject, model.ConflictOverwrite, model.ConflictRename, model.ConflictVersion:
+		return true
+	}
+	return false
+}
+
+// Renderers returns the names of the renderers used by the routes.
+func Renderers(sc *model.ServerConf) []string {
+	names := []string{}
+	seen := map[string]bool{}
+	for _, route := range sc.Routes {
+		name := route.Renderer
+		if name == "" {
+			name = sc.Renderer
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Print writes the configuration as YAML, with secrets redacted.
+func Print(w io.Writer, sc *model.ServerConf) error {
+	out := yaml.MapSlice{}
+	eachField(sc, func(field reflect.StructField, value reflect.Value) {
+		item := yaml.MapItem{Key: field.Tag.Get("yaml"), Value: fmt.Sprint(value.Interface())}
+		if field.Tag.Get("secret") == "true" && !value.IsZero() {
+			item.Value = redacted
+		}
+		out = append(out, item)
+	})
+	out = append(out, yaml.MapItem{Key: "project_uploads", Value: sc.ProjectUploads})
+	out = append(out, yaml.MapItem{Key: "project_cache", Value: sc.ProjectCache})
+	out = append(out, yaml.MapItem{Key: "routes", Value: sc.Routes})
+
+	data, err := yaml.Marshal(out)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Diff describes the settings that differ between old and new, with secrets
+// redacted, and notes the ones that only take effect on restart.
+func Diff(old *model.ServerConf, new *model.ServerConf) []string {
+	changes := []string{}
+
+	newValue := reflect.ValueOf(new).Elem()
+	eachField(old, func(field reflect.StructField, value reflect.Value) {
+		before := fmt.Sprint(value.Interface())
+		after := fmt.Sprint(newValue.FieldByName(field.Name).Interface())
+		if before == after {
+			return
+		}
+		if field.Tag.Get("secret") == "true" {
+			before, after = redacted, redacted
+		}
+		change := fmt.Sprintf("%s: %q -> %q", field.Tag.Get("yaml"), before, after)
+		if field.Tag.Get("restart") == "true" {
+			change = change + " (needs a restart)"
+		}
+		changes = append(changes, change)
+	})
+
+	if !reflect.DeepEqual(old.ProjectUploads, new.ProjectUploads) {
+		changes = append(changes, "project_uploads: changed")
+	}
+	if !reflect.DeepEqual(old.ProjectCache, new.ProjectCache) {
+		changes = append(changes, "project_cache: changed")
+	}
+
+	oldRoutes := map[string]model.Route{}
+	for _, route := range old.Routes {
+		oldRoutes[route.Path] = route
+	}
+	newRoutes := map[string]bool{}
+	for _, route := range new.Routes {
+		newRoutes[route.Path] = true
+		oldRoute, ok := oldRoutes[route.Path]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("routes: added %s", route.Path))
+		} else if oldRoute != route {
+			changes = append(changes, fmt.Sprintf("routes: changed %s", route.Path))
+		}
+	}
+	for _, route := range old.Routes {
+		if !newRoutes[route.Path] {
+			changes = append(changes, fmt.Sprintf("routes: removed %s", route.Path))
+		}
+	}
+	if len(changes) == 0 && !reflect.DeepEqual(old.Routes, new.Routes) {
+		changes = append(changes, "routes: reordered")
+	}
+
+	return changes
+}
+
+// KeepRestartSettings copies the settings that only take effect on restart
+// from current into sc, so sc describes what the running server uses.
+func KeepRestartSettings(sc *model.ServerConf, current *model.ServerConf) {
+	currentValue := reflect.ValueOf(current).Elem()
+	eachField(sc, func(field reflect.StructField, value reflect.Value) {
+		if field.Tag.Get("restart") == "true" {
+			value.Set(currentValue.FieldByName(field.Name))
+		}
+	})
+}
+
+func missing(field reflect.StructField) string {
+	return fmt.Sprintf("%s is required (set %s in the config file, $%s or -%s)", field.Tag.Get("yaml"), field.Tag.Get("yaml"), field.Tag.Get("env"), field.Tag.Get("flag"))
+}
+
+// eachField calls fn for every scalar setting of sc, the ones that can also
+// be set from the environment and flags.
+func eachField(sc *model.ServerConf, fn func(field reflect.StructField, value reflect.Value)) {
+	v := reflect.ValueOf(sc).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("flag") == "" {
+			continue
+		}
+		fn(t.Field(i), v.Field(i))
+	}
+}
+
+func setValue(value reflect.Value, str string) error {
+	switch value.Interface().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			return err
+		}
+		value.Set(reflect.ValueOf(d))
+	case int64:
+		n, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return err
+		}
+		value.SetInt(n)
+	case bool:
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return err
+		}
+		value.SetBool(b)
+	case string:
+		value.SetString(str)
+	default:
+		return fmt.Errorf("Unsupported setting type %s", value.Type())
+	}
+	return nil
+}
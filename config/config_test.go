@@ -0,0 +1,292 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/siddhartham/imageutil-thumbor/model"
+	"github.com/siddhartham/imageutil-thumbor/renderer"
+	"github.com/siddhartham/imageutil-thumbor/storage"
+)
+
+// inDir runs the test in an empty directory, with none of the settings in
+// the environment, and returns the directory.
+func inDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	t.Setenv("CONFIG", "")
+	eachField(Defaults(), func(field reflect.StructField, value reflect.Value) {
+		t.Setenv(field.Tag.Get("env"), "")
+	})
+	return dir
+}
+
+func writeFile(t *testing.T, name string, data string) {
+	t.Helper()
+	if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadDefaults(t *testing.T) {
+	inDir(t)
+	sc, err := Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sc, Defaults()) {
+		t.Errorf("got %+v, want the defaults", sc)
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	dir := inDir(t)
+	writeFile(t, filepath.Join(dir, "imageutil.yml"), `
+port: ":8000"
+max_upload_size: 100
+renderer: imgproxy
+strip_exif: true
+max_age: 2h
+`)
+	writeFile(t, filepath.Join(dir, ".env"), "RENDERER=thumbor\nWIDTHS=200,100\nMAXAGE=3h\n")
+	t.Setenv("MAXUPLOADSIZE", "200")
+	t.Setenv("RENDERER", "local")
+
+	sc, err := Load([]string{"-config", "imageutil.yml", "-max-upload-size", "300", "-legacy-upload-tokens"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		setting string
+		got     interface{}
+		want    interface{}
+	}{
+		{"port from the file", sc.Port, ":8000"},
+		{"strip_exif from the file", sc.StripExif, true},
+		{"max_upload_size from a flag", sc.MaxUploadSize, int64(300)},
+		{"renderer from the environment over .env", sc.Renderer, renderer.Local},
+		{"widths from .env", sc.Widths, "200,100"},
+		{"max_age from .env over the file", sc.MaxAge, 3 * time.Hour},
+		{"legacy_upload_tokens from a bare flag", sc.LegacyUploadTokens, true},
+		{"graceful_timeout from the defaults", sc.GracefulTimeout, 15 * time.Second},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.setting, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigFromEnvironment(t *testing.T) {
+	dir := inDir(t)
+	writeFile(t, filepath.Join(dir, "conf.yml"), "host: example.com\n")
+	t.Setenv("CONFIG", "conf.yml")
+	sc, err := Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.Host != "example.com" {
+		t.Errorf("got host %q, want example.com", sc.Host)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{"unknown setting in the file", "colour: blue\n", nil, nil, "Invalid config file"},
+		{"missing file", "", nil, []string{"-config", "missing.yml"}, "missing.yml"},
+		{"invalid environment", "", map[string]string{"MAXUPLOADSIZE": "ten"}, nil, "Invalid $MAXUPLOADSIZE"},
+		{"invalid flag", "", nil, []string{"-upload-timeout", "soon"}, "Invalid -upload-timeout"},
+		{"invalid bool flag", "", nil, []string{"-strip-exif=maybe"}, "Invalid -strip-exif"},
+		{"unknown flag", "", nil, []string{"-colour", "blue"}, "colour"},
+		{"extra arguments", "", nil, []string{"serve"}, "Unexpected arguments"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := inDir(t)
+			args := tt.args
+			if tt.file != "" {
+				writeFile(t, filepath.Join(dir, "conf.yml"), tt.file)
+				args = append([]string{"-config", "conf.yml"}, args...)
+			}
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			_, err := Load(args)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// validConf returns a configuration Validate accepts.
+func validConf() *model.ServerConf {
+	sc := Defaults()
+	sc.ThumborHost = "thumbor:8888"
+	sc.ThumborSecret = "secret"
+	sc.MysqlServerHost = "mysql"
+	sc.MysqlServerPort = "3306"
+	sc.MysqlServerUsername = "imageutil"
+	sc.MysqlServerDatabase = "imageutil"
+	sc.CdnOrigin = "cdn.example.com"
+	sc.BucketName = "media"
+	sc.MediaEndpoint = "s3.example.com"
+	sc.UploadTokenSecret = "upload-secret"
+	return sc
+}
+
+func TestValidate(t *testing.T) {
+	if err := Validate(validConf()); err != nil {
+		t.Fatalf("valid configuration: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(sc *model.ServerConf)
+		want   string
+	}{
+		{"missing required", func(sc *model.ServerConf) { sc.MysqlServerHost = "" }, "mysql_host is required"},
+		{"unknown renderer", func(sc *model.ServerConf) { sc.Renderer = "gimp" }, "renderer must be one of"},
+		{"thumbor without secret", func(sc *model.ServerConf) { sc.ThumborSecret = "" }, "needed by the thumbor renderer"},
+		{"thumbor without hosts", func(sc *model.ServerConf) { sc.ThumborHost = "" }, "thumbor_hosts is required"},
+		{"imgproxy route without host", func(sc *model.ServerConf) { sc.Routes[0].Renderer = renderer.Imgproxy }, "imgproxy_host is required"},
+		{"s3 without bucket", func(sc *model.ServerConf) { sc.BucketName = "" }, "needed by the s3 storage"},
+		{"fs without path", func(sc *model.ServerConf) { sc.Storage = storage.Filesystem }, "needed by the fs storage"},
+		{"unknown storage", func(sc *model.ServerConf) { sc.Storage = "tape" }, "storage must be one of"},
+		{"unknown balancer", func(sc *model.ServerConf) { sc.Balancer = "random" }, "balancer must be"},
+		{"port without colon", func(sc *model.ServerConf) { sc.Port = "9000" }, "port must look like :9000"},
+		{"zero upload size", func(sc *model.ServerConf) { sc.MaxUploadSize = 0 }, "max_upload_size must be positive"},
+		{"no upload formats", func(sc *model.ServerConf) { sc.UploadFormats = " " }, "upload_formats must list"},
+		{"unknown conflict", func(sc *model.ServerConf) { sc.UploadConflict = "merge" }, "upload_conflict must be one of"},
+		{"unknown project conflict", func(sc *model.ServerConf) {
+			sc.ProjectUploads = map[string]model.UploadPolicy{"42": {OnConflict: "merge"}}
+		}, "project_uploads[42] on_conflict"},
+		{"zero upload timeout", func(sc *model.ServerConf) { sc.UploadTimeout = 0 }, "upload_timeout must be positive"},
+		{"negative revalidate", func(sc *model.ServerConf) { sc.RevalidateAfter = -time.Second }, "revalidate_after must not be negative"},
+		{"invalid widths", func(sc *model.ServerConf) { sc.Widths = "320,wide" }, "widths must list positive widths"},
+		{"negative cache size", func(sc *model.ServerConf) { sc.CacheDiskSize = -1 }, "must not be negative"},
+		{"negative project width", func(sc *model.ServerConf) {
+			sc.ProjectCache = map[string]model.CachePolicy{"42": {Widths: []int{-1}}}
+		}, "project_cache[42] widths must be positive"},
+		{"signed tokens without secret", func(sc *model.ServerConf) { sc.UploadTokenSecret = "" }, "needed by the signed upload tokens"},
+		{"no routes", func(sc *model.ServerConf) { sc.Routes = nil }, "routes must have at least one route"},
+		{"route without image", func(sc *model.ServerConf) { sc.Routes[0].Path = "/{project_id}/{transformation}" }, "has no {image} variable"},
+		{"unknown route source", func(sc *model.ServerConf) { sc.Routes[0].Source = "ftp" }, "routes[0] source must be one of"},
+	}
+	for _, tt := range tests {
+		sc := validConf()
+		tt.change(sc)
+		err := Validate(sc)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want an error containing %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestValidateLegacyTokensNeedNoSecret(t *testing.T) {
+	sc := validConf()
+	sc.UploadTokenSecret = ""
+	sc.LegacyUploadTokens = true
+	if err := Validate(sc); err != nil {
+		t.Errorf("got %v, want no error", err)
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	sc := validConf()
+	sc.Port = "9000"
+	sc.Balancer = "random"
+	err := Validate(sc)
+	if err == nil || !strings.Contains(err.Error(), "port") || !strings.Contains(err.Error(), "balancer") {
+		t.Errorf("got %v, want both problems", err)
+	}
+}
+
+func TestParseWidths(t *testing.T) {
+	tests := []struct {
+		list string
+		want []int
+		ok   bool
+	}{
+		{"640, 320,1280", []int{320, 640, 1280}, true},
+		{"320,", []int{320}, true},
+		{"", nil, false},
+		{"320,0", nil, false},
+		{"320,wide", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseWidths(tt.list)
+		if (err == nil) != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseWidths(%q) = %v, %v, want %v", tt.list, got, err, tt.want)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old := validConf()
+	new := validConf()
+	new.MaxUploadSize = 20 << 20
+	new.ThumborSecret = "rotated"
+	new.CacheDiskSize = 2 << 30
+	new.ProjectCache = map[string]model.CachePolicy{"42": {MaxAge: time.Minute}}
+	new.Routes = append(new.Routes[1:], model.Route{Path: "/{project_id}/r/{transformation}/{image:.*}", Source: model.SourceRemote})
+	new.Routes[0].Renderer = renderer.Local
+
+	want := []string{
+		`thumbor_secret: "********" -> "********"`,
+		`max_upload_size: "10485760" -> "20971520"`,
+		`cache_disk_size: "1073741824" -> "2147483648" (needs a restart)`,
+		"project_cache: changed",
+		"routes: changed /{project_id}/media/{transformation}/{image:.*}",
+		"routes: added /{project_id}/r/{transformation}/{image:.*}",
+		"routes: removed /{project_id}/media/{transformation}/smart/{image:.*}",
+	}
+	if got := Diff(old, new); !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n  %s\nwant\n  %s", strings.Join(got, "\n  "), strings.Join(want, "\n  "))
+	}
+
+	if got := Diff(old, validConf()); len(got) != 0 {
+		t.Errorf("same configuration: got %v", got)
+	}
+
+	reordered := validConf()
+	reordered.Routes[0], reordered.Routes[1] = reordered.Routes[1], reordered.Routes[0]
+	if got := Diff(old, reordered); !reflect.DeepEqual(got, []string{"routes: reordered"}) {
+		t.Errorf("reordered routes: got %v", got)
+	}
+}
+
+func TestKeepRestartSettings(t *testing.T) {
+	current := validConf()
+	sc := validConf()
+	sc.Port = ":9100"
+	sc.CacheDir = "/var/cache/imageutil"
+	sc.MaxUploadSize = 1
+	KeepRestartSettings(sc, current)
+	if sc.Port != current.Port || sc.CacheDir != current.CacheDir {
+		t.Errorf("restart settings changed: port %q, cache_dir %q", sc.Port, sc.CacheDir)
+	}
+	if sc.MaxUploadSize != 1 {
+		t.Errorf("max_upload_size was reset to %d", sc.MaxUploadSize)
+	}
+}
@@ -1,6 +1,7 @@
-GOOS=linux GOARCH=amd64 go build main.go
+GOOS=linux GOARCH=amd64 go build -o main .
 scp main root@167.99.172.148:/
 # scp .env root@167.99.172.148:/
+# scp conf/imageutil.yml root@167.99.172.148:/etc/imageutil.yml
 # scp conf/nginx.conf root@167.99.172.148:/etc/nginx/sites-enabled/default 
 # scp conf/supervisor_thumbor.conf root@167.99.172.148:/etc/supervisor/conf.d/thumbor.conf
 # scp conf/thumbor.conf root@167.99.172.148:/etc/thumbor.conf
@@ -3,8 +3,8 @@ package main
 import (
 	"context"
 	"database/sql"
-	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
@@ -15,20 +15,56 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
-	"github.com/joho/godotenv"
-	"github.com/rs/cors"
 	"github.com/siddhartham/imageutil-thumbor/action"
+	"github.com/siddhartham/imageutil-thumbor/cache"
+	"github.com/siddhartham/imageutil-thumbor/config"
 	"github.com/siddhartham/imageutil-thumbor/model"
-	"github.com/siddhartham/imageutil-thumbor/thumbor"
+	"github.com/siddhartham/imageutil-thumbor/renderer"
+	"github.com/siddhartham/imageutil-thumbor/storage"
 	"github.com/siddhartham/imageutil-thumbor/util"
 )
 
-func generateProxy(conf model.Config) http.Handler {
-	proxy := &httputil.ReverseProxy{Director: func(req *http.Request) {
+// proxyTarget is the request context key holding the upstream url the
+// proxy forwards to.
+type proxyTarget struct{}
+
+func generateProxy(conf model.Config, rend renderer.Renderer, pool http.RoundTripper, store storage.Storage) http.Handler {
+	director := func(req *http.Request) {
+		target := req.Context().Value(proxyTarget{}).(*url.URL)
+
+		//rewrite url
+		req.URL = target
+		util.LogInfo("generateProxy : FinalURL", req.URL.String())
+
+		//conditional requests are answered here, with this service's validators
+		req.Header.Del("If-None-Match")
+		req.Header.Del("If-Modified-Since")
+
+		//set headers
+		req.Header.Add("X-Forwarded-Host", req.Host)
+		req.Header.Add("X-Origin-Host", target.Host)
+
+		util.LogInfo("generateProxy : X-Forwarded-Host", req.Host)
+		util.LogInfo("generateProxy : X-Origin-Host", target.Host)
+
+	}
+	proxy := &httputil.ReverseProxy{Director: director, Transport: &http.Transport{
+		Dial: (&net.Dialer{
+			Timeout: 5 * time.Second,
+		}).Dial,
+	}}
+	// renderer requests are balanced across the renderer pool
+	renderProxy := proxy
+	if pool != nil {
+		renderProxy = &httputil.ReverseProxy{Director: director, Transport: pool}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		vars := mux.Vars(req)
 
 		// to be fetched from db
@@ -43,60 +79,161 @@ func generateProxy(conf model.Config) http.Handler {
 		projectImageOrigin, err := action.GetProject(conf.MysqlServerConn, projectID, &project)
 		if err != nil {
 			util.LogError("generateProxy : GetProject : SELECT", err.Error())
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		}
+		analytic.UserID = project.UserID
+		analytic.ProjectID = project.ID
+
+		// signed urls are served for good
+		signed, err := action.CheckSignature(conf.Server, req)
+		if err != nil {
+			util.LogWarning("generateProxy : CheckSignature", err.Error())
+			http.Error(w, err.Error(), http.StatusForbidden)
 			return
 		}
 
 		imgPath := vars["image"]
+		switch conf.Source {
 		//is media storage
-		if conf.IsMedia {
+		case model.SourceMedia:
 			imgPath = fmt.Sprintf("https://%s.%s/%s/%s", conf.BucketName, conf.MediaEndpoint, conf.MediaStorage, imgPath)
+		//is a full url
+		case model.SourceRemote:
+			imgPath, err = remoteSource(imgPath)
+			if err != nil {
+				util.LogError("generateProxy : remoteSource", err.Error())
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 		}
 		util.LogInfo("generateProxy : GetImage : Image Path", imgPath)
 
+		// f:auto is rendered, and indexed, as the format the client accepts,
+		// dpr and s:auto as the size the client hints at
+		transformationStr, negotiated := renderer.NegotiateFormat(vars["transformation"], req.Header.Get("Accept"), imgPath)
+		transformationStr, hinted := renderer.ResolveSize(transformationStr, renderer.ClientHints(req.Header), action.Widths(conf.Server, project.ID))
+		vary := action.VaryBy(negotiated, hinted)
+
+		// rendered on this node lately, serve it from the local cache
+		resultKey := action.ResultKey(project.ID, imgPath, conf.IsSmart, transformationStr)
+		if entry := action.ServeCachedResult(w, req, resultKey, action.ResultHeaders(conf.Server, project.ID, resultKey, image, signed, vary)); entry != nil {
+			if entry.ImageID != "" {
+				image.FileSize = entry.Size
+				analytic.ImageID = entry.ImageID
+				action.Background(func() {
+					action.SaveAnalytic(conf.MysqlServerConn, image, analytic, 0, 1, 0)
+				})
+			}
+			return
+		}
+
 		// get image
-		err = action.GetImage(conf.MysqlServerConn, conf.IsSmart, projectImageOrigin, imgPath, vars["transformation"], &project, &image, &analytic)
+		err = action.GetImage(conf.MysqlServerConn, conf.IsSmart, projectImageOrigin, imgPath, transformationStr, &project, &image, &analytic)
 		if err != nil {
 			util.LogWarning("generateProxy : GetImage : SELECT", err.Error())
 		}
 
-		// get or generate thumbor
-		finalScheme := project.Protocol
-		finalHost := conf.CdnOrigin
-		finalPath := strings.Replace(image.CdnPath, fmt.Sprintf("%s/", conf.ResultStorage), "", 1)
-		image.ImgURL = fmt.Sprintf("%s://%s%s", finalScheme, finalHost, finalPath)
-		if finalPath == "" {
-			finalScheme = "http" //thumbor is internal
-			finalHost = conf.Host
-			finalPath = thumbor.GetThumborUrl(conf, projectImageOrigin, image, analytic)
-		} else {
+		// source of the image
+		source := image.OriginPath
+		if conf.Source == model.SourceOrigin {
+			source = fmt.Sprintf("%s/%s", projectImageOrigin, image.OriginPath)
+		}
+
+		// rendered a while ago, render it again if its source changed
+		if image.CdnPath != "" && action.Stale(conf.Server, image) {
+			action.RevalidateImage(conf.MysqlServerConn, store, conf.Server, source, &image)
+		}
+		// not rendered yet, its source validators go in its ETag
+		if image.CdnPath == "" && image.OriginETag == "" && image.OriginLastModified == "" && action.Revalidates(conf.Server, project.ID) {
+			image.OriginETag, image.OriginLastModified = action.OriginValidators(source)
+		}
+		header := action.ResultHeaders(conf.Server, project.ID, resultKey, image, signed, vary)
+
+		// already rendered, serve it from the cdn
+		if image.CdnPath != "" {
+			target := cdnURL(conf, project, image.CdnPath)
+			image.ImgURL = target.String()
 			req.Host = conf.CdnOrigin
 			analytic.ImageID = image.ID
-			go action.SaveAnalytic(conf.MysqlServerConn, image, analytic, 0, 1, 0)
+			action.Background(func() {
+				action.SaveAnalytic(conf.MysqlServerConn, image, analytic, 0, 1, 0)
+			})
+
+			// the client has it already
+			if action.NotModified(req, header) {
+				action.WriteNotModified(w, header)
+				return
+			}
+
+			rw := action.RecordResult(w, req, conf.Server, header)
+			proxy.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), proxyTarget{}, target)))
+			action.CacheResult(rw, conf.Server, resultKey, project.ID, image.ID)
+			return
 		}
 
-		//rewrite url
-		req.URL = &url.URL{
-			Scheme:  finalScheme,
-			Host:    finalHost,
-			Path:    finalPath,
-			RawPath: finalPath,
+		transformation, err := renderer.ParseTransformation(image.Transformation, conf.IsSmart)
+		if err != nil {
+			util.LogError("generateProxy : ParseTransformation", err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-		util.LogInfo("generateProxy : FinalURL", fmt.Sprintf("%s", req.URL))
 
-		//set headers
-		req.Header.Add("X-Forwarded-Host", req.Host)
-		req.Header.Add("X-Origin-Host", finalHost)
+		result, err := rend.Render(source, transformation)
+		if err != nil {
+			util.LogError("generateProxy : Render", err.Error())
+			http.Error(w, "Could not render image", http.StatusBadGateway)
+			return
+		}
 
-		util.LogInfo("generateProxy : X-Forwarded-Host", req.Host)
-		util.LogInfo("generateProxy : X-Origin-Host", finalHost)
+		// rendered in-process
+		rw := action.RecordResult(w, req, conf.Server, header)
+		if result.URL == nil {
+			defer result.Body.Close()
+			rw.Header().Set("Content-Type", result.ContentType)
+			rw.Header().Set("Content-Length", strconv.FormatInt(result.Size, 10))
+			if _, err := io.Copy(rw, result.Body); err == nil {
+				action.CacheResult(rw, conf.Server, resultKey, project.ID, "")
+			}
+			return
+		}
 
-	}, Transport: &http.Transport{
-		Dial: (&net.Dialer{
-			Timeout: 5 * time.Second,
-		}).Dial,
-	}}
+		// rendered upstream, remember where it will be stored
+		if result.CdnPath != "" {
+			image.Key = result.Key
+			image.CdnPath = result.CdnPath
+			image.ImgURL = cdnURL(conf, project, image.CdnPath).String()
+			action.Background(func() {
+				action.SaveImageUrl(conf.MysqlServerConn, image, analytic)
+			})
+		}
+
+		renderProxy.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), proxyTarget{}, result.URL)))
+		action.CacheResult(rw, conf.Server, resultKey, project.ID, "")
+	})
+}
 
-	return proxy
+// remoteSource returns the source url of a remote route. The router cleans
+// the "//" after the scheme down to "/", so it is restored here.
+func remoteSource(imgPath string) (string, error) {
+	for _, scheme := range []string{"http:/", "https:/"} {
+		if strings.HasPrefix(imgPath, scheme) {
+			imgPath = scheme + "/" + strings.TrimLeft(strings.TrimPrefix(imgPath, scheme), "/")
+			return imgPath, nil
+		}
+	}
+	return "", fmt.Errorf("Invalid remote image url %q", imgPath)
+}
+
+// cdnURL returns the cdn url of an image kept in result storage.
+func cdnURL(conf model.Config, project model.Project, cdnPath string) *url.URL {
+	finalPath := strings.Replace(cdnPath, fmt.Sprintf("%s/", conf.ResultStorage), "", 1)
+	return &url.URL{
+		Scheme:  project.Protocol,
+		Host:    conf.CdnOrigin,
+		Path:    finalPath,
+		RawPath: finalPath,
+	}
 }
 
 func main() {
@@ -104,38 +241,39 @@ func main() {
 
 	args := os.Args[1:]
 
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
+	//config print subcommand
+	if len(args) >= 2 && args[0] == "config" && args[1] == "print" {
+		sc, err := config.Load(args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := config.Validate(sc); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if err := config.Print(os.Stdout, sc); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	port := os.Getenv("PORT")
-	thumborHost := os.Getenv("THUMBORHOST")
-	if len(args) > 0 {
-		p, err := strconv.Atoi(args[0])
-		if err == nil {
-			port = fmt.Sprintf("%s%d", ":900", p)
-			thumborHost = fmt.Sprintf("%s%d", "127.0.0.1:800", p)
+	//token mint subcommand
+	if len(args) >= 2 && args[0] == "token" && args[1] == "mint" {
+		signed, err := mintToken(args[2:])
+		if err != nil {
+			log.Fatal(err)
 		}
+		fmt.Println(signed)
+		return
 	}
 
-	//General config, should load from env in prod
-	sc := &model.ServerConf{
-		Host:                os.Getenv("HOST"),
-		Port:                port,
-		ThumborHost:         thumborHost,
-		ThumborSecret:       os.Getenv("THUMBORSECRET"),
-		MysqlServerHost:     os.Getenv("MYSQLSERVERHOST"),
-		MysqlServerPort:     os.Getenv("MYSQLSERVERPORT"),
-		MysqlServerUsername: os.Getenv("MYSQLSERVERUSERNAME"),
-		MysqlServerPassword: os.Getenv("MYSQLSERVERPASSWORD"),
-		MysqlServerDatabase: os.Getenv("MYSQLSERVERDATABASE"),
-		CdnOrigin:           os.Getenv("CDNORIGIN"), //"cdn.imageutil.io",
-		BucketName:          os.Getenv("BUCKETNAME"),
-		ResultStorage:       os.Getenv("RESULTSTORAGE"),
-		MediaStorage:        os.Getenv("MEDIASTORAGE"),
-		MediaEndpoint:       os.Getenv("MEDIAENDPOINT"),
+	sc, err := config.Load(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := config.Validate(sc); err != nil {
+		log.Fatal(err)
 	}
+
 	//Mysql connection
 	mysqlConnStr := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s", sc.MysqlServerUsername, sc.MysqlServerPassword, sc.MysqlServerHost, sc.MysqlServerPort, sc.MysqlServerDatabase)
 	db, err := sql.Open("mysql", mysqlConnStr)
@@ -143,126 +281,98 @@ func main() {
 		panic(err.Error())
 	}
 	defer db.Close()
+	if err := action.CheckSchema(db); err != nil {
+		log.Fatal(err)
+	}
 
-	//main router
-	r := mux.NewRouter()
-
-	//fixed routes
-	r.HandleFunc("/health", action.HealthCheckHandler)
-	r.HandleFunc("/upload/{uploadToken}/{fileName}", func(w http.ResponseWriter, r *http.Request) {
-		action.UploadHandler(db, w, r)
-	})
+	//media storage
+	store, err := storage.New(sc)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	//reverse proxy routes
-	configuration := []model.Config{
-		model.Config{
-			Path:            "/{project_id}/media/{transformation}/smart/{image:.*}",
-			Host:            sc.ThumborHost,
-			IsSmart:         true,
-			IsMedia:         true,
-			Secret:          sc.ThumborSecret,
-			MysqlServerConn: db,
-			CdnOrigin:       sc.CdnOrigin,
-			BucketName:      sc.BucketName,
-			ResultStorage:   sc.ResultStorage,
-			MediaStorage:    sc.MediaStorage,
-			MediaEndpoint:   sc.MediaEndpoint,
-		},
-		model.Config{
-			Path:            "/{project_id}/media/{transformation}/{image:.*}",
-			Host:            sc.ThumborHost,
-			IsSmart:         false,
-			IsMedia:         true,
-			Secret:          sc.ThumborSecret,
-			MysqlServerConn: db,
-			CdnOrigin:       sc.CdnOrigin,
-			BucketName:      sc.BucketName,
-			ResultStorage:   sc.ResultStorage,
-			MediaStorage:    sc.MediaStorage,
-			MediaEndpoint:   sc.MediaEndpoint,
-		},
-		model.Config{
-			Path:            "/{project_id}/{transformation}/smart/{image:.*}",
-			Host:            sc.ThumborHost,
-			IsSmart:         true,
-			IsMedia:         false,
-			Secret:          sc.ThumborSecret,
-			MysqlServerConn: db,
-			CdnOrigin:       sc.CdnOrigin,
-			BucketName:      sc.BucketName,
-			ResultStorage:   sc.ResultStorage,
-			MediaStorage:    sc.MediaStorage,
-			MediaEndpoint:   sc.MediaEndpoint,
-		},
-		model.Config{
-			Path:            "/{project_id}/{transformation}/{image:.*}",
-			Host:            sc.ThumborHost,
-			IsSmart:         false,
-			IsMedia:         false,
-			Secret:          sc.ThumborSecret,
-			MysqlServerConn: db,
-			CdnOrigin:       sc.CdnOrigin,
-			BucketName:      sc.BucketName,
-			ResultStorage:   sc.ResultStorage,
-			MediaStorage:    sc.MediaStorage,
-			MediaEndpoint:   sc.MediaEndpoint,
-		},
+	//local result cache, kept across reloads
+	results, err := cache.New(sc.CacheMemorySize, sc.CacheDir, sc.CacheDiskSize, sc.CacheMaxEntry)
+	if err != nil {
+		log.Fatal(err)
 	}
-	for _, conf := range configuration {
-		proxy := generateProxy(conf)
-		r.HandleFunc(conf.Path, func(w http.ResponseWriter, r *http.Request) {
-			proxy.ServeHTTP(w, r)
-		})
+	if sc.CacheMemorySize > 0 || sc.CacheDir != "" {
+		action.SetResultCache(results)
 	}
 
-	//Start server
-	util.LogInfo("Starting imageutil server on port", sc.Port)
-	// log.Fatal(http.ListenAndServe(sc.Port, r))
+	//cleanup of abandoned uploads
+	stopSweeper := action.StartSweeper(db, store)
 
-	var wait time.Duration
-	flag.DurationVar(&wait, "graceful-timeout", time.Second*15, "the duration for which the server gracefully wait for existing connections to finish - e.g. 15s or 1m")
-	flag.Parse()
-
-	corsObj := cors.New(cors.Options{
-		AllowedOrigins: []string{"*"},
-	})
+	//router, rebuilt on reload
+	handler, err := newLiveHandler(args, sc, db, store)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	handler := corsObj.Handler(r)
+	//Start server
+	util.LogInfo("Starting imageutil server on port", sc.Port)
 
 	srv := &http.Server{
 		Addr: fmt.Sprintf("0.0.0.0%s", sc.Port),
-		// Good practice to set timeouts to avoid Slowloris attacks.
-		WriteTimeout: time.Second * 15, //upload
+		// Good practice to set timeouts to avoid Slowloris attacks. The
+		// upload routes extend them to upload_timeout.
+		WriteTimeout: time.Second * 15,
 		ReadTimeout:  time.Second * 15,
 		IdleTimeout:  time.Second * 60,
 		Handler:      handler, // Pass our instance of gorilla/mux in.
 	}
 
 	// Run our server in a goroutine so that it doesn't block.
+	serverErr := make(chan error, 1)
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
-			util.LogError("main : server", err.Error())
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			serverErr <- err
 		}
 	}()
 
-	c := make(chan os.Signal, 1)
-	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C)
-	// SIGKILL, SIGQUIT or SIGTERM (Ctrl+/) will not be caught.
-	signal.Notify(c, os.Interrupt)
+	// Reload the configuration on SIGHUP.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			util.LogInfo("main : server", "reloading configuration")
+			if err := handler.Reload(); err != nil {
+				util.LogError("main : reload", err.Error())
+			}
+		}
+	}()
 
-	// Block until we receive our signal.
-	<-c
+	c := make(chan os.Signal, 1)
+	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C) or
+	// SIGTERM, which supervisor sends on stop. SIGKILL and SIGQUIT will
+	// not be caught.
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	// Block until we receive our signal, or the server fails.
+	select {
+	case sig := <-c:
+		util.LogInfo("main : server", fmt.Sprintf("%s received, shutting down", sig))
+	case err := <-serverErr:
+		util.LogError("main : server", err.Error())
+		handler.Close()
+		db.Close()
+		os.Exit(1)
+	}
 
 	// Create a deadline to wait for.
-	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	ctx, cancel := context.WithTimeout(context.Background(), handler.Config().GracefulTimeout)
 	defer cancel()
-	// Doesn't block if no connections, but will otherwise wait
-	// until the timeout deadline.
-	srv.Shutdown(ctx)
-	// Optionally, you could run srv.Shutdown in a goroutine and block on
-	// <-ctx.Done() if your application should wait for other services
-	// to finalize based on context cancellation.
-	util.LogInfo("main : server", "shutting down")
-	os.Exit(0)
-
+	// Stop accepting requests and wait for the in-flight ones, proxied
+	// responses included, until the timeout deadline.
+	if err := srv.Shutdown(ctx); err != nil {
+		util.LogError("main : server : Shutdown", err.Error())
+	}
+	stopSweeper()
+	handler.Close()
+	// Then flush the pending analytics and image index writes, which still
+	// need the database, under the same deadline.
+	if err := action.WaitBackground(ctx); err != nil {
+		util.LogError("main : server : WaitBackground", err.Error())
+	}
+	util.LogInfo("main : server", "shut down")
 }
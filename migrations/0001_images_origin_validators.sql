@@ -0,0 +1,6 @@
+-- Validators of the source an image was rendered from, to revalidate it
+-- against the origin (revalidate_after).
+ALTER TABLE images
+  ADD COLUMN origin_etag VARCHAR(255) NULL,
+  ADD COLUMN origin_last_modified VARCHAR(64) NULL,
+  ADD COLUMN validated_at DATETIME NULL;
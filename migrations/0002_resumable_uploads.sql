@@ -0,0 +1,24 @@
+-- State of the resumable uploads in progress. Uploads idle longer than
+-- ResumableExpiry are aborted by the sweeper.
+CREATE TABLE IF NOT EXISTS resumable_uploads (
+  id VARCHAR(32) NOT NULL,
+  upload_token VARCHAR(1024) NOT NULL,
+  user_id BIGINT NOT NULL,
+  project_id BIGINT NOT NULL,
+  folder_id BIGINT NOT NULL,
+  file_name VARCHAR(255) NOT NULL,
+  store_key VARCHAR(1024) NOT NULL,
+  storage_upload_id VARCHAR(1024) NOT NULL DEFAULT '',
+  size BIGINT NOT NULL,
+  upload_offset BIGINT NOT NULL DEFAULT 0,
+  parts MEDIUMTEXT NOT NULL,
+  on_conflict VARCHAR(16) NULL,
+  mime_type VARCHAR(255) NULL,
+  width INT NULL,
+  height INT NULL,
+  format VARCHAR(16) NULL,
+  created_at DATETIME NOT NULL,
+  updated_at DATETIME NOT NULL,
+  PRIMARY KEY (id),
+  KEY index_resumable_uploads_on_updated_at (updated_at)
+);
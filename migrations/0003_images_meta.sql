@@ -0,0 +1,4 @@
+-- Metadata of a source image, kept in the images row of transformation
+-- "meta" (see action/meta.go).
+ALTER TABLE images
+  ADD COLUMN meta TEXT NULL;
@@ -0,0 +1,6 @@
+-- Dimensions and format of the uploaded images, read from their header on
+-- upload.
+ALTER TABLE folders
+  ADD COLUMN width INT NULL,
+  ADD COLUMN height INT NULL,
+  ADD COLUMN format VARCHAR(16) NULL;
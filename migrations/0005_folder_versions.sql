@@ -0,0 +1,21 @@
+-- Conflict policy of a folder for uploads of a name it already has, and
+-- the versions kept of the files overwritten with on_conflict=version.
+ALTER TABLE folders
+  ADD COLUMN conflict_policy VARCHAR(16) NULL;
+
+CREATE TABLE IF NOT EXISTS folder_versions (
+  id BIGINT NOT NULL AUTO_INCREMENT,
+  file_id BIGINT NOT NULL,
+  project_id BIGINT NOT NULL,
+  version INT NOT NULL,
+  path VARCHAR(1024) NOT NULL,
+  original_name VARCHAR(255) NULL,
+  mime_type VARCHAR(255) NULL,
+  file_size BIGINT NULL,
+  width INT NULL,
+  height INT NULL,
+  format VARCHAR(16) NULL,
+  created_at DATETIME NOT NULL,
+  PRIMARY KEY (id),
+  UNIQUE KEY index_folder_versions_on_file_id_and_version (file_id, version)
+);
@@ -0,0 +1,10 @@
+-- Files uploaded with each upload token limiting them with max_files, by
+-- the token id, until the token expires.
+CREATE TABLE IF NOT EXISTS upload_token_uses (
+  jti VARCHAR(128) NOT NULL,
+  uses INT NOT NULL,
+  max_files INT NOT NULL,
+  expires_at DATETIME NOT NULL,
+  PRIMARY KEY (jti),
+  KEY index_upload_token_uses_on_expires_at (expires_at)
+);
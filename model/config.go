@@ -1,17 +1,86 @@
 package model
 
-import "database/sql"
+import (
+	"database/sql"
+	"time"
+)
 
 type Override struct {
 	Match   string
 	Replace string
 }
 
+const (
+	SourceOrigin = "origin"
+	SourceMedia  = "media"
+	SourceRemote = "remote"
+)
+
+// What an upload does when its folder already has a file of the same name:
+// fail, replace the file, upload under a numbered name ("name (1).jpg") or
+// replace the file keeping the old one as a version.
+const (
+	ConflictReject    = "reject"
+	ConflictOverwrite = "overwrite"
+	ConflictRename    = "rename"
+	ConflictVersion   = "version"
+)
+
+// Route is one entry of the proxy route table. Path is a gorilla/mux pattern
+// with {project_id}, {transformation} and {image} variables, Source says
+// where {image} is fetched from: the project origin, the media library
+// bucket or, for remote, {image} is a full url. Renderer and the storage
+// settings fall back to the server settings when empty.
+type Route struct {
+	Path          string `yaml:"path"`
+	Source        string `yaml:"source"`
+	Smart         bool   `yaml:"smart"`
+	Renderer      string `yaml:"renderer,omitempty"`
+	BucketName    string `yaml:"bucket_name,omitempty"`
+	ResultStorage string `yaml:"result_storage,omitempty"`
+	MediaStorage  string `yaml:"media_storage,omitempty"`
+	MediaEndpoint string `yaml:"media_endpoint,omitempty"`
+}
+
+// UploadPolicy limits what can be uploaded to a project's media library.
+// Formats are image formats as named by the image package (jpeg, png, gif,
+// webp). Fields left empty fall back to the server wide upload settings.
+type UploadPolicy struct {
+	MaxSize    int64    `yaml:"max_size,omitempty"`
+	Formats    []string `yaml:"formats,omitempty"`
+	MaxWidth   int64    `yaml:"max_width,omitempty"`
+	MaxHeight  int64    `yaml:"max_height,omitempty"`
+	MaxPixels  int64    `yaml:"max_pixels,omitempty"`
+	StripExif  *bool    `yaml:"strip_exif,omitempty"`
+	OnConflict string   `yaml:"on_conflict,omitempty"`
+
+	// MaxFiles is how many more files the upload token allows, 0 when it
+	// does not limit them, and TokenID the token they are counted for. They
+	// come from the token, not the config.
+	MaxFiles int64  `yaml:"-"`
+	TokenID  string `yaml:"-"`
+}
+
+// CachePolicy is how a project's rendered images are cached, and so how
+// many variants of an image are. Fields left empty fall back to the server
+// wide cache settings.
+type CachePolicy struct {
+	// RevalidateAfter is how long a rendered image is served before its
+	// source is checked for changes against the project origin.
+	RevalidateAfter time.Duration `yaml:"revalidate_after,omitempty"`
+	// MaxAge is the Cache-Control max-age of the project's images, unless
+	// their url is signed.
+	MaxAge time.Duration `yaml:"max_age,omitempty"`
+	// Widths are the widths dpr scaled and client hinted sizes are snapped
+	// up to.
+	Widths []int `yaml:"widths,omitempty"`
+}
+
 type Config struct {
 	Path            string
 	Host            string
 	IsSmart         bool
-	IsMedia         bool
+	Source          string
 	Secret          string
 	MysqlServerConn *sql.DB
 	CdnOrigin       string
@@ -19,21 +88,65 @@ type Config struct {
 	ResultStorage   string
 	MediaStorage    string
 	MediaEndpoint   string
+	Renderer        string
+	ImgproxyHost    string
+	ImgproxyKey     string
+	ImgproxySalt    string
+	Server          *ServerConf
 }
 
+// ServerConf is the server configuration. The tags name the setting in the
+// config file, the environment variable and the flag that set it. Settings
+// tagged restart only take effect on restart, not on reload.
 type ServerConf struct {
-	Host                string
-	Port                string
-	ThumborHost         string
-	ThumborSecret       string
-	MysqlServerHost     string
-	MysqlServerPort     string
-	MysqlServerUsername string
-	MysqlServerPassword string
-	MysqlServerDatabase string
-	CdnOrigin           string
-	BucketName          string
-	ResultStorage       string
-	MediaStorage        string
-	MediaEndpoint       string
+	Host                string                  `yaml:"host" env:"HOST" flag:"host"`
+	Port                string                  `yaml:"port" env:"PORT" flag:"port" required:"true" restart:"true"`
+	GracefulTimeout     time.Duration           `yaml:"graceful_timeout" env:"GRACEFULTIMEOUT" flag:"graceful-timeout"`
+	ThumborHost         string                  `yaml:"thumbor_host" env:"THUMBORHOST" flag:"thumbor-host"`
+	ThumborHosts        string                  `yaml:"thumbor_hosts" env:"THUMBORHOSTS" flag:"thumbor-hosts"`
+	ThumborSecret       string                  `yaml:"thumbor_secret" env:"THUMBORSECRET" flag:"thumbor-secret" secret:"true"`
+	MysqlServerHost     string                  `yaml:"mysql_host" env:"MYSQLSERVERHOST" flag:"mysql-host" required:"true" restart:"true"`
+	MysqlServerPort     string                  `yaml:"mysql_port" env:"MYSQLSERVERPORT" flag:"mysql-port" required:"true" restart:"true"`
+	MysqlServerUsername string                  `yaml:"mysql_username" env:"MYSQLSERVERUSERNAME" flag:"mysql-username" required:"true" restart:"true"`
+	MysqlServerPassword string                  `yaml:"mysql_password" env:"MYSQLSERVERPASSWORD" flag:"mysql-password" secret:"true" restart:"true"`
+	MysqlServerDatabase string                  `yaml:"mysql_database" env:"MYSQLSERVERDATABASE" flag:"mysql-database" required:"true" restart:"true"`
+	CdnOrigin           string                  `yaml:"cdn_origin" env:"CDNORIGIN" flag:"cdn-origin" required:"true"`
+	CdnPurgeURL         string                  `yaml:"cdn_purge_url" env:"CDNPURGEURL" flag:"cdn-purge-url"`
+	CdnPurgeToken       string                  `yaml:"cdn_purge_token" env:"CDNPURGETOKEN" flag:"cdn-purge-token" secret:"true"`
+	BucketName          string                  `yaml:"bucket_name" env:"BUCKETNAME" flag:"bucket-name"`
+	ResultStorage       string                  `yaml:"result_storage" env:"RESULTSTORAGE" flag:"result-storage"`
+	MediaStorage        string                  `yaml:"media_storage" env:"MEDIASTORAGE" flag:"media-storage"`
+	MediaEndpoint       string                  `yaml:"media_endpoint" env:"MEDIAENDPOINT" flag:"media-endpoint"`
+	MediaRegion         string                  `yaml:"media_region" env:"MEDIAREGION" flag:"media-region" restart:"true"`
+	SpaceKey            string                  `yaml:"space_key" env:"SPACEKEY" flag:"space-key" secret:"true" restart:"true"`
+	SpaceSecret         string                  `yaml:"space_secret" env:"SPACESECRET" flag:"space-secret" secret:"true" restart:"true"`
+	Storage             string                  `yaml:"storage" env:"STORAGE" flag:"storage" restart:"true"`
+	StoragePath         string                  `yaml:"storage_path" env:"STORAGEPATH" flag:"storage-path" restart:"true"`
+	MaxUploadSize       int64                   `yaml:"max_upload_size" env:"MAXUPLOADSIZE" flag:"max-upload-size"`
+	UploadFormats       string                  `yaml:"upload_formats" env:"UPLOADFORMATS" flag:"upload-formats"`
+	MaxUploadWidth      int64                   `yaml:"max_upload_width" env:"MAXUPLOADWIDTH" flag:"max-upload-width"`
+	MaxUploadHeight     int64                   `yaml:"max_upload_height" env:"MAXUPLOADHEIGHT" flag:"max-upload-height"`
+	MaxUploadPixels     int64                   `yaml:"max_upload_pixels" env:"MAXUPLOADPIXELS" flag:"max-upload-pixels"`
+	StripExif           bool                    `yaml:"strip_exif" env:"STRIPEXIF" flag:"strip-exif"`
+	UploadConflict      string                  `yaml:"upload_conflict" env:"UPLOADCONFLICT" flag:"upload-conflict"`
+	UploadTimeout       time.Duration           `yaml:"upload_timeout" env:"UPLOADTIMEOUT" flag:"upload-timeout"`
+	ProjectUploads      map[string]UploadPolicy `yaml:"project_uploads"`
+	UploadTokenSecret   string                  `yaml:"upload_token_secret" env:"UPLOADTOKENSECRET" flag:"upload-token-secret" secret:"true"`
+	LegacyUploadTokens  bool                    `yaml:"legacy_upload_tokens" env:"LEGACYUPLOADTOKENS" flag:"legacy-upload-tokens"`
+	Renderer            string                  `yaml:"renderer" env:"RENDERER" flag:"renderer"`
+	ImgproxyHost        string                  `yaml:"imgproxy_host" env:"IMGPROXYHOST" flag:"imgproxy-host"`
+	ImgproxyKey         string                  `yaml:"imgproxy_key" env:"IMGPROXYKEY" flag:"imgproxy-key" secret:"true"`
+	ImgproxySalt        string                  `yaml:"imgproxy_salt" env:"IMGPROXYSALT" flag:"imgproxy-salt" secret:"true"`
+	Balancer            string                  `yaml:"balancer" env:"BALANCER" flag:"balancer"`
+	RevalidateAfter     time.Duration           `yaml:"revalidate_after" env:"REVALIDATEAFTER" flag:"revalidate-after"`
+	ProjectCache        map[string]CachePolicy  `yaml:"project_cache"`
+	MaxAge              time.Duration           `yaml:"max_age" env:"MAXAGE" flag:"max-age"`
+	Widths              string                  `yaml:"widths" env:"WIDTHS" flag:"widths"`
+	URLSigningKey       string                  `yaml:"url_signing_key" env:"URLSIGNINGKEY" flag:"url-signing-key" secret:"true"`
+	CacheMemorySize     int64                   `yaml:"cache_memory_size" env:"CACHEMEMORYSIZE" flag:"cache-memory-size" restart:"true"`
+	CacheDir            string                  `yaml:"cache_dir" env:"CACHEDIR" flag:"cache-dir" restart:"true"`
+	CacheDiskSize       int64                   `yaml:"cache_disk_size" env:"CACHEDISKSIZE" flag:"cache-disk-size" restart:"true"`
+	CacheMaxEntry       int64                   `yaml:"cache_max_entry" env:"CACHEMAXENTRY" flag:"cache-max-entry" restart:"true"`
+	CacheMaxAge         time.Duration           `yaml:"cache_max_age" env:"CACHEMAXAGE" flag:"cache-max-age"`
+	Routes              []Route                 `yaml:"routes"`
 }
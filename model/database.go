@@ -31,6 +31,13 @@ type Image struct {
 	CdnPath        string
 	FileSize       int64
 	ImgURL         string
+	// OriginETag and OriginLastModified are the validators of the source
+	// when it was rendered, or last checked, at ValidatedAt (unix time).
+	OriginETag         string
+	OriginLastModified string
+	ValidatedAt        int64
+	// RenderedAt is when the image was rendered, as unix time.
+	RenderedAt int64
 }
 
 type Folder struct {
@@ -45,4 +52,28 @@ type Folder struct {
 	OriginalName string
 	MimeType     string
 	FileSize     int64
+	Width        int64
+	Height       int64
+	Format       string
+	// ConflictPolicy of a folder overrides the project's, see UploadPolicy.
+	ConflictPolicy string
+}
+
+type Upload struct {
+	ID              string
+	UploadToken     string
+	UserID          string
+	ProjectID       string
+	FolderID        string
+	FileName        string
+	Key             string
+	StorageUploadID string
+	OnConflict      string
+	Size            int64
+	Offset          int64
+	Parts           string
+	MimeType        string
+	Width           int64
+	Height          int64
+	Format          string
 }
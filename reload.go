@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/siddhartham/imageutil-thumbor/config"
+	"github.com/siddhartham/imageutil-thumbor/model"
+	"github.com/siddhartham/imageutil-thumbor/storage"
+	"github.com/siddhartham/imageutil-thumbor/util"
+)
+
+// liveHandler serves requests with the router built from the current
+// configuration. Reload swaps in a new router under live traffic, requests
+// already being served finish on the router they started on.
+type liveHandler struct {
+	args   []string
+	db     *sql.DB
+	store  storage.Storage
+	router atomic.Value
+
+	mu   sync.Mutex
+	sc   *model.ServerConf
+	stop func()
+}
+
+type routerState struct {
+	handler http.Handler
+	sc      *model.ServerConf
+}
+
+func newLiveHandler(args []string, sc *model.ServerConf, db *sql.DB, store storage.Storage) (*liveHandler, error) {
+	handler, stop, err := buildRouter(sc, db, store)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &liveHandler{args: args, db: db, store: store, sc: sc, stop: stop}
+	h.router.Store(routerState{handler: handler, sc: sc})
+	return h, nil
+}
+
+func (h *liveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.router.Load().(routerState).handler.ServeHTTP(w, r)
+}
+
+// Config returns the configuration currently in use.
+func (h *liveHandler) Config() *model.ServerConf {
+	return h.router.Load().(routerState).sc
+}
+
+// Close stops the renderer pools of the current router.
+func (h *liveHandler) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stop()
+}
+
+// Reload re-reads the configuration, rebuilds the route table and renderer
+// pools and swaps them in. On any error the current router is kept.
+func (h *liveHandler) Reload() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sc, err := config.Load(h.args)
+	if err != nil {
+		return err
+	}
+	if err := config.Validate(sc); err != nil {
+		return err
+	}
+	changes := config.Diff(h.sc, sc)
+	// the listener, the database connection and the storage stay as they are
+	config.KeepRestartSettings(sc, h.sc)
+
+	if len(changes) == 0 {
+		util.LogInfo("liveHandler : Reload", "configuration unchanged")
+	} else {
+		util.LogInfo("liveHandler : Reload", strings.Join(changes, "\n"))
+	}
+
+	handler, stop, err := buildRouter(sc, h.db, h.store)
+	if err != nil {
+		return err
+	}
+	h.router.Store(routerState{handler: handler, sc: sc})
+
+	h.stop()
+	h.sc = sc
+	h.stop = stop
+	return nil
+}
@@ -0,0 +1,143 @@
+package renderer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/siddhartham/imageutil-thumbor/util"
+)
+
+// ImgproxyRenderer forwards requests to an imgproxy instance, translating the
+// transformation into imgproxy processing options.
+//
+// brightness and contrast map to the adjust options of imgproxy pro, their
+// Thumbor percentages converted as the local renderer applies them: br is
+// -255..255 and co a multiplier, 1 leaving the image unchanged. rgb,
+// round_corner and noise have no imgproxy counterpart and are skipped.
+type ImgproxyRenderer struct {
+	Host string
+	Key  []byte
+	Salt []byte
+}
+
+// NewImgproxyRenderer returns an ImgproxyRenderer for the hex encoded key and
+// salt imgproxy is configured with. Without a key urls are left unsigned.
+func NewImgproxyRenderer(host string, key string, salt string) (*ImgproxyRenderer, error) {
+	keyBin, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid imgproxy key : %s", err.Error())
+	}
+	saltBin, err := hex.DecodeString(salt)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid imgproxy salt : %s", err.Error())
+	}
+
+	return &ImgproxyRenderer{
+		Host: host,
+		Key:  keyBin,
+		Salt: saltBin,
+	}, nil
+}
+
+func (ip *ImgproxyRenderer) Render(source string, t Transformation) (*Result, error) {
+	options := []string{}
+
+	//set the size and policy
+	resizingType := "fill"
+	if t.Policy == "fit" {
+		resizingType = "fit"
+	}
+	options = append(options, fmt.Sprintf("rs:%s:%d:%d", resizingType, t.Width, t.Height))
+
+	//set the gravity
+	if t.IsSmart {
+		options = append(options, "g:sm")
+	} else if t.Policy != "fit" {
+		options = append(options, fmt.Sprintf("g:%s", imgproxyGravity(t.Align())))
+	}
+
+	//set the quality
+	if t.Quality > 0 {
+		options = append(options, fmt.Sprintf("q:%d", t.Quality))
+	}
+	//set the format
+	if t.Format != "" {
+		options = append(options, fmt.Sprintf("f:%s", t.Format))
+	}
+	//set other effects
+	switch t.Effect {
+	case "":
+	case "brightness", "contrast":
+		v, err := strconv.ParseFloat(strings.TrimSpace(t.EffectArgs), 64)
+		if err != nil {
+			util.LogWarning("ImgproxyRenderer : Render", fmt.Sprintf("Invalid %s argument %q", t.Effect, t.EffectArgs))
+			break
+		}
+		v = math.Max(-100, math.Min(100, v))
+		if t.Effect == "brightness" {
+			options = append(options, fmt.Sprintf("br:%d", int(math.Round(255*v/100))))
+		} else {
+			factor := (100 + v) / 100
+			options = append(options, fmt.Sprintf("co:%s", strconv.FormatFloat(factor*factor, 'f', -1, 64)))
+		}
+	case "watermark":
+		options = append(options, "wm:1")
+	default:
+		util.LogWarning("ImgproxyRenderer : Render", fmt.Sprintf("Effect %s is not supported by imgproxy", t.Effect))
+	}
+
+	//imgproxy path
+	encodedSource := base64.RawURLEncoding.EncodeToString([]byte(source))
+	imgproxyPath := fmt.Sprintf("/%s/%s", strings.Join(options, "/"), encodedSource)
+
+	//final path
+	finalPath := fmt.Sprintf("/%s%s", ip.sign(imgproxyPath), imgproxyPath)
+
+	return &Result{
+		URL: &url.URL{
+			Scheme:  "http", //imgproxy is internal
+			Host:    ip.Host,
+			Path:    finalPath,
+			RawPath: finalPath,
+		},
+	}, nil
+}
+
+// sign calculates the imgproxy signature of path.
+func (ip *ImgproxyRenderer) sign(path string) string {
+	if len(ip.Key) == 0 {
+		return "insecure"
+	}
+	hash := hmac.New(sha256.New, ip.Key)
+	hash.Write(ip.Salt)
+	hash.Write([]byte(path))
+	return base64.RawURLEncoding.EncodeToString(hash.Sum(nil))
+}
+
+// imgproxyGravity maps the crop alignment to an imgproxy gravity type.
+func imgproxyGravity(halign string, valign string) string {
+	gravity := ""
+	switch valign {
+	case "top":
+		gravity = "no"
+	case "bottom":
+		gravity = "so"
+	}
+	switch halign {
+	case "left":
+		gravity = gravity + "we"
+	case "right":
+		gravity = gravity + "ea"
+	}
+	if gravity == "" {
+		return "ce"
+	}
+	return gravity
+}
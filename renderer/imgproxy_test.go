@@ -0,0 +1,114 @@
+package renderer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const (
+	testImgproxyKey  = "943b421c9eb07c830af81030552c86009268de4e532ba2ee2eab8247c6da0881"
+	testImgproxySalt = "520f986b998545b4785e0defbc4f3c1203f22de2374a3d53cb7a7fe9fea309c5"
+)
+
+// imgproxyStub answers like imgproxy does: 403 to urls not signed with the
+// test key and salt, else 200. It records the processing options of the
+// last url it was asked for.
+func imgproxyStub(t *testing.T, options *string) *httptest.Server {
+	t.Helper()
+	key, _ := hex.DecodeString(testImgproxyKey)
+	salt, _ := hex.DecodeString(testImgproxySalt)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/", 2)
+		if len(parts) != 2 {
+			http.Error(w, "Invalid path", http.StatusNotFound)
+			return
+		}
+		hash := hmac.New(sha256.New, key)
+		hash.Write(salt)
+		hash.Write([]byte("/" + parts[1]))
+		if parts[0] != base64.RawURLEncoding.EncodeToString(hash.Sum(nil)) {
+			http.Error(w, "Invalid signature", http.StatusForbidden)
+			return
+		}
+		*options = parts[1][:strings.LastIndex(parts[1], "/")]
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestImgproxyRendererSignedPath(t *testing.T) {
+	var options string
+	srv := imgproxyStub(t, &options)
+	ip, err := NewImgproxyRenderer(strings.TrimPrefix(srv.URL, "http://"), testImgproxyKey, testImgproxySalt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		transformation string
+		isSmart        bool
+		options        string
+	}{
+		{"s:300x200", false, "rs:fill:300:200/g:ce"},
+		{"s:300x200,p:crop-top-left,q:80,f:webp", false, "rs:fill:300:200/g:nowe/q:80/f:webp"},
+		{"s:300x200,p:fit", false, "rs:fit:300:200"},
+		{"s:300x200", true, "rs:fill:300:200/g:sm"},
+		{"s:300x200,e:brightness(20)", false, "rs:fill:300:200/g:ce/br:51"},
+		{"s:300x200,e:brightness(-100)", false, "rs:fill:300:200/g:ce/br:-255"},
+		// 0 leaves the image unchanged, -100 flattens it to grey
+		{"s:300x200,e:contrast(0)", false, "rs:fill:300:200/g:ce/co:1"},
+		{"s:300x200,e:contrast(50)", false, "rs:fill:300:200/g:ce/co:2.25"},
+		{"s:300x200,e:contrast(-100)", false, "rs:fill:300:200/g:ce/co:0"},
+		{"s:300x200,e:rgb(10,0,0)", false, "rs:fill:300:200/g:ce"},
+	}
+	for _, tt := range tests {
+		transformation, err := ParseTransformation(tt.transformation, tt.isSmart)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := ip.Render("https://example.com/images/cat.jpg", transformation)
+		if err != nil {
+			t.Errorf("%s: %v", tt.transformation, err)
+			continue
+		}
+
+		options = ""
+		resp, err := http.Get(result.URL.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: imgproxy answered %s", tt.transformation, resp.Status)
+			continue
+		}
+		if options != tt.options {
+			t.Errorf("%s: got options %q, want %q", tt.transformation, options, tt.options)
+		}
+	}
+}
+
+func TestImgproxyRendererUnsigned(t *testing.T) {
+	ip, err := NewImgproxyRenderer("imgproxy:8080", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transformation, _ := ParseTransformation("s:300x200", false)
+	result, err := ip.Render("https://example.com/cat.jpg", transformation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := base64.RawURLEncoding.EncodeToString([]byte("https://example.com/cat.jpg"))
+	if want := "/insecure/rs:fill:300:200/g:ce/" + source; result.URL.Path != want {
+		t.Errorf("got path %q, want %q", result.URL.Path, want)
+	}
+}
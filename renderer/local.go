@@ -0,0 +1,298 @@
+package renderer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/siddhartham/imageutil-thumbor/util"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	MB = 1 << 20
+)
+
+// LocalRenderer renders images in-process with pure Go decoders and
+// encoders, so no Thumbor (and its Python/OpenCV stack) is needed.
+//
+// It implements the subset of the transformation DSL we use: size, crop and
+// fit policies with alignment, quality, format and the brightness, contrast
+// and rgb effects. Smart cropping falls back to a centered crop and WebP
+// output falls back to JPEG, or PNG for images with transparency.
+type LocalRenderer struct {
+	Client         *http.Client
+	MaxSourceBytes int64
+	// MaxSourcePixels bounds the sources decoded, checked from their
+	// header first, so a small but highly compressed file cannot take all
+	// the memory once decoded.
+	MaxSourcePixels int64
+	MaxWidth        int
+	MaxHeight       int
+	Quality         int
+}
+
+// NewLocalRenderer returns a LocalRenderer with the same limits and defaults
+// as conf/thumbor.conf.example.
+func NewLocalRenderer() *LocalRenderer {
+	return &LocalRenderer{
+		Client:          &http.Client{Timeout: 10 * time.Second},
+		MaxSourceBytes:  20 * MB,
+		MaxSourcePixels: 25000000,
+		MaxWidth:        1200,
+		MaxHeight:       800,
+		Quality:         90,
+	}
+}
+
+func (l *LocalRenderer) Render(source string, t Transformation) (*Result, error) {
+	src, srcFormat, err := l.fetch(source)
+	if err != nil {
+		return nil, err
+	}
+
+	dst := l.resize(src, t)
+
+	if err := applyEffect(dst, t); err != nil {
+		util.LogWarning("LocalRenderer : applyEffect", err.Error())
+	}
+
+	format := t.Format
+	if format == "" {
+		format = srcFormat
+	}
+
+	var buf bytes.Buffer
+	contentType, err := l.encode(&buf, dst, format, t.Quality)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{
+		Body:        ioutil.NopCloser(&buf),
+		ContentType: contentType,
+		Size:        int64(buf.Len()),
+	}, nil
+}
+
+func (l *LocalRenderer) fetch(source string) (image.Image, string, error) {
+	resp, err := l.Client.Get(source)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("Source returned %s", resp.Status)
+	}
+
+	body := io.LimitReader(resp.Body, l.MaxSourceBytes+1)
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > l.MaxSourceBytes {
+		return nil, "", errors.New("Source image is too large")
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if pixels := int64(config.Width) * int64(config.Height); pixels > l.MaxSourcePixels {
+		return nil, "", fmt.Errorf("Source image has %d pixels, the maximum is %d", pixels, l.MaxSourcePixels)
+	}
+
+	return image.Decode(bytes.NewReader(data))
+}
+
+// resize scales src to the requested size. Without a policy, or with crop,
+// the image fills the box and the overflow is cropped according to the
+// alignment; with fit the whole image is scaled to fit inside the box.
+func (l *LocalRenderer) resize(src image.Image, t Transformation) *image.NRGBA {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+
+	width, height := t.Width, t.Height
+	if width == 0 && height == 0 {
+		width, height = srcW, srcH
+	} else if width == 0 {
+		width = int(math.Round(float64(srcW) * float64(height) / float64(srcH)))
+	} else if height == 0 {
+		height = int(math.Round(float64(srcH) * float64(width) / float64(srcW)))
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+
+	region := bounds
+	if t.Policy == "fit" {
+		scale := math.Min(float64(width)/float64(srcW), float64(height)/float64(srcH))
+		if scale > 1 {
+			scale = 1
+		}
+		width = int(math.Round(float64(srcW) * scale))
+		height = int(math.Round(float64(srcH) * scale))
+	} else {
+		region = cropRegion(bounds, width, height, t)
+	}
+
+	width, height = l.clamp(width, height)
+
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, region, draw.Src, nil)
+	return dst
+}
+
+// clamp keeps the output within MaxWidth x MaxHeight, preserving the aspect ratio.
+func (l *LocalRenderer) clamp(width int, height int) (int, int) {
+	scale := 1.0
+	if l.MaxWidth > 0 && width > l.MaxWidth {
+		scale = math.Min(scale, float64(l.MaxWidth)/float64(width))
+	}
+	if l.MaxHeight > 0 && height > l.MaxHeight {
+		scale = math.Min(scale, float64(l.MaxHeight)/float64(height))
+	}
+	width = int(math.Max(1, math.Round(float64(width)*scale)))
+	height = int(math.Max(1, math.Round(float64(height)*scale)))
+	return width, height
+}
+
+// cropRegion returns the part of bounds with the aspect ratio of
+// width x height, positioned by the transformation's alignment.
+func cropRegion(bounds image.Rectangle, width int, height int, t Transformation) image.Rectangle {
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	cropW, cropH := srcW, srcH
+	if srcW*height > srcH*width {
+		cropW = srcH * width / height
+	} else {
+		cropH = srcW * height / width
+	}
+
+	halign, valign := t.Align()
+	x, y := 0, 0
+	switch halign {
+	case "center":
+		x = (srcW - cropW) / 2
+	case "right":
+		x = srcW - cropW
+	}
+	switch valign {
+	case "middle":
+		y = (srcH - cropH) / 2
+	case "bottom":
+		y = srcH - cropH
+	}
+
+	origin := bounds.Min.Add(image.Pt(x, y))
+	return image.Rectangle{Min: origin, Max: origin.Add(image.Pt(cropW, cropH))}
+}
+
+// applyEffect applies the brightness, contrast and rgb effects, using the
+// same -100..100 percentage arguments as the Thumbor filters.
+func applyEffect(img *image.NRGBA, t Transformation) error {
+	if t.Effect == "" {
+		return nil
+	}
+
+	args := []float64{}
+	for _, arg := range strings.Split(t.EffectArgs, ",") {
+		if arg = strings.TrimSpace(arg); arg == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid %s argument %q", t.Effect, arg)
+		}
+		args = append(args, v)
+	}
+
+	var adjust func(c, i int) float64
+	switch t.Effect {
+	case "brightness":
+		if len(args) != 1 {
+			return errors.New("brightness expects 1 argument")
+		}
+		adjust = func(c, i int) float64 { return float64(c) + 255*args[0]/100 }
+	case "contrast":
+		if len(args) != 1 {
+			return errors.New("contrast expects 1 argument")
+		}
+		factor := (100 + args[0]) / 100
+		factor = factor * factor
+		adjust = func(c, i int) float64 { return (float64(c)-128)*factor + 128 }
+	case "rgb":
+		if len(args) != 3 {
+			return errors.New("rgb expects 3 arguments")
+		}
+		adjust = func(c, i int) float64 { return float64(c) + 255*args[i]/100 }
+	default:
+		return fmt.Errorf("Effect %s is not supported by the local renderer", t.Effect)
+	}
+
+	for i := 0; i < len(img.Pix); i += 4 {
+		for c := 0; c < 3; c++ {
+			img.Pix[i+c] = clampUint8(adjust(int(img.Pix[i+c]), c))
+		}
+	}
+	return nil
+}
+
+func clampUint8(v float64) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(math.Round(v))
+}
+
+func (l *LocalRenderer) encode(w io.Writer, img *image.NRGBA, format string, quality int) (string, error) {
+	if format == "webp" || format == "avif" {
+		// there is no pure Go webp or avif encoder
+		format = "jpeg"
+		if !img.Opaque() {
+			format = "png"
+		}
+	}
+
+	switch format {
+	case "png":
+		return "image/png", png.Encode(w, img)
+	case "gif":
+		return "image/gif", gif.Encode(w, img, nil)
+	default:
+		if quality <= 0 || quality > 100 {
+			quality = l.Quality
+		}
+		return "image/jpeg", jpeg.Encode(w, flatten(img), &jpeg.Options{Quality: quality})
+	}
+}
+
+// flatten composes img onto a white background, as jpeg has no alpha channel.
+func flatten(img *image.NRGBA) image.Image {
+	if img.Opaque() {
+		return img
+	}
+	dst := image.NewRGBA(img.Bounds())
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Over)
+	return dst
+}
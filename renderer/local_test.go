@@ -0,0 +1,140 @@
+package renderer
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// sourceServer serves a width x height grey PNG at /source.png.
+func sourceServer(t *testing.T, width int, height int) *httptest.Server {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = 128
+		if i%4 == 3 {
+			img.Pix[i] = 255
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/source.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(buf.Bytes())
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func render(t *testing.T, l *LocalRenderer, source string, str string) (image.Image, string, error) {
+	t.Helper()
+	transformation, err := ParseTransformation(str, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := l.Render(source, transformation)
+	if err != nil {
+		return nil, "", err
+	}
+	defer result.Body.Close()
+	img, _, err := image.Decode(result.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img, result.ContentType, nil
+}
+
+func TestLocalRendererRender(t *testing.T) {
+	srv := sourceServer(t, 400, 200)
+	tests := []struct {
+		transformation string
+		width, height  int
+		contentType    string
+	}{
+		{"s:100x100", 100, 100, "image/png"},
+		{"s:100x100,p:crop-top-left,f:jpeg,q:80", 100, 100, "image/jpeg"},
+		{"s:100x100,p:fit", 100, 50, "image/png"},
+		{"s:200x", 200, 100, "image/png"},
+		{"s:x50,f:webp", 100, 50, "image/jpeg"},
+		// clamped to MaxWidth x MaxHeight
+		{"s:2400x1200", 1200, 600, "image/png"},
+	}
+	for _, tt := range tests {
+		img, contentType, err := render(t, NewLocalRenderer(), srv.URL+"/source.png", tt.transformation)
+		if err != nil {
+			t.Errorf("%s: %v", tt.transformation, err)
+			continue
+		}
+		if size := img.Bounds().Size(); size.X != tt.width || size.Y != tt.height {
+			t.Errorf("%s: got %dx%d, want %dx%d", tt.transformation, size.X, size.Y, tt.width, tt.height)
+		}
+		if contentType != tt.contentType {
+			t.Errorf("%s: got %s, want %s", tt.transformation, contentType, tt.contentType)
+		}
+	}
+}
+
+func TestLocalRendererEffect(t *testing.T) {
+	srv := sourceServer(t, 10, 10)
+	tests := []struct {
+		transformation string
+		want           uint8
+	}{
+		{"s:10x10,e:brightness(100)", 255},
+		{"s:10x10,e:brightness(-100)", 0},
+		{"s:10x10,e:contrast(0)", 128},
+		{"s:10x10,e:rgb(-100,0,0)", 0},
+	}
+	for _, tt := range tests {
+		img, _, err := render(t, NewLocalRenderer(), srv.URL+"/source.png", tt.transformation)
+		if err != nil {
+			t.Errorf("%s: %v", tt.transformation, err)
+			continue
+		}
+		r, _, _, _ := img.At(5, 5).RGBA()
+		if got := uint8(r >> 8); got != tt.want {
+			t.Errorf("%s: got red %d, want %d", tt.transformation, got, tt.want)
+		}
+	}
+}
+
+func TestLocalRendererSourceLimits(t *testing.T) {
+	srv := sourceServer(t, 400, 200)
+
+	l := NewLocalRenderer()
+	l.MaxSourcePixels = 400*200 - 1
+	if _, _, err := render(t, l, srv.URL+"/source.png", "s:100x100"); err == nil || !strings.Contains(err.Error(), "pixels") {
+		t.Errorf("source over MaxSourcePixels: got %v, want a pixels error", err)
+	}
+
+	l = NewLocalRenderer()
+	l.MaxSourceBytes = 10
+	if _, _, err := render(t, l, srv.URL+"/source.png", "s:100x100"); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("source over MaxSourceBytes: got %v, want a too large error", err)
+	}
+
+	if _, _, err := render(t, NewLocalRenderer(), srv.URL+"/missing.png", "s:100x100"); err == nil {
+		t.Error("missing source: got no error")
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{})
+	r, g, b, _ := flatten(img).At(0, 0).RGBA()
+	if r != 0xffff || g != 0xffff || b != 0xffff {
+		t.Errorf("transparent pixel flattened to %d,%d,%d, want white", r>>8, g>>8, b>>8)
+	}
+}
@@ -0,0 +1,47 @@
+package renderer
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+
+	"github.com/siddhartham/imageutil-thumbor/model"
+)
+
+const (
+	Thumbor  = "thumbor"
+	Imgproxy = "imgproxy"
+	Local    = "local"
+)
+
+// Result is what a Renderer hands back to the proxy. Renderers backed by
+// another service set URL and the proxy forwards the request there, with
+// Key and CdnPath telling where that service keeps the rendered image.
+// In-process renderers set Body instead and the proxy streams it.
+type Result struct {
+	URL         *url.URL
+	Key         string
+	CdnPath     string
+	Body        io.ReadCloser
+	ContentType string
+	Size        int64
+}
+
+// Renderer renders the image found at source with the given transformation.
+type Renderer interface {
+	Render(source string, t Transformation) (*Result, error)
+}
+
+// New returns the renderer configured for the route.
+func New(conf model.Config) (Renderer, error) {
+	switch conf.Renderer {
+	case "", Thumbor:
+		return NewThumborRenderer(conf.Host, conf.Secret, conf.ResultStorage), nil
+	case Imgproxy:
+		return NewImgproxyRenderer(conf.ImgproxyHost, conf.ImgproxyKey, conf.ImgproxySalt)
+	case Local:
+		return NewLocalRenderer(), nil
+	default:
+		return nil, fmt.Errorf("Unknown renderer %q", conf.Renderer)
+	}
+}
@@ -0,0 +1,98 @@
+package renderer
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+)
+
+// keyExp matches what the result storage key replaces in a signature.
+var keyExp = regexp.MustCompile("[^a-zA-Z0-9]+")
+
+// ThumborRenderer forwards requests to a Thumbor instance, which stores the
+// rendered image in result storage.
+type ThumborRenderer struct {
+	Host          string
+	Secret        string
+	ResultStorage string
+}
+
+func NewThumborRenderer(host string, secret string, resultStorage string) *ThumborRenderer {
+	return &ThumborRenderer{
+		Host:          host,
+		Secret:        secret,
+		ResultStorage: resultStorage,
+	}
+}
+
+func (th *ThumborRenderer) Render(source string, t Transformation) (*Result, error) {
+	//set the size, a side left out stays empty as it is in the url
+	transformationStr := fmt.Sprintf("%sx%s", sizeString(t.Width), sizeString(t.Height))
+
+	//set the policy
+	if t.Policy != "" {
+		switch t.Policy {
+		case "fit":
+			transformationStr = fmt.Sprintf("fit-in/%s", transformationStr)
+		default:
+			transformationStr = fmt.Sprintf("trim/%s", transformationStr)
+		}
+		HALIGN, VALIGN := t.Align()
+		transformationStr = fmt.Sprintf("%s/%s/%s", transformationStr, HALIGN, VALIGN)
+	}
+
+	//set smart detect
+	if t.IsSmart {
+		transformationStr = fmt.Sprintf("%s/smart", transformationStr)
+	}
+
+	//filters
+	filters := ""
+	//set the quality
+	if t.Quality > 0 {
+		filters = fmt.Sprintf("%s:quality(%d)", filters, t.Quality)
+	}
+	//set the format
+	if t.Format != "" {
+		filters = fmt.Sprintf("%s:format(%s)", filters, t.Format)
+	}
+	//set other effects
+	if t.Effect != "" {
+		filters = fmt.Sprintf("%s:%s(%s)", filters, t.Effect, t.EffectArgs)
+	}
+	//set the filters
+	if filters != "" {
+		transformationStr = fmt.Sprintf("%s/filters%s", transformationStr, filters)
+	}
+
+	//thumbor path
+	thumborPath := fmt.Sprintf("%s/%s", transformationStr, source)
+
+	//calculate signature
+	hash := hmac.New(sha1.New, []byte(th.Secret))
+	hash.Write([]byte(thumborPath))
+	message := hash.Sum(nil)
+	signature := base64.URLEncoding.EncodeToString(message)
+
+	//final path
+	finalPath := fmt.Sprintf("/%s/%s", signature, thumborPath)
+
+	//cdn path
+	_, fileName := path.Split(source)
+	processedKey := keyExp.ReplaceAllString(signature, "_")
+
+	return &Result{
+		URL: &url.URL{
+			Scheme:  "http", //thumbor is internal
+			Host:    th.Host,
+			Path:    finalPath,
+			RawPath: finalPath,
+		},
+		Key:     signature,
+		CdnPath: fmt.Sprintf("/%s/%s/%s", th.ResultStorage, processedKey, fileName),
+	}, nil
+}
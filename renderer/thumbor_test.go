@@ -0,0 +1,52 @@
+package renderer
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"testing"
+)
+
+func TestThumborRendererPath(t *testing.T) {
+	th := NewThumborRenderer("thumbor:8888", "secret", "result_storage")
+	source := "https://example.com/images/cat.jpg"
+	tests := []struct {
+		transformation string
+		isSmart        bool
+		path           string
+	}{
+		// the paths the renderer sent before it was behind the interface
+		{"s:300x200", false, "300x200"},
+		{"s:300x", false, "300x"},
+		{"s:x200", false, "x200"},
+		{"s:300x200,p:crop", false, "trim/300x200/left/top"},
+		{"s:300x200,p:fit-middle-center", false, "fit-in/300x200/center/middle"},
+		{"s:300x200", true, "300x200/smart"},
+		{"s:300x200,q:80,f:webp", false, "300x200/filters:quality(80):format(webp)"},
+		{"s:300x200,e:brightness(10)", false, "300x200/filters:brightness(10)"},
+	}
+	for _, tt := range tests {
+		transformation, err := ParseTransformation(tt.transformation, tt.isSmart)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := th.Render(source, transformation)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		thumborPath := tt.path + "/" + source
+		hash := hmac.New(sha1.New, []byte("secret"))
+		hash.Write([]byte(thumborPath))
+		signature := base64.URLEncoding.EncodeToString(hash.Sum(nil))
+		if want := "/" + signature + "/" + thumborPath; result.URL.Path != want {
+			t.Errorf("%s: got path %q, want %q", tt.transformation, result.URL.Path, want)
+		}
+		if result.Key != signature {
+			t.Errorf("%s: got key %q, want %q", tt.transformation, result.Key, signature)
+		}
+		if want := "/result_storage/" + keyExp.ReplaceAllString(signature, "_") + "/cat.jpg"; result.CdnPath != want {
+			t.Errorf("%s: got cdn path %q, want %q", tt.transformation, result.CdnPath, want)
+		}
+	}
+}
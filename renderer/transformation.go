@@ -0,0 +1,285 @@
+package renderer
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// FormatAuto is the format negotiated from the Accept header of a request.
+const FormatAuto = "auto"
+
+var (
+	sizeExp    = regexp.MustCompile(`s:(\d*)x(\d*)`)
+	policyExp  = regexp.MustCompile(`p:(crop|fit)-?(top|middle|bottom)?-?(left|center|right)?`)
+	qualityExp = regexp.MustCompile(`q:(\d*)`)
+	formatExp  = regexp.MustCompile(`f:(webp|avif|jpeg|gif|png|auto)`)
+	effectExp  = regexp.MustCompile(`e:(brightness|contrast|rgb|round_corner|noise|watermark)\(?([^\)]*)?\)`)
+	dprExp     = regexp.MustCompile(`dpr:(auto|\d+(?:\.\d+)?)`)
+	autoExp    = regexp.MustCompile(`s:auto`)
+)
+
+// MaxDPR is the highest device pixel ratio images are rendered for.
+const MaxDPR = 4
+
+// Transformation is the parsed form of the transformation segment of a
+// proxy url, e.g. "s:300x200,p:crop-top-left,q:80,f:webp,e:brightness(10)".
+type Transformation struct {
+	Raw        string
+	Width      int
+	Height     int
+	Policy     string
+	VAlign     string
+	HAlign     string
+	IsSmart    bool
+	Quality    int
+	Format     string
+	Effect     string
+	EffectArgs string
+}
+
+// ParseTransformation parses the transformation DSL used in proxy urls.
+// A size is mandatory, everything else is optional.
+func ParseTransformation(str string, isSmart bool) (Transformation, error) {
+	t := Transformation{Raw: str, IsSmart: isSmart}
+
+	size := sizeExp.FindStringSubmatch(str)
+	if size == nil {
+		return t, errors.New("Transformation has no size")
+	}
+	t.Width, _ = strconv.Atoi(size[1])
+	t.Height, _ = strconv.Atoi(size[2])
+
+	if policy := policyExp.FindStringSubmatch(str); policy != nil {
+		t.Policy = policy[1]
+		t.VAlign = policy[2]
+		t.HAlign = policy[3]
+	}
+
+	if quality := qualityExp.FindStringSubmatch(str); quality != nil {
+		t.Quality, _ = strconv.Atoi(quality[1])
+	}
+
+	if format := formatExp.FindStringSubmatch(str); format != nil {
+		t.Format = format[1]
+	}
+
+	if effect := effectExp.FindStringSubmatch(str); effect != nil {
+		t.Effect = effect[1]
+		t.EffectArgs = effect[2]
+	}
+
+	return t, nil
+}
+
+// NegotiateFormat replaces an f:auto format in the transformation str with
+// the best format the client accepts: AVIF, then WebP, then PNG for
+// sources that may be transparent (by their extension) or JPEG. It
+// reports whether the format was negotiated, so the response varies by
+// Accept.
+func NegotiateFormat(str string, accept string, source string) (string, bool) {
+	format := formatExp.FindStringSubmatch(str)
+	if format == nil || format[1] != FormatAuto {
+		return str, false
+	}
+
+	negotiated := "jpeg"
+	switch {
+	case accepts(accept, "image/avif"):
+		negotiated = "avif"
+	case accepts(accept, "image/webp"):
+		negotiated = "webp"
+	case mayBeTransparent(source):
+		negotiated = "png"
+	}
+	return strings.Replace(str, format[0], "f:"+negotiated, 1), true
+}
+
+// accepts reports whether the Accept header lists mediaType, with a
+// quality above 0. Wildcards do not count, browsers list the image formats
+// they support.
+func accepts(accept string, mediaType string) bool {
+	for _, item := range strings.Split(accept, ",") {
+		params := strings.Split(item, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), mediaType) {
+			continue
+		}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// mayBeTransparent reports whether the source is in a format with alpha.
+func mayBeTransparent(source string) bool {
+	if i := strings.IndexAny(source, "?#"); i >= 0 {
+		source = source[:i]
+	}
+	switch strings.ToLower(path.Ext(source)) {
+	case ".png", ".gif", ".webp", ".avif", ".svg":
+		return true
+	}
+	return false
+}
+
+// Hints are the client hints a request came with, 0 when not sent.
+type Hints struct {
+	DPR           float64
+	Width         int
+	ViewportWidth int
+}
+
+// ClientHints returns the Sec-CH-DPR, Sec-CH-Width and
+// Sec-CH-Viewport-Width hints of a request, or their legacy DPR, Width and
+// Viewport-Width forms, which older browsers send.
+func ClientHints(header http.Header) Hints {
+	hints := Hints{}
+	hints.DPR, _ = strconv.ParseFloat(hint(header, "DPR"), 64)
+	hints.Width, _ = strconv.Atoi(hint(header, "Width"))
+	hints.ViewportWidth, _ = strconv.Atoi(hint(header, "Viewport-Width"))
+	return hints
+}
+
+func hint(header http.Header, name string) string {
+	if value := header.Get("Sec-CH-" + name); value != "" {
+		return value
+	}
+	return header.Get(name)
+}
+
+// ResolveSize turns the dpr and s:auto of the transformation str into a
+// plain s:WxH, so it renders and is indexed as one. dpr:N scales the size,
+// dpr:auto by the Sec-CH-DPR hint. s:auto takes the width of the
+// Sec-CH-Width hint, or of the viewport, and keeps the aspect ratio;
+// without hints it is the largest width. Scaled and hinted widths are
+// snapped up to the next of widths, sorted ascending, so few variants are
+// rendered. Like ParseTransformation it finds them anywhere in str, with
+// whatever separates them. It reports whether hints were used, so the
+// response varies by them.
+func ResolveSize(str string, hints Hints, widths []int) (string, bool) {
+	dpr, scaled, used := 1.0, false, false
+	for {
+		match := dprExp.FindStringSubmatchIndex(str)
+		if match == nil {
+			break
+		}
+		if value := str[match[2]:match[3]]; value == "auto" {
+			used = true
+			if hints.DPR > 0 {
+				dpr = hints.DPR
+			}
+		} else {
+			dpr, _ = strconv.ParseFloat(value, 64)
+		}
+		str, scaled = removeToken(str, match[0], match[1]), true
+	}
+	auto := autoExp.FindStringIndex(str)
+	if !scaled && auto == nil {
+		return str, false
+	}
+	// half steps between 1 and MaxDPR
+	dpr = math.Max(1, math.Min(MaxDPR, math.Round(dpr*2)/2))
+
+	var width, height int
+	at := auto
+	if auto != nil {
+		used = true
+		switch {
+		case hints.Width > 0:
+			width = snapWidth(hints.Width, widths)
+		case hints.ViewportWidth > 0:
+			width = snapWidth(int(math.Ceil(float64(hints.ViewportWidth)*dpr)), widths)
+		case len(widths) > 0:
+			width = widths[len(widths)-1]
+		}
+	} else {
+		size := sizeExp.FindStringSubmatchIndex(str)
+		if size == nil || dpr == 1 {
+			return str, used
+		}
+		width, _ = strconv.Atoi(str[size[2]:size[3]])
+		height, _ = strconv.Atoi(str[size[4]:size[5]])
+		if width > 0 {
+			scaledWidth := snapWidth(int(math.Ceil(float64(width)*dpr)), widths)
+			height = int(math.Round(float64(height) * float64(scaledWidth) / float64(width)))
+			width = scaledWidth
+		} else {
+			height = int(math.Round(float64(height) * dpr))
+		}
+		at = size[:2]
+	}
+	return str[:at[0]] + fmt.Sprintf("s:%sx%s", sizeString(width), sizeString(height)) + str[at[1]:], used
+}
+
+// removeToken cuts str[start:end] out of str with the separator before it,
+// or after it when it is the first token.
+func removeToken(str string, start int, end int) string {
+	if start > 0 && isSeparator(str[start-1]) {
+		start--
+	} else if end < len(str) && isSeparator(str[end]) {
+		end++
+	}
+	return str[:start] + str[end:]
+}
+
+func isSeparator(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return false
+	case c == ':' || c == '(' || c == ')':
+		return false
+	}
+	return true
+}
+
+// snapWidth returns the first of widths at least width, or the largest.
+// Without widths, width is kept as it is.
+func snapWidth(width int, widths []int) int {
+	largest := 0
+	for _, w := range widths {
+		if w >= width {
+			return w
+		}
+		if w > largest {
+			largest = w
+		}
+	}
+	if largest == 0 {
+		return width
+	}
+	return largest
+}
+
+func sizeString(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+// Align returns the horizontal and vertical alignment used when cropping.
+// Without a policy the image is centered, with one it defaults to top left.
+func (t Transformation) Align() (string, string) {
+	if t.Policy == "" {
+		return "center", "middle"
+	}
+	halign, valign := "left", "top"
+	if t.HAlign != "" {
+		halign = t.HAlign
+	}
+	if t.VAlign != "" {
+		valign = t.VAlign
+	}
+	return halign, valign
+}
@@ -0,0 +1,90 @@
+package renderer
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestResolveSize(t *testing.T) {
+	widths := []int{320, 640, 1280}
+	tests := []struct {
+		name  string
+		str   string
+		hints Hints
+		want  string
+		used  bool
+	}{
+		{"plain size", "s:300x200,q:80", Hints{}, "s:300x200,q:80", false},
+		{"dpr 1", "s:300x200,dpr:1", Hints{}, "s:300x200", false},
+		{"dpr 2 snapped", "s:300x200,dpr:2", Hints{}, "s:640x427", false},
+		{"dpr first", "dpr:2,s:300x200,q:80", Hints{}, "s:640x427,q:80", false},
+		{"dpr capped", "s:300x200,dpr:9", Hints{}, "s:1280x853", false},
+		{"dpr height only", "s:x100,dpr:2", Hints{}, "s:x200", false},
+		{"dpr auto", "s:300x200,dpr:auto", Hints{DPR: 2}, "s:640x427", true},
+		{"dpr auto without hint", "s:300x200,dpr:auto", Hints{}, "s:300x200", true},
+		{"auto width hint", "s:auto,q:80", Hints{Width: 500}, "s:640x,q:80", true},
+		{"auto viewport", "s:auto", Hints{ViewportWidth: 400}, "s:640x", true},
+		{"auto viewport dpr", "s:auto,dpr:auto", Hints{ViewportWidth: 400, DPR: 2}, "s:1280x", true},
+		{"auto without hints", "s:auto", Hints{}, "s:1280x", true},
+		// the DSL takes any separator, or none
+		{"slash separated", "s:300x200/dpr:2/q:80", Hints{}, "s:640x427/q:80", false},
+		{"dash separated", "dpr:2-s:300x200", Hints{}, "s:640x427", false},
+		{"semicolon separated", "s:auto;q:80", Hints{Width: 300}, "s:320x;q:80", true},
+		{"no separator", "s:300x200dpr:2q:80", Hints{}, "s:640x427q:80", false},
+		{"effect args kept", "s:300x200,e:rgb(10,0,0),dpr:2", Hints{}, "s:640x427,e:rgb(10,0,0)", false},
+	}
+	for _, tt := range tests {
+		got, used := ResolveSize(tt.str, tt.hints, widths)
+		if got != tt.want || used != tt.used {
+			t.Errorf("%s: ResolveSize(%q) = %q, %t, want %q, %t", tt.name, tt.str, got, used, tt.want, tt.used)
+		}
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	chrome := "image/avif,image/webp,image/apng,image/*,*/*;q=0.8"
+	tests := []struct {
+		name   string
+		str    string
+		accept string
+		source string
+		want   string
+		used   bool
+	}{
+		{"avif", "s:300x200,f:auto", chrome, "a.jpg", "s:300x200,f:avif", true},
+		{"webp", "f:auto", "image/webp,*/*", "a.jpg", "f:webp", true},
+		{"avif refused", "f:auto", "image/avif;q=0,image/webp", "a.jpg", "f:webp", true},
+		{"quality kept", "f:auto", "image/webp;q=0.5", "a.jpg", "f:webp", true},
+		{"wildcard only", "f:auto", "image/*,*/*;q=0.8", "a.jpg", "f:jpeg", true},
+		{"no accept", "f:auto", "", "a.jpg", "f:jpeg", true},
+		{"transparent source", "f:auto", "*/*", "a/b.PNG", "f:png", true},
+		{"transparent with query", "f:auto", "*/*", "http://x.io/b.gif?v=1", "f:png", true},
+		{"opaque with png query", "f:auto", "*/*", "b.jpg?x=.png", "f:jpeg", true},
+		{"explicit format", "s:300x200,f:webp", "image/avif", "a.jpg", "s:300x200,f:webp", false},
+		{"no format", "s:300x200", "image/avif", "a.jpg", "s:300x200", false},
+	}
+	for _, tt := range tests {
+		got, used := NegotiateFormat(tt.str, tt.accept, tt.source)
+		if got != tt.want || used != tt.used {
+			t.Errorf("%s: NegotiateFormat(%q) = %q, %t, want %q, %t", tt.name, tt.str, got, used, tt.want, tt.used)
+		}
+	}
+}
+
+func TestResolveSizeWithoutWidths(t *testing.T) {
+	if got, _ := ResolveSize("s:300x200,dpr:1.5", Hints{}, nil); got != "s:450x300" {
+		t.Errorf("got %q, want s:450x300", got)
+	}
+}
+
+func TestClientHints(t *testing.T) {
+	header := http.Header{}
+	header.Set("Sec-CH-DPR", "2")
+	header.Set("Width", "640")
+	header.Set("Viewport-Width", "800")
+	header.Set("Sec-CH-Viewport-Width", "1024")
+	want := Hints{DPR: 2, Width: 640, ViewportWidth: 1024}
+	if got := ClientHints(header); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/cors"
+	"github.com/siddhartham/imageutil-thumbor/action"
+	"github.com/siddhartham/imageutil-thumbor/balancer"
+	"github.com/siddhartham/imageutil-thumbor/config"
+	"github.com/siddhartham/imageutil-thumbor/model"
+	"github.com/siddhartham/imageutil-thumbor/renderer"
+	"github.com/siddhartham/imageutil-thumbor/storage"
+	"github.com/siddhartham/imageutil-thumbor/util"
+)
+
+// healthPaths are the health check endpoints of the renderer services.
+var healthPaths = map[string]string{
+	renderer.Thumbor:  "/healthcheck",
+	renderer.Imgproxy: "/health",
+}
+
+// buildRouter builds the handler serving the fixed routes and the proxy
+// routes of sc. The returned stop function stops the health checks of its
+// renderer pools once the handler is no longer used.
+func buildRouter(sc *model.ServerConf, db *sql.DB, store storage.Storage) (http.Handler, func(), error) {
+	//main router
+	r := mux.NewRouter()
+
+	//fixed routes
+	r.HandleFunc("/health", action.HealthCheckHandler)
+	r.HandleFunc("/upload/{uploadToken}", uploadDeadline(sc, func(w http.ResponseWriter, r *http.Request) {
+		action.BatchUploadHandler(db, store, sc, w, r)
+	})).Methods(http.MethodPost)
+	r.HandleFunc("/upload/{uploadToken}/{fileName}", uploadDeadline(sc, func(w http.ResponseWriter, r *http.Request) {
+		action.UploadHandler(db, store, sc, w, r)
+	}))
+	r.HandleFunc("/upload/{uploadToken}/{fileName}/resumable", func(w http.ResponseWriter, r *http.Request) {
+		action.ResumableInitHandler(db, store, sc, w, r)
+	}).Methods(http.MethodPost)
+	r.HandleFunc("/upload/{uploadToken}/{fileName}/presign", func(w http.ResponseWriter, r *http.Request) {
+		action.PresignHandler(db, store, sc, w, r)
+	}).Methods(http.MethodPost)
+	r.HandleFunc("/upload/{uploadToken}/{fileName}/presign/complete", uploadDeadline(sc, func(w http.ResponseWriter, r *http.Request) {
+		action.PresignCompleteHandler(db, store, sc, w, r)
+	})).Methods(http.MethodPost)
+	resumable := map[string]func(*sql.DB, storage.Storage, *model.ServerConf, http.ResponseWriter, *http.Request){
+		http.MethodHead:   action.ResumableStatusHandler,
+		http.MethodPatch:  action.ResumableChunkHandler,
+		http.MethodPut:    action.ResumableCompleteHandler,
+		http.MethodDelete: action.ResumableAbortHandler,
+	}
+	for method, handler := range resumable {
+		handler := handler
+		r.HandleFunc("/upload/{uploadToken}/{fileName}/resumable/{uploadID}", uploadDeadline(sc, func(w http.ResponseWriter, r *http.Request) {
+			handler(db, store, sc, w, r)
+		})).Methods(method)
+	}
+
+	//image metadata
+	meta := map[string]string{
+		"/{project_id}/meta/{image:.*}":       model.SourceOrigin,
+		"/{project_id}/media/meta/{image:.*}": model.SourceMedia,
+	}
+	for path, source := range meta {
+		source := source
+		r.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			action.MetaHandler(db, store, sc, source, w, r)
+		}).Methods(http.MethodGet, http.MethodHead)
+	}
+
+	//media library api
+	library := []struct {
+		path    string
+		method  string
+		handler func(*sql.DB, storage.Storage, *model.ServerConf, http.ResponseWriter, *http.Request)
+	}{
+		{"/api/projects/{project_id}/folders", http.MethodPost, action.LibraryCreateHandler},
+		{"/api/projects/{project_id}/folders/{id}", http.MethodGet, action.LibraryGetHandler},
+		{"/api/projects/{project_id}/folders/{id}", http.MethodPatch, action.LibraryUpdateHandler},
+		{"/api/projects/{project_id}/folders/{id}", http.MethodDelete, action.LibraryDeleteHandler},
+		{"/api/projects/{project_id}/folders/{id}/children", http.MethodGet, action.LibraryListHandler},
+		{"/api/projects/{project_id}/folders/{id}/upload_token", http.MethodPost, action.LibraryUploadTokenHandler},
+		{"/api/projects/{project_id}/purge", http.MethodPost, action.PurgeHandler},
+		{"/api/projects/{project_id}/srcset", http.MethodGet, action.SrcsetHandler},
+	}
+	for _, route := range library {
+		handler := route.handler
+		r.HandleFunc(route.path, func(w http.ResponseWriter, r *http.Request) {
+			handler(db, store, sc, w, r)
+		}).Methods(route.method)
+	}
+
+	//reverse proxy routes
+	pools := map[string]*balancer.Pool{}
+	stop := func() {
+		for _, pool := range pools {
+			pool.Stop()
+		}
+	}
+	if err := registerRoutes(r, sc, db, store, pools); err != nil {
+		stop()
+		return nil, nil, err
+	}
+
+	corsObj := cors.New(cors.Options{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodHead, http.MethodPatch, http.MethodPut, http.MethodDelete},
+		AllowedHeaders: []string{"Authorization", "Content-Type", "Upload-Length", "Upload-Offset"},
+		ExposedHeaders: []string{"Location", "Upload-Length", "Upload-Offset", "X-Upload-Name"},
+	})
+
+	return corsObj.Handler(r), stop, nil
+}
+
+// uploadDeadline gives the requests of an upload route upload_timeout to be
+// read and answered, in place of the server timeouts.
+func uploadDeadline(sc *model.ServerConf, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		deadline := time.Now().Add(sc.UploadTimeout)
+		if err := rc.SetReadDeadline(deadline); err != nil {
+			util.LogWarning("uploadDeadline : SetReadDeadline", err.Error())
+		}
+		if err := rc.SetWriteDeadline(deadline); err != nil {
+			util.LogWarning("uploadDeadline : SetWriteDeadline", err.Error())
+		}
+		next(w, r)
+	}
+}
+
+// registerRoutes adds the proxy routes of the route table to r, in the order
+// they are configured. Each renderer used by the routes gets one upstream
+// pool, shared by all the routes using it and added to pools.
+func registerRoutes(r *mux.Router, sc *model.ServerConf, db *sql.DB, store storage.Storage, pools map[string]*balancer.Pool) error {
+	for _, name := range config.Renderers(sc) {
+		hosts := rendererHosts(sc, name)
+		if len(hosts) == 0 {
+			continue
+		}
+		pool, err := balancer.NewPool(hosts, sc.Balancer)
+		if err != nil {
+			return err
+		}
+		go pool.HealthCheck(healthPaths[name], 5*time.Second)
+		pools[name] = pool
+	}
+
+	for _, route := range sc.Routes {
+		conf := routeConfig(sc, route, db)
+		rend, err := renderer.New(conf)
+		if err != nil {
+			return err
+		}
+		var transport http.RoundTripper
+		if pool, ok := pools[conf.Renderer]; ok {
+			transport = pool
+		}
+		util.LogInfo("registerRoutes : "+conf.Path, fmt.Sprintf("source %s, renderer %s, smart %t", conf.Source, conf.Renderer, conf.IsSmart))
+		proxy := generateProxy(conf, rend, transport, store)
+		r.HandleFunc(conf.Path, func(w http.ResponseWriter, r *http.Request) {
+			proxy.ServeHTTP(w, r)
+		})
+	}
+	return nil
+}
+
+// routeConfig returns the proxy configuration of a route, filling what the
+// route leaves empty from the server configuration.
+func routeConfig(sc *model.ServerConf, route model.Route, db *sql.DB) model.Config {
+	conf := model.Config{
+		Path:            route.Path,
+		Host:            sc.ThumborHost,
+		IsSmart:         route.Smart,
+		Source:          route.Source,
+		Secret:          sc.ThumborSecret,
+		MysqlServerConn: db,
+		CdnOrigin:       sc.CdnOrigin,
+		BucketName:      sc.BucketName,
+		ResultStorage:   sc.ResultStorage,
+		MediaStorage:    sc.MediaStorage,
+		MediaEndpoint:   sc.MediaEndpoint,
+		Renderer:        sc.Renderer,
+		ImgproxyHost:    sc.ImgproxyHost,
+		ImgproxyKey:     sc.ImgproxyKey,
+		ImgproxySalt:    sc.ImgproxySalt,
+		Server:          sc,
+	}
+	if route.Renderer != "" {
+		conf.Renderer = route.Renderer
+	}
+	if route.BucketName != "" {
+		conf.BucketName = route.BucketName
+	}
+	if route.ResultStorage != "" {
+		conf.ResultStorage = route.ResultStorage
+	}
+	if route.MediaStorage != "" {
+		conf.MediaStorage = route.MediaStorage
+	}
+	if route.MediaEndpoint != "" {
+		conf.MediaEndpoint = route.MediaEndpoint
+	}
+	return conf
+}
+
+// rendererHosts returns the upstreams of a renderer, none for renderers
+// running in-process.
+func rendererHosts(sc *model.ServerConf, name string) []string {
+	hosts := ""
+	switch name {
+	case renderer.Thumbor:
+		hosts = sc.ThumborHosts
+		if hosts == "" {
+			hosts = sc.ThumborHost
+		}
+	case renderer.Imgproxy:
+		hosts = sc.ImgproxyHost
+	}
+
+	list := []string{}
+	for _, host := range strings.Split(hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			list = append(list, host)
+		}
+	}
+	return list
+}
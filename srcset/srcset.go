@@ -0,0 +1,211 @@
+package srcset
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"mime"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/siddhartham/imageutil-thumbor/token"
+)
+
+// Responsive images need one url per width, and per format for <picture>
+// sources. This package builds them the way the proxy routes read them:
+// the route's path with the project, transformation and image filled in,
+// signed with the "sig" query parameter when a signing key is given.
+
+var (
+	sizeExp   = regexp.MustCompile(`^s:(\d*)x(\d*)$|^s:auto$`)
+	formatExp = regexp.MustCompile(`^f:\w+$`)
+	dprExp    = regexp.MustCompile(`^dpr:`)
+	imageExp  = regexp.MustCompile(`\{image(:[^}]*)?\}`)
+)
+
+// Options describes a responsive image.
+type Options struct {
+	// BaseURL is the scheme and host the urls start with.
+	BaseURL string
+	// Route is the path template of the proxy route serving the image, as
+	// configured, e.g. "/{project_id}/{transformation}/smart/{image:.*}".
+	Route     string
+	ProjectID string
+	Image     string
+	// Transformation is applied at every width, its size is replaced by
+	// each width, the height scaled to keep its aspect ratio.
+	Transformation string
+	Widths         []int
+	// Sizes is the sizes attribute, 100vw when empty.
+	Sizes string
+	// Formats are the formats of the <picture> sources, best first, e.g.
+	// avif and webp. The <img> is rendered with the transformation's own.
+	Formats    []string
+	SigningKey string
+}
+
+// Source is a <picture> source.
+type Source struct {
+	Type   string `json:"type"`
+	Srcset string `json:"srcset"`
+	Sizes  string `json:"sizes"`
+}
+
+// Set is the markup of a responsive image.
+type Set struct {
+	Src     string   `json:"src"`
+	Srcset  string   `json:"srcset"`
+	Sizes   string   `json:"sizes"`
+	Sources []Source `json:"sources"`
+}
+
+// Build returns the srcset, sizes and <picture> sources of an image. The
+// src is the largest width.
+func Build(o Options) (*Set, error) {
+	if len(o.Widths) == 0 {
+		return nil, errors.New("At least one width is needed")
+	}
+	widths := append([]int{}, o.Widths...)
+	sort.Ints(widths)
+	if widths[0] <= 0 {
+		return nil, fmt.Errorf("Invalid width %d", widths[0])
+	}
+	sizes := o.Sizes
+	if sizes == "" {
+		sizes = "100vw"
+	}
+
+	set := &Set{Sizes: sizes, Sources: []Source{}}
+	srcset, src, err := buildSrcset(o, widths, "")
+	if err != nil {
+		return nil, err
+	}
+	set.Srcset, set.Src = srcset, src
+	for _, format := range o.Formats {
+		srcset, _, err := buildSrcset(o, widths, format)
+		if err != nil {
+			return nil, err
+		}
+		set.Sources = append(set.Sources, Source{Type: mimeType(format), Srcset: srcset, Sizes: sizes})
+	}
+	return set, nil
+}
+
+// buildSrcset returns the srcset of the widths in format, and the url of
+// the largest.
+func buildSrcset(o Options, widths []int, format string) (string, string, error) {
+	candidates := []string{}
+	last := ""
+	for _, width := range widths {
+		transformation := Resize(o.Transformation, width)
+		if format != "" {
+			transformation = Reformat(transformation, format)
+		}
+		u, err := URL(o, transformation)
+		if err != nil {
+			return "", "", err
+		}
+		candidates = append(candidates, fmt.Sprintf("%s %dw", u, width))
+		last = u
+	}
+	return strings.Join(candidates, ", "), last, nil
+}
+
+// URL returns the url of the image with transformation, by the route.
+func URL(o Options, transformation string) (string, error) {
+	if !strings.Contains(o.Route, "{transformation}") || !imageExp.MatchString(o.Route) {
+		return "", fmt.Errorf("Invalid route %q", o.Route)
+	}
+	p := strings.Replace(o.Route, "{project_id}", o.ProjectID, 1)
+	p = strings.Replace(p, "{transformation}", transformation, 1)
+	p = imageExp.ReplaceAllLiteralString(p, strings.TrimLeft(o.Image, "/"))
+
+	// escaped as the proxy will see it, which the signature is of
+	escaped := (&url.URL{Path: p}).EscapedPath()
+	u := strings.TrimRight(o.BaseURL, "/") + escaped
+	if o.SigningKey != "" {
+		signature, err := token.SignPath(o.SigningKey, escaped)
+		if err != nil {
+			return "", err
+		}
+		u += "?sig=" + url.QueryEscape(signature)
+	}
+	return u, nil
+}
+
+// Resize returns transformation at width: its size replaced, with the
+// height scaled to keep the aspect ratio, or added. Device pixel ratios
+// are dropped, srcset picks by width.
+func Resize(transformation string, width int) string {
+	tokens := []string{}
+	resized := false
+	for _, t := range splitTokens(transformation) {
+		if dprExp.MatchString(t) {
+			continue
+		}
+		if size := sizeExp.FindStringSubmatch(t); size != nil && !resized {
+			w, _ := strconv.Atoi(size[1])
+			h, _ := strconv.Atoi(size[2])
+			height := ""
+			if w > 0 && h > 0 {
+				height = strconv.Itoa(h * width / w)
+			}
+			t, resized = fmt.Sprintf("s:%dx%s", width, height), true
+		}
+		tokens = append(tokens, t)
+	}
+	if !resized {
+		tokens = append([]string{fmt.Sprintf("s:%dx", width)}, tokens...)
+	}
+	return strings.Join(tokens, ",")
+}
+
+// Reformat returns transformation rendered in format.
+func Reformat(transformation string, format string) string {
+	tokens := []string{}
+	for _, t := range splitTokens(transformation) {
+		if !formatExp.MatchString(t) {
+			tokens = append(tokens, t)
+		}
+	}
+	return strings.Join(append(tokens, "f:"+format), ",")
+}
+
+// HTML returns the <picture> markup of the set, or a plain <img> when it
+// has no sources.
+func (s *Set) HTML(alt string) string {
+	img := fmt.Sprintf(`<img src="%s" srcset="%s" sizes="%s" alt="%s">`,
+		html.EscapeString(s.Src), html.EscapeString(s.Srcset), html.EscapeString(s.Sizes), html.EscapeString(alt))
+	if len(s.Sources) == 0 {
+		return img
+	}
+
+	var b strings.Builder
+	b.WriteString("<picture>\n")
+	for _, source := range s.Sources {
+		fmt.Fprintf(&b, "  <source type=\"%s\" srcset=\"%s\" sizes=\"%s\">\n",
+			html.EscapeString(source.Type), html.EscapeString(source.Srcset), html.EscapeString(source.Sizes))
+	}
+	b.WriteString("  " + img + "\n</picture>")
+	return b.String()
+}
+
+func splitTokens(transformation string) []string {
+	tokens := []string{}
+	for _, t := range strings.Split(transformation, ",") {
+		if t != "" {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+func mimeType(format string) string {
+	if t := mime.TypeByExtension("." + format); t != "" {
+		return t
+	}
+	return "image/" + format
+}
@@ -0,0 +1,165 @@
+package srcset
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/siddhartham/imageutil-thumbor/token"
+)
+
+const route = "/{project_id}/{transformation}/smart/{image:.*}"
+
+func TestResize(t *testing.T) {
+	tests := []struct {
+		name           string
+		transformation string
+		width          int
+		want           string
+	}{
+		{"aspect kept", "s:300x200,q:80", 600, "s:600x400,q:80"},
+		{"width only", "s:300x,q:80", 600, "s:600x,q:80"},
+		{"height only", "s:x200", 600, "s:600x"},
+		{"auto", "s:auto,f:webp", 320, "s:320x,f:webp"},
+		{"size added", "q:80,f:webp", 320, "s:320x,q:80,f:webp"},
+		{"empty", "", 320, "s:320x"},
+		{"dpr dropped", "s:300x200,dpr:2,q:80", 150, "s:150x100,q:80"},
+		{"dpr auto dropped", "dpr:auto,s:auto", 640, "s:640x"},
+		{"first size only", "s:300x200,s:100x100", 600, "s:600x400,s:100x100"},
+		{"empty tokens dropped", "s:300x200,,q:80,", 600, "s:600x400,q:80"},
+	}
+	for _, tt := range tests {
+		if got := Resize(tt.transformation, tt.width); got != tt.want {
+			t.Errorf("%s: Resize(%q, %d) = %q, want %q", tt.name, tt.transformation, tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestReformat(t *testing.T) {
+	tests := []struct {
+		transformation string
+		format         string
+		want           string
+	}{
+		{"s:300x,q:80", "webp", "s:300x,q:80,f:webp"},
+		{"s:300x,f:jpeg,q:80", "avif", "s:300x,q:80,f:avif"},
+		{"f:auto", "webp", "f:webp"},
+		{"", "png", "f:png"},
+	}
+	for _, tt := range tests {
+		if got := Reformat(tt.transformation, tt.format); got != tt.want {
+			t.Errorf("Reformat(%q, %q) = %q, want %q", tt.transformation, tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestURL(t *testing.T) {
+	tests := []struct {
+		name  string
+		o     Options
+		want  string
+		valid bool
+	}{
+		{"plain", Options{BaseURL: "https://img.example.com/", Route: route, ProjectID: "p1", Image: "/a/b.jpg"}, "https://img.example.com/p1/s:300x/smart/a/b.jpg", true},
+		{"image pattern", Options{Route: "/{transformation}/{image}", Image: "b.jpg"}, "/s:300x/b.jpg", true},
+		{"escaped", Options{Route: route, ProjectID: "p1", Image: "a b/ü.jpg"}, "/p1/s:300x/smart/a%20b/%C3%BC.jpg", true},
+		{"no transformation", Options{Route: "/{project_id}/{image}"}, "", false},
+		{"no image", Options{Route: "/{project_id}/{transformation}"}, "", false},
+	}
+	for _, tt := range tests {
+		got, err := URL(tt.o, "s:300x")
+		if (err == nil) != tt.valid || got != tt.want {
+			t.Errorf("%s: got %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestURLSigned(t *testing.T) {
+	o := Options{BaseURL: "https://img.example.com", Route: route, ProjectID: "p1", Image: "a b.jpg", SigningKey: "key"}
+	got, err := URL(o, "s:300x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the proxy checks the escaped path it is sent
+	if u.EscapedPath() != "/p1/s:300x/smart/a%20b.jpg" {
+		t.Errorf("got path %q", u.EscapedPath())
+	}
+	if err := token.VerifyPath("key", u.EscapedPath(), u.Query().Get("sig")); err != nil {
+		t.Errorf("signature of %q: %v", got, err)
+	}
+	if err := token.VerifyPath("other", u.EscapedPath(), u.Query().Get("sig")); err == nil {
+		t.Error("signature verified with another key")
+	}
+}
+
+func TestBuild(t *testing.T) {
+	o := Options{
+		BaseURL:        "https://img.example.com",
+		Route:          route,
+		ProjectID:      "p1",
+		Image:          "a.jpg",
+		Transformation: "s:300x200,q:80",
+		Widths:         []int{640, 320},
+		Formats:        []string{"avif", "webp"},
+	}
+	set, err := Build(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "https://img.example.com/p1/"
+	want := &Set{
+		Src:    base + "s:640x426,q:80/smart/a.jpg",
+		Srcset: base + "s:320x213,q:80/smart/a.jpg 320w, " + base + "s:640x426,q:80/smart/a.jpg 640w",
+		Sizes:  "100vw",
+		Sources: []Source{
+			{"image/avif", base + "s:320x213,q:80,f:avif/smart/a.jpg 320w, " + base + "s:640x426,q:80,f:avif/smart/a.jpg 640w", "100vw"},
+			{"image/webp", base + "s:320x213,q:80,f:webp/smart/a.jpg 320w, " + base + "s:640x426,q:80,f:webp/smart/a.jpg 640w", "100vw"},
+		},
+	}
+	if set.Src != want.Src || set.Srcset != want.Srcset || set.Sizes != want.Sizes || len(set.Sources) != len(want.Sources) {
+		t.Fatalf("got %+v, want %+v", set, want)
+	}
+	for i := range want.Sources {
+		if set.Sources[i] != want.Sources[i] {
+			t.Errorf("source %d: got %+v, want %+v", i, set.Sources[i], want.Sources[i])
+		}
+	}
+	// the widths given are not reordered
+	if o.Widths[0] != 640 {
+		t.Errorf("got widths %v", o.Widths)
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		o    Options
+	}{
+		{"no widths", Options{Route: route}},
+		{"zero width", Options{Route: route, Widths: []int{0, 320}}},
+		{"invalid route", Options{Route: "/{image}", Widths: []int{320}}},
+	}
+	for _, tt := range tests {
+		if set, err := Build(tt.o); err == nil {
+			t.Errorf("%s: got %+v, want an error", tt.name, set)
+		}
+	}
+}
+
+func TestHTML(t *testing.T) {
+	set := &Set{Src: "/a.jpg?x=1&y=2", Srcset: "/a.jpg 320w", Sizes: "(max-width: 600px) 100vw"}
+	want := `<img src="/a.jpg?x=1&amp;y=2" srcset="/a.jpg 320w" sizes="(max-width: 600px) 100vw" alt="&#34;a&#34; &lt;b&gt;">`
+	if got := set.HTML(`"a" <b>`); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	set.Sources = []Source{{Type: "image/webp", Srcset: "/a.webp 320w", Sizes: set.Sizes}}
+	got := set.HTML("a")
+	if !strings.HasPrefix(got, "<picture>\n  <source type=\"image/webp\" srcset=\"/a.webp 320w\"") || !strings.HasSuffix(got, "alt=\"a\">\n</picture>") {
+		t.Errorf("got %s", got)
+	}
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FilesystemStorage keeps objects as files under a root directory, for
+// development and single node installs.
+type FilesystemStorage struct {
+	Root string
+}
+
+func NewFilesystemStorage(root string) (*FilesystemStorage, error) {
+	if root == "" {
+		return nil, errors.New("Filesystem storage needs a root directory")
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &FilesystemStorage{Root: root}, nil
+}
+
+// file returns the file of key, which can not escape the root directory.
+func (s *FilesystemStorage) file(key string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+func (s *FilesystemStorage) Put(key string, r io.Reader, contentType string) error {
+	name := s.file(key)
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	// write to a temporary file first so readers never see a partial object
+	tmp, err := ioutil.TempFile(filepath.Dir(name), ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func (s *FilesystemStorage) Get(key string) (io.ReadCloser, *Object, error) {
+	obj, err := s.Stat(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(s.file(key))
+	if err != nil {
+		return nil, nil, fsError(err)
+	}
+	return f, obj, nil
+}
+
+func (s *FilesystemStorage) Delete(key string) error {
+	return fsError(os.Remove(s.file(key)))
+}
+
+func (s *FilesystemStorage) Stat(key string) (*Object, error) {
+	info, err := os.Stat(s.file(key))
+	if err != nil {
+		return nil, fsError(err)
+	}
+	if info.IsDir() {
+		return nil, ErrNotFound
+	}
+	return fsObject(key, info), nil
+}
+
+func (s *FilesystemStorage) List(prefix string) ([]Object, error) {
+	objects := []Object{}
+	err := filepath.Walk(s.Root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".upload-") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Root, name)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) && (!strings.HasPrefix(key, multipartPrefix) || strings.HasPrefix(prefix, multipartPrefix)) {
+			objects = append(objects, *fsObject(key, info))
+		}
+		return nil
+	})
+	return objects, err
+}
+
+func (s *FilesystemStorage) Copy(src string, dst string) error {
+	f, err := os.Open(s.file(src))
+	if err != nil {
+		return fsError(err)
+	}
+	defer f.Close()
+	return s.Put(dst, f, "")
+}
+
+func (s *FilesystemStorage) SignedURL(method string, key string, expires time.Duration, put *Object) (string, http.Header, error) {
+	return "", nil, ErrNotSupported
+}
+
+func (s *FilesystemStorage) CreateMultipart(key string, contentType string) (string, error) {
+	return newUploadID()
+}
+
+func (s *FilesystemStorage) PutPart(key string, uploadID string, number int, data []byte) (Part, error) {
+	return putPart(s, uploadID, number, data)
+}
+
+func (s *FilesystemStorage) CompleteMultipart(key string, uploadID string, parts []Part) error {
+	return completeMultipart(s, key, uploadID, parts, "")
+}
+
+func (s *FilesystemStorage) AbortMultipart(key string, uploadID string) error {
+	return abortMultipart(s, uploadID)
+}
+
+func fsObject(key string, info os.FileInfo) *Object {
+	return &Object{
+		Key:         key,
+		Size:        info.Size(),
+		ContentType: mime.TypeByExtension(path.Ext(key)),
+		ModTime:     info.ModTime(),
+	}
+}
+
+func fsError(err error) error {
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStorage keeps objects in memory, for tests and local development.
+type MemoryStorage struct {
+	mu           sync.RWMutex
+	objects      map[string]memoryObject
+	contentTypes map[string]string
+}
+
+type memoryObject struct {
+	Object
+	data []byte
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		objects:      map[string]memoryObject{},
+		contentTypes: map[string]string{},
+	}
+}
+
+func (s *MemoryStorage) Put(key string, r io.Reader, contentType string) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = memoryObject{
+		Object: Object{
+			Key:         key,
+			Size:        int64(len(data)),
+			ContentType: contentType,
+			ModTime:     time.Now(),
+		},
+		data: data,
+	}
+	return nil
+}
+
+func (s *MemoryStorage) Get(key string) (io.ReadCloser, *Object, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	obj, ok := s.objects[key]
+	if !ok {
+		return nil, nil, ErrNotFound
+	}
+	info := obj.Object
+	return ioutil.NopCloser(bytes.NewReader(obj.data)), &info, nil
+}
+
+func (s *MemoryStorage) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.objects[key]; !ok {
+		return ErrNotFound
+	}
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *MemoryStorage) Stat(key string) (*Object, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	obj, ok := s.objects[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	info := obj.Object
+	return &info, nil
+}
+
+func (s *MemoryStorage) List(prefix string) ([]Object, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	objects := []Object{}
+	for key, obj := range s.objects {
+		if strings.HasPrefix(key, prefix) && (!strings.HasPrefix(key, multipartPrefix) || strings.HasPrefix(prefix, multipartPrefix)) {
+			objects = append(objects, obj.Object)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (s *MemoryStorage) Copy(src string, dst string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[src]
+	if !ok {
+		return ErrNotFound
+	}
+	obj.Key, obj.ModTime = dst, time.Now()
+	s.objects[dst] = obj
+	return nil
+}
+
+func (s *MemoryStorage) SignedURL(method string, key string, expires time.Duration, put *Object) (string, http.Header, error) {
+	return "", nil, ErrNotSupported
+}
+
+func (s *MemoryStorage) CreateMultipart(key string, contentType string) (string, error) {
+	uploadID, err := newUploadID()
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.contentTypes[uploadID] = contentType
+	return uploadID, nil
+}
+
+func (s *MemoryStorage) PutPart(key string, uploadID string, number int, data []byte) (Part, error) {
+	return putPart(s, uploadID, number, data)
+}
+
+func (s *MemoryStorage) CompleteMultipart(key string, uploadID string, parts []Part) error {
+	s.mu.RLock()
+	contentType := s.contentTypes[uploadID]
+	s.mu.RUnlock()
+	return completeMultipart(s, key, uploadID, parts, contentType)
+}
+
+func (s *MemoryStorage) AbortMultipart(key string, uploadID string) error {
+	s.mu.Lock()
+	delete(s.contentTypes, uploadID)
+	s.mu.Unlock()
+	return abortMultipart(s, uploadID)
+}
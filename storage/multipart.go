@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+)
+
+// The filesystem and memory storages keep the parts of a multipart upload
+// as hidden objects and concatenate them on completion.
+
+const multipartPrefix = ".multipart"
+
+func newUploadID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func partKey(uploadID string, number int) string {
+	return path.Join(multipartPrefix, uploadID, fmt.Sprintf("%05d", number))
+}
+
+func putPart(s Storage, uploadID string, number int, data []byte) (Part, error) {
+	if err := s.Put(partKey(uploadID, number), bytes.NewReader(data), "application/octet-stream"); err != nil {
+		return Part{}, err
+	}
+	sum := md5.Sum(data)
+	return Part{Number: number, ETag: hex.EncodeToString(sum[:])}, nil
+}
+
+func completeMultipart(s Storage, key string, uploadID string, parts []Part, contentType string) error {
+	readers := []io.Reader{}
+	for _, part := range parts {
+		r, _, err := s.Get(partKey(uploadID, part.Number))
+		if err != nil {
+			return fmt.Errorf("Part %d : %s", part.Number, err.Error())
+		}
+		defer r.Close()
+		readers = append(readers, r)
+	}
+	if err := s.Put(key, io.MultiReader(readers...), contentType); err != nil {
+		return err
+	}
+	return abortMultipart(s, uploadID)
+}
+
+func abortMultipart(s Storage, uploadID string) error {
+	parts, err := s.List(path.Join(multipartPrefix, uploadID) + "/")
+	if err != nil {
+		return err
+	}
+	for _, part := range parts {
+		if err := s.Delete(part.Key); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// S3Storage keeps objects in an S3 compatible bucket, such as DigitalOcean
+// Spaces. The session is created once and shared by all requests.
+type S3Storage struct {
+	Bucket   string
+	client   *s3.S3
+	uploader *s3manager.Uploader
+}
+
+func NewS3Storage(endpoint string, region string, key string, secret string, bucket string) (*S3Storage, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint: aws.String(endpoint),
+		Region:   aws.String(region),
+		Credentials: credentials.NewStaticCredentialsFromCreds(credentials.Value{
+			AccessKeyID:     key,
+			SecretAccessKey: secret,
+		}),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3Storage{
+		Bucket:   bucket,
+		client:   s3.New(sess),
+		uploader: s3manager.NewUploader(sess),
+	}, nil
+}
+
+func (s *S3Storage) Put(key string, r io.Reader, contentType string) error {
+	_, err := s.uploader.Upload(&s3manager.UploadInput{
+		Bucket:      aws.String(s.Bucket),
+		Key:         aws.String(key),
+		Body:        r,
+		ContentType: aws.String(contentType),
+	})
+	return err
+}
+
+func (s *S3Storage) Get(key string) (io.ReadCloser, *Object, error) {
+	out, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, nil, s3Error(err)
+	}
+
+	return out.Body, &Object{
+		Key:         key,
+		Size:        aws.Int64Value(out.ContentLength),
+		ContentType: aws.StringValue(out.ContentType),
+		ModTime:     aws.TimeValue(out.LastModified),
+	}, nil
+}
+
+func (s *S3Storage) Delete(key string) error {
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	return s3Error(err)
+}
+
+func (s *S3Storage) Stat(key string) (*Object, error) {
+	out, err := s.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+
+	return &Object{
+		Key:         key,
+		Size:        aws.Int64Value(out.ContentLength),
+		ContentType: aws.StringValue(out.ContentType),
+		ModTime:     aws.TimeValue(out.LastModified),
+	}, nil
+}
+
+func (s *S3Storage) List(prefix string) ([]Object, error) {
+	objects := []Object{}
+	err := s.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			objects = append(objects, Object{
+				Key:     aws.StringValue(obj.Key),
+				Size:    aws.Int64Value(obj.Size),
+				ModTime: aws.TimeValue(obj.LastModified),
+			})
+		}
+		return true
+	})
+	return objects, s3Error(err)
+}
+
+// Copy copies src to dst within the bucket, without the object going
+// through this service.
+func (s *S3Storage) Copy(src string, dst string) error {
+	_, err := s.client.CopyObject(&s3.CopyObjectInput{
+		Bucket:     aws.String(s.Bucket),
+		Key:        aws.String(dst),
+		CopySource: aws.String(url.PathEscape(s.Bucket) + "/" + (&url.URL{Path: src}).EscapedPath()),
+	})
+	return s3Error(err)
+}
+
+// SignedURL signs the content type and length of a PUT, which S3 then
+// requires of the upload, and puts the object private.
+func (s *S3Storage) SignedURL(method string, key string, expires time.Duration, put *Object) (string, http.Header, error) {
+	var req *request.Request
+	switch {
+	case method == http.MethodGet:
+		req, _ = s.client.GetObjectRequest(&s3.GetObjectInput{
+			Bucket: aws.String(s.Bucket),
+			Key:    aws.String(key),
+		})
+	case method == http.MethodPut && put != nil:
+		req, _ = s.client.PutObjectRequest(&s3.PutObjectInput{
+			Bucket:        aws.String(s.Bucket),
+			Key:           aws.String(key),
+			ACL:           aws.String(s3.ObjectCannedACLPrivate),
+			ContentType:   aws.String(put.ContentType),
+			ContentLength: aws.Int64(put.Size),
+		})
+	default:
+		return "", nil, ErrNotSupported
+	}
+	return req.PresignRequest(expires)
+}
+
+// s3Error maps the S3 not found errors to ErrNotFound.
+func s3Error(err error) error {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return ErrNotFound
+		}
+	}
+	return err
+}
+
+func (s *S3Storage) CreateMultipart(key string, contentType string) (string, error) {
+	out, err := s.client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(s.Bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.UploadId), nil
+}
+
+func (s *S3Storage) PutPart(key string, uploadID string, number int, data []byte) (Part, error) {
+	out, err := s.client.UploadPart(&s3.UploadPartInput{
+		Bucket:     aws.String(s.Bucket),
+		Key:        aws.String(key),
+		UploadId:   aws.String(uploadID),
+		PartNumber: aws.Int64(int64(number)),
+		Body:       bytes.NewReader(data),
+	})
+	if err != nil {
+		return Part{}, err
+	}
+	return Part{Number: number, ETag: aws.StringValue(out.ETag)}, nil
+}
+
+func (s *S3Storage) CompleteMultipart(key string, uploadID string, parts []Part) error {
+	completed := []*s3.CompletedPart{}
+	for _, part := range parts {
+		completed = append(completed, &s3.CompletedPart{
+			PartNumber: aws.Int64(int64(part.Number)),
+			ETag:       aws.String(part.ETag),
+		})
+	}
+	_, err := s.client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.Bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	return err
+}
+
+func (s *S3Storage) AbortMultipart(key string, uploadID string) error {
+	_, err := s.client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.Bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	return err
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/siddhartham/imageutil-thumbor/model"
+)
+
+const (
+	S3         = "s3"
+	Filesystem = "fs"
+	Memory     = "memory"
+)
+
+var (
+	ErrNotFound     = errors.New("Object not found")
+	ErrNotSupported = errors.New("Not supported by this storage")
+)
+
+// Object describes a stored object.
+type Object struct {
+	Key         string
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+// Storage is where uploaded media is kept. Keys are slash separated paths,
+// relative to the bucket or root directory.
+type Storage interface {
+	Put(key string, r io.Reader, contentType string) error
+	Get(key string) (io.ReadCloser, *Object, error)
+	Delete(key string) error
+	Stat(key string) (*Object, error)
+	List(prefix string) ([]Object, error)
+	// Copy copies the object at src to dst, replacing any object there.
+	Copy(src string, dst string) error
+	// SignedURL returns a url granting method (GET or PUT) on key until it
+	// expires, and the headers the request has to be sent with. A PUT is
+	// only granted for an object of the content type and size of put.
+	SignedURL(method string, key string, expires time.Duration, put *Object) (string, http.Header, error)
+}
+
+// Part is one uploaded part of a multipart upload.
+type Part struct {
+	Number int    `json:"number"`
+	ETag   string `json:"etag"`
+}
+
+// MultipartStorage assembles an object from parts uploaded separately, as
+// S3 multipart uploads do. Parts are numbered from 1.
+type MultipartStorage interface {
+	CreateMultipart(key string, contentType string) (string, error)
+	PutPart(key string, uploadID string, number int, data []byte) (Part, error)
+	CompleteMultipart(key string, uploadID string, parts []Part) error
+	AbortMultipart(key string, uploadID string) error
+}
+
+// New returns the storage driver configured for the server.
+func New(sc *model.ServerConf) (Storage, error) {
+	switch sc.Storage {
+	case "", S3:
+		return NewS3Storage(sc.MediaEndpoint, sc.MediaRegion, sc.SpaceKey, sc.SpaceSecret, sc.BucketName)
+	case Filesystem:
+		return NewFilesystemStorage(sc.StoragePath)
+	case Memory:
+		return NewMemoryStorage(), nil
+	default:
+		return nil, fmt.Errorf("Unknown storage %q", sc.Storage)
+	}
+}
@@ -0,0 +1,270 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/siddhartham/imageutil-thumbor/model"
+)
+
+// drivers returns an empty storage of each driver that needs no service.
+func drivers(t *testing.T) map[string]Storage {
+	t.Helper()
+	fs, err := NewFilesystemStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]Storage{Memory: NewMemoryStorage(), Filesystem: fs}
+}
+
+func put(t *testing.T, s Storage, key string, data string) {
+	t.Helper()
+	if err := s.Put(key, strings.NewReader(data), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func read(t *testing.T, s Storage, key string) string {
+	t.Helper()
+	r, _, err := s.Get(key)
+	if err != nil {
+		t.Fatalf("%s: %v", key, err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func keys(objects []Object) string {
+	names := []string{}
+	for _, obj := range objects {
+		names = append(names, obj.Key)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestPutGet(t *testing.T) {
+	for name, s := range drivers(t) {
+		put(t, s, "photos/a.png", "first")
+		put(t, s, "photos/a.png", "second")
+		if got := read(t, s, "photos/a.png"); got != "second" {
+			t.Errorf("%s: got %q, want %q", name, got, "second")
+		}
+
+		obj, err := s.Stat("photos/a.png")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if obj.Key != "photos/a.png" || obj.Size != 6 || obj.ContentType != "image/png" || obj.ModTime.IsZero() {
+			t.Errorf("%s: got %+v", name, obj)
+		}
+		if _, obj, _ := s.Get("photos/a.png"); obj == nil || obj.Size != 6 {
+			t.Errorf("%s: got object %+v from Get", name, obj)
+		}
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	for name, s := range drivers(t) {
+		put(t, s, "photos/a.png", "a")
+		tests := []struct {
+			op  string
+			err error
+		}{
+			{"get", func() error { _, _, err := s.Get("photos/b.png"); return err }()},
+			{"get folder", func() error { _, _, err := s.Get("photos"); return err }()},
+			{"stat", func() error { _, err := s.Stat("photos/b.png"); return err }()},
+			{"delete", s.Delete("photos/b.png")},
+			{"copy", s.Copy("photos/b.png", "photos/c.png")},
+		}
+		for _, tt := range tests {
+			if tt.err != ErrNotFound {
+				t.Errorf("%s %s: got %v, want %v", name, tt.op, tt.err, ErrNotFound)
+			}
+		}
+	}
+}
+
+func TestListCopyDelete(t *testing.T) {
+	for name, s := range drivers(t) {
+		put(t, s, "photos/b.png", "b")
+		put(t, s, "photos/a.png", "a")
+		put(t, s, "photography/c.png", "c")
+		put(t, s, "other/d.png", "d")
+
+		tests := []struct {
+			prefix string
+			want   string
+		}{
+			{"photos/", "photos/a.png,photos/b.png"},
+			{"photo", "photography/c.png,photos/a.png,photos/b.png"},
+			{"none/", ""},
+			{"", "other/d.png,photography/c.png,photos/a.png,photos/b.png"},
+		}
+		for _, tt := range tests {
+			objects, err := s.List(tt.prefix)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if got := keys(objects); got != tt.want {
+				t.Errorf("%s: List(%q) = %q, want %q", name, tt.prefix, got, tt.want)
+			}
+		}
+
+		if err := s.Copy("photos/a.png", "photos/b.png"); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := read(t, s, "photos/b.png"); got != "a" {
+			t.Errorf("%s: got %q after copy, want %q", name, got, "a")
+		}
+		if got := read(t, s, "photos/a.png"); got != "a" {
+			t.Errorf("%s: copy changed the source to %q", name, got)
+		}
+
+		if err := s.Delete("photos/a.png"); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := s.Stat("photos/a.png"); err != ErrNotFound {
+			t.Errorf("%s: got %v after delete, want %v", name, err, ErrNotFound)
+		}
+	}
+}
+
+func TestSignedURLNotSupported(t *testing.T) {
+	for name, s := range drivers(t) {
+		if _, _, err := s.SignedURL("GET", "a.png", 0, nil); err != ErrNotSupported {
+			t.Errorf("%s: got %v, want %v", name, err, ErrNotSupported)
+		}
+	}
+}
+
+func TestMultipart(t *testing.T) {
+	for name, s := range drivers(t) {
+		m := s.(MultipartStorage)
+		uploadID, err := m.CreateMultipart("photos/a.png", "image/png")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		two, err := m.PutPart("photos/a.png", uploadID, 2, []byte("world"))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		one, err := m.PutPart("photos/a.png", uploadID, 1, []byte("hello "))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if one.Number != 1 || one.ETag == "" || one.ETag == two.ETag {
+			t.Errorf("%s: got parts %+v, %+v", name, one, two)
+		}
+
+		// parts are hidden from listings of the objects
+		if objects, _ := s.List(""); len(objects) != 0 {
+			t.Errorf("%s: got %q listed", name, keys(objects))
+		}
+		if objects, _ := s.List(multipartPrefix + "/" + uploadID + "/"); len(objects) != 2 {
+			t.Errorf("%s: got parts %q", name, keys(objects))
+		}
+
+		if err := m.CompleteMultipart("photos/a.png", uploadID, []Part{one, two}); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := read(t, s, "photos/a.png"); got != "hello world" {
+			t.Errorf("%s: got %q, want %q", name, got, "hello world")
+		}
+		if obj, _ := s.Stat("photos/a.png"); obj == nil || obj.ContentType != "image/png" {
+			t.Errorf("%s: got %+v", name, obj)
+		}
+		if objects, _ := s.List(multipartPrefix); len(objects) != 0 {
+			t.Errorf("%s: parts %q left after completion", name, keys(objects))
+		}
+	}
+}
+
+func TestMultipartAbort(t *testing.T) {
+	for name, s := range drivers(t) {
+		m := s.(MultipartStorage)
+		uploadID, _ := m.CreateMultipart("a.png", "image/png")
+		one, _ := m.PutPart("a.png", uploadID, 1, []byte("hello"))
+
+		if err := m.CompleteMultipart("a.png", uploadID, []Part{one, {Number: 2}}); err == nil {
+			t.Errorf("%s: completed with a missing part", name)
+		}
+		if _, err := s.Stat("a.png"); err != ErrNotFound {
+			t.Errorf("%s: got %v, want no object", name, err)
+		}
+
+		if err := m.AbortMultipart("a.png", uploadID); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if objects, _ := s.List(multipartPrefix); len(objects) != 0 {
+			t.Errorf("%s: parts %q left after abort", name, keys(objects))
+		}
+	}
+}
+
+func TestMemoryGetIsASnapshot(t *testing.T) {
+	s := NewMemoryStorage()
+	put(t, s, "a.png", "first")
+	r, _, err := s.Get("a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, s, "a.png", "second")
+	if data, _ := ioutil.ReadAll(r); string(data) != "first" {
+		t.Errorf("got %q, want %q", data, "first")
+	}
+}
+
+func TestFilesystemKeysStayInRoot(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "root")
+	s, err := NewFilesystemStorage(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, s, "../../outside.png", "a")
+	if _, err := os.Stat(filepath.Join(root, "outside.png")); err != nil {
+		t.Errorf("got %v, want the file in the root", err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(root), "outside.png")); !os.IsNotExist(err) {
+		t.Errorf("got %v, want no file outside the root", err)
+	}
+
+	// temporary files of writes in progress are not listed
+	ioutil.WriteFile(filepath.Join(root, ".upload-123"), []byte("partial"), 0644)
+	if objects, _ := s.List(""); keys(objects) != "outside.png" {
+		t.Errorf("got %q listed", keys(objects))
+	}
+
+	if _, err := NewFilesystemStorage(""); err == nil {
+		t.Error("got a storage without a root")
+	}
+}
+
+func TestNew(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		storage string
+		want    string
+	}{
+		{Memory, "*storage.MemoryStorage"},
+		{Filesystem, "*storage.FilesystemStorage"},
+		{"ftp", ""},
+	}
+	for _, tt := range tests {
+		s, err := New(&model.ServerConf{Storage: tt.storage, StoragePath: dir})
+		got := ""
+		if err == nil {
+			got = fmt.Sprintf("%T", s)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, %v, want %q", tt.storage, got, err, tt.want)
+		}
+	}
+}
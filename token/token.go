@@ -0,0 +1,128 @@
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Upload tokens are JSON Web Tokens signed with HS256, so they can be
+// minted by anything holding the secret and verified without a database
+// lookup.
+
+var (
+	ErrMalformed = errors.New("Malformed upload token")
+	ErrSignature = errors.New("Invalid upload token signature")
+	ErrExpired   = errors.New("Upload token is already expired")
+	ErrNoSecret  = errors.New("No upload token secret is configured")
+)
+
+// header is the only JWT header tokens are minted and accepted with.
+var header = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+const (
+	// ScopeUpload tokens grant uploads to one folder.
+	ScopeUpload = "upload"
+	// ScopeManage tokens grant managing the media library of a project.
+	ScopeManage = "manage"
+)
+
+// Claims is what a token grants until ExpiresAt. Upload tokens grant
+// uploads to one folder of a project; MaxSize, Types and MaxFiles narrow
+// the upload policy of the project, left empty they do not. Manage tokens
+// grant the whole media library of a project. ID tells tokens apart, the
+// files uploaded with a token are counted by it.
+type Claims struct {
+	ID         string   `json:"jti,omitempty"`
+	Scope      string   `json:"scope,omitempty"`
+	UserID     string   `json:"uid"`
+	ProjectID  string   `json:"pid"`
+	FolderID   string   `json:"fid,omitempty"`
+	FolderPath string   `json:"path,omitempty"`
+	IssuedAt   int64    `json:"iat"`
+	ExpiresAt  int64    `json:"exp"`
+	MaxSize    int64    `json:"max_size,omitempty"`
+	Types      []string `json:"types,omitempty"`
+	MaxFiles   int64    `json:"max_files,omitempty"`
+}
+
+// Sign returns the upload token for claims. IssuedAt is set to now and ID
+// to a random one when empty.
+func Sign(secret string, claims Claims) (string, error) {
+	if secret == "" {
+		return "", ErrNoSecret
+	}
+	if claims.IssuedAt == 0 {
+		claims.IssuedAt = time.Now().Unix()
+	}
+	if claims.ID == "" {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return "", err
+		}
+		claims.ID = hex.EncodeToString(id)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + sign(secret, unsigned), nil
+}
+
+// Verify checks the signature and expiry of token and returns its claims,
+// with the scope defaulting to ScopeUpload and the ID to the signature, for
+// tokens signed without one. Callers check the scope.
+func Verify(secret string, token string) (*Claims, error) {
+	if secret == "" {
+		return nil, ErrNoSecret
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != header {
+		return nil, ErrMalformed
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(sign(secret, parts[0]+"."+parts[1]))) {
+		return nil, ErrSignature
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	claims := &Claims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, ErrMalformed
+	}
+	if claims.ProjectID == "" || claims.UserID == "" {
+		return nil, ErrMalformed
+	}
+	if claims.Scope == "" {
+		claims.Scope = ScopeUpload
+	}
+	if claims.ID == "" {
+		claims.ID = parts[2]
+	}
+	if time.Now().Unix() > claims.ExpiresAt {
+		return nil, ErrExpired
+	}
+	return claims, nil
+}
+
+// IsSigned reports whether token looks like a signed token rather than a
+// legacy one.
+func IsSigned(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func sign(secret string, unsigned string) string {
+	hash := hmac.New(sha256.New, []byte(secret))
+	hash.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(hash.Sum(nil))
+}
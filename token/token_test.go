@@ -0,0 +1,157 @@
+package token
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "test-secret"
+
+func validClaims() Claims {
+	return Claims{
+		UserID:    "7",
+		ProjectID: "42",
+		FolderID:  "3",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		MaxSize:   1 << 20,
+		Types:     []string{"jpeg", "png"},
+		MaxFiles:  5,
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	claims := validClaims()
+	signed, err := Sign(testSecret, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSigned(signed) {
+		t.Errorf("IsSigned(%q) = false", signed)
+	}
+
+	got, err := Verify(testSecret, signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Scope != ScopeUpload {
+		t.Errorf("got scope %q, want %q", got.Scope, ScopeUpload)
+	}
+	if got.IssuedAt == 0 {
+		t.Error("IssuedAt was not set")
+	}
+	if len(got.ID) != 32 {
+		t.Errorf("got id %q, want 32 hex digits", got.ID)
+	}
+	if got.ProjectID != claims.ProjectID || got.FolderID != claims.FolderID || got.MaxSize != claims.MaxSize || got.MaxFiles != claims.MaxFiles || strings.Join(got.Types, ",") != "jpeg,png" {
+		t.Errorf("got claims %+v, want %+v", got, claims)
+	}
+
+	// two tokens of the same claims are told apart
+	other, _ := Sign(testSecret, claims)
+	if otherClaims, _ := Verify(testSecret, other); otherClaims == nil || otherClaims.ID == got.ID {
+		t.Error("two tokens got the same id")
+	}
+}
+
+func TestSignKeepsClaims(t *testing.T) {
+	claims := validClaims()
+	claims.ID, claims.IssuedAt, claims.Scope = "token-1", 1000, ScopeManage
+	signed, err := Sign(testSecret, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Verify(testSecret, signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != "token-1" || got.IssuedAt != 1000 || got.Scope != ScopeManage {
+		t.Errorf("got id %q, iat %d, scope %q", got.ID, got.IssuedAt, got.Scope)
+	}
+}
+
+func TestVerifyIDDefaultsToSignature(t *testing.T) {
+	payload, _ := json.Marshal(validClaims())
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signed := unsigned + "." + sign(testSecret, unsigned)
+
+	got, err := Verify(testSecret, signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := signed[strings.LastIndex(signed, ".")+1:]; got.ID != want {
+		t.Errorf("got id %q, want the signature %q", got.ID, want)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	signed, err := Sign(testSecret, validClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(signed, ".")
+
+	expired := validClaims()
+	expired.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	expiredToken, _ := Sign(testSecret, expired)
+
+	noProject := validClaims()
+	noProject.ProjectID = ""
+	noProjectToken, _ := Sign(testSecret, noProject)
+
+	// a payload granting more, under the original signature
+	tampered := validClaims()
+	tampered.MaxSize = 1 << 30
+	tamperedPayload, _ := json.Marshal(tampered)
+
+	otherHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	garbage := header + ".not-base64!." + sign(testSecret, header+".not-base64!")
+
+	tests := []struct {
+		name   string
+		secret string
+		token  string
+		err    error
+	}{
+		{"no secret", "", signed, ErrNoSecret},
+		{"other secret", "other-secret", signed, ErrSignature},
+		{"tampered payload", testSecret, parts[0] + "." + base64.RawURLEncoding.EncodeToString(tamperedPayload) + "." + parts[2], ErrSignature},
+		{"tampered signature", testSecret, parts[0] + "." + parts[1] + "." + strings.Repeat("A", len(parts[2])), ErrSignature},
+		{"other header", testSecret, otherHeader + "." + parts[1] + "." + parts[2], ErrMalformed},
+		{"two parts", testSecret, parts[0] + "." + parts[1], ErrMalformed},
+		{"legacy token", testSecret, "7_42_abc_1700000000", ErrMalformed},
+		{"bad payload", testSecret, garbage, ErrMalformed},
+		{"no project", testSecret, noProjectToken, ErrMalformed},
+		{"expired", testSecret, expiredToken, ErrExpired},
+	}
+	for _, tt := range tests {
+		if _, err := Verify(tt.secret, tt.token); err != tt.err {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestSignWithoutSecret(t *testing.T) {
+	if _, err := Sign("", validClaims()); err != ErrNoSecret {
+		t.Errorf("got %v, want %v", err, ErrNoSecret)
+	}
+}
+
+func TestIsSigned(t *testing.T) {
+	tests := []struct {
+		token string
+		want  bool
+	}{
+		{"a.b.c", true},
+		{"7_42_abc_1700000000", false},
+		{"a.b", false},
+		{"a.b.c.d", false},
+	}
+	for _, tt := range tests {
+		if got := IsSigned(tt.token); got != tt.want {
+			t.Errorf("IsSigned(%q) = %t, want %t", tt.token, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package token
+
+import (
+	"crypto/hmac"
+	"errors"
+)
+
+// Image urls can be signed by the projects handing them out, with the
+// signature of their path in the "sig" query parameter. A signed url names
+// a variant that was meant to be served, so it can be cached for good.
+
+var ErrURLSignature = errors.New("Invalid url signature")
+
+// SignPath returns the signature of an image url path, escaped as sent.
+func SignPath(secret string, path string) (string, error) {
+	if secret == "" {
+		return "", errors.New("No url signing key is configured")
+	}
+	return sign(secret, path), nil
+}
+
+// VerifyPath checks the signature of an image url path.
+func VerifyPath(secret string, path string, signature string) error {
+	expected, err := SignPath(secret, path)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return ErrURLSignature
+	}
+	return nil
+}
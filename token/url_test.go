@@ -0,0 +1,42 @@
+package token
+
+import "testing"
+
+func TestSignPath(t *testing.T) {
+	path := "/42/s:300x200,f:webp/images/cat%20one.jpg"
+	signature, err := SignPath(testSecret, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := SignPath(testSecret, path); again != signature {
+		t.Errorf("signing twice gave %q and %q", signature, again)
+	}
+
+	tests := []struct {
+		name      string
+		secret    string
+		path      string
+		signature string
+		err       error
+	}{
+		{"valid", testSecret, path, signature, nil},
+		{"other path", testSecret, "/42/s:600x400,f:webp/images/cat%20one.jpg", signature, ErrURLSignature},
+		{"unescaped path", testSecret, "/42/s:300x200,f:webp/images/cat one.jpg", signature, ErrURLSignature},
+		{"other secret", "other-secret", path, signature, ErrURLSignature},
+		{"no signature", testSecret, path, "", ErrURLSignature},
+	}
+	for _, tt := range tests {
+		if err := VerifyPath(tt.secret, tt.path, tt.signature); err != tt.err {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestSignPathWithoutSecret(t *testing.T) {
+	if _, err := SignPath("", "/42/s:300x200/cat.jpg"); err == nil {
+		t.Error("SignPath without a secret: got no error")
+	}
+	if err := VerifyPath("", "/42/s:300x200/cat.jpg", "sig"); err == nil {
+		t.Error("VerifyPath without a secret: got no error")
+	}
+}
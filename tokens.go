@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/siddhartham/imageutil-thumbor/config"
+	"github.com/siddhartham/imageutil-thumbor/token"
+)
+
+// mintToken implements `main token mint`, printing a signed token. The token
+// flags come first, the config flags follow a "--", e.g.
+//
+//	main token mint -user 7 -project 3 -folder 12 -path media/12 -expires 24h -- -config /etc/imageutil.yml
+//	main token mint -scope manage -user 7 -project 3
+func mintToken(args []string) (string, error) {
+	fs := flag.NewFlagSet("token mint", flag.ContinueOnError)
+	claims := token.Claims{}
+	fs.StringVar(&claims.Scope, "scope", token.ScopeUpload, "upload, for uploads to a folder, or manage, for the media library api")
+	fs.StringVar(&claims.UserID, "user", "", "id of the user uploading")
+	fs.StringVar(&claims.ProjectID, "project", "", "id of the project")
+	fs.StringVar(&claims.FolderID, "folder", "", "id of the folder uploaded to")
+	fs.StringVar(&claims.FolderPath, "path", "", "path of the folder uploaded to")
+	expires := fs.Duration("expires", 24*time.Hour, "how long the token is valid")
+	fs.Int64Var(&claims.MaxSize, "max-size", 0, "largest file allowed in bytes, 0 for the project's limit")
+	types := fs.String("types", "", "comma separated image formats allowed, empty for the project's")
+	fs.Int64Var(&claims.MaxFiles, "max-files", 0, "how many files can be uploaded, 0 for no limit")
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	switch claims.Scope {
+	case token.ScopeUpload:
+		if claims.UserID == "" || claims.ProjectID == "" || claims.FolderID == "" || claims.FolderPath == "" {
+			return "", errors.New("-user, -project, -folder and -path are required")
+		}
+	case token.ScopeManage:
+		if claims.UserID == "" || claims.ProjectID == "" {
+			return "", errors.New("-user and -project are required")
+		}
+	default:
+		return "", fmt.Errorf("-scope must be %s or %s", token.ScopeUpload, token.ScopeManage)
+	}
+
+	sc, err := config.Load(fs.Args())
+	if err != nil {
+		return "", err
+	}
+
+	claims.ExpiresAt = time.Now().Add(*expires).Unix()
+	for _, format := range strings.Split(*types, ",") {
+		if format = strings.TrimSpace(format); format != "" {
+			claims.Types = append(claims.Types, format)
+		}
+	}
+	signed, err := token.Sign(sc.UploadTokenSecret, claims)
+	if err != nil {
+		return "", fmt.Errorf("Cannot mint token : %s", err.Error())
+	}
+	return signed, nil
+}